@@ -0,0 +1,198 @@
+package bots
+
+import (
+	"anonymous-chat/handlers"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Максимальная длина выражения для /calc
+const maxExprLength = 200
+
+// Calc вычисляет арифметические выражения по команде /calc
+type Calc struct{}
+
+func (Calc) Name() string { return "calc" }
+
+func (Calc) Description() string {
+	return "/calc <выражение> — вычислить выражение с + - * / % ^ и скобками"
+}
+
+func (Calc) OnMessage(ev handlers.BotEvent) {
+	if ev.Command != "calc" {
+		return
+	}
+	if ev.Args == "" || len(ev.Args) > maxExprLength {
+		ev.Whisper("Формат: /calc 2 * (3 + 4)")
+		return
+	}
+
+	result, err := evaluate(ev.Args)
+	if err != nil {
+		ev.Whisper("Ошибка: " + err.Error())
+		return
+	}
+	ev.Reply(fmt.Sprintf("%s = %s", ev.Args, strconv.FormatFloat(result, 'g', 12, 64)))
+}
+
+// exprParser разбирает выражение рекурсивным спуском:
+//
+//	expr   = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = ("-" | "+") unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | "(" expr ")"
+type exprParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+// Максимальная вложенность скобок и унарных операторов
+const maxExprDepth = 50
+
+// evaluate вычисляет значение выражения
+func evaluate(src string) (float64, error) {
+	p := &exprParser{src: src}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return 0, fmt.Errorf("неожиданный символ %q", p.src[p.pos])
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.New("результат не определён")
+	}
+	return v, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek возвращает следующий значимый символ или 0 в конце выражения
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (float64, error) {
+	v, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var rhs float64
+		if rhs, err = p.term(); err == nil {
+			if op == '+' {
+				v += rhs
+			} else {
+				v -= rhs
+			}
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) term() (float64, error) {
+	v, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		p.pos++
+		var rhs float64
+		if rhs, err = p.unary(); err != nil {
+			break
+		}
+		switch {
+		case op == '*':
+			v *= rhs
+		case rhs == 0:
+			err = errors.New("деление на ноль")
+		case op == '/':
+			v /= rhs
+		default:
+			v = math.Mod(v, rhs)
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) unary() (float64, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExprDepth {
+		return 0, errors.New("слишком глубокая вложенность")
+	}
+
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (float64, error) {
+	v, err := p.primary()
+	if err != nil || p.peek() != '^' {
+		return v, err
+	}
+	p.pos++
+	exp, err := p.unary()
+	return math.Pow(v, exp), err
+}
+
+func (p *exprParser) primary() (float64, error) {
+	if p.peek() == '(' {
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("не хватает закрывающей скобки")
+		}
+		p.pos++
+		return v, nil
+	}
+	return p.number()
+}
+
+func (p *exprParser) number() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.' || p.src[p.pos] == ',') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.src) {
+			return 0, errors.New("неожиданный конец выражения")
+		}
+		return 0, fmt.Errorf("неожиданный символ %q", p.src[p.pos])
+	}
+	// Десятичная запятая допускается наравне с точкой
+	v, err := strconv.ParseFloat(strings.ReplaceAll(p.src[start:p.pos], ",", "."), 64)
+	if err != nil {
+		return 0, fmt.Errorf("некорректное число %q", p.src[start:p.pos])
+	}
+	return v, nil
+}
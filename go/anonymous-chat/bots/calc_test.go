@@ -0,0 +1,76 @@
+package bots
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"10 - 4 - 3", 3},
+		{"64 / 4 / 2", 8},
+		{"7 / 2", 3.5},
+		{"10 % 4", 2},
+		{"2 + 10 % 4 * 3", 8},
+		{"2 ^ 3 ^ 2", 512}, // степень правоассоциативна
+		{"-2 ^ 2", -4},     // унарный минус слабее степени
+		{"2 ^ -1", 0.5},
+		{"2 * -3", -6},
+		{"--3", 3},
+		{"+5", 5},
+		{"1,5 + 1.5", 3},
+		{"  ( ( 1 ) )  ", 1},
+		{strings.Repeat("(", 49) + "1" + strings.Repeat(")", 49), 1},
+	}
+	for _, tt := range tests {
+		got, err := evaluate(tt.expr)
+		if err != nil {
+			t.Errorf("evaluate(%q): %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("evaluate(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string // начало текста ошибки
+	}{
+		{"1 / 0", "деление на ноль"},
+		{"5 % 0", "деление на ноль"},
+		{"1 / (2 - 2)", "деление на ноль"},
+		{"10 ^ 400", "результат не определён"},
+		{"(-8) ^ (1 / 3)", "результат не определён"},
+		{strings.Repeat("(", 50) + "1" + strings.Repeat(")", 50), "слишком глубокая вложенность"},
+		{strings.Repeat("-", 100) + "1", "слишком глубокая вложенность"},
+		{strings.Repeat("2^", 100) + "2", "слишком глубокая вложенность"},
+		{"", "неожиданный конец выражения"},
+		{"2 +", "неожиданный конец выражения"},
+		{"(1 + 2", "не хватает закрывающей скобки"},
+		{"1 + 2)", "неожиданный символ ')'"},
+		{"2 3", "неожиданный символ '3'"},
+		{"abc", "неожиданный символ 'a'"},
+		{"1e5", "неожиданный символ 'e'"},
+		{"* 2", "неожиданный символ '*'"},
+		{"1..2", "некорректное число"},
+		{"()", "неожиданный символ ')'"},
+	}
+	for _, tt := range tests {
+		got, err := evaluate(tt.expr)
+		if err == nil {
+			t.Errorf("evaluate(%q) = %v, want error %q", tt.expr, got, tt.want)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("evaluate(%q): err = %q, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package bots содержит встроенных ботов, которые регистрируются при запуске сервера
+// и включаются в отдельных комнатах через административный API.
+package bots
+
+import (
+	"anonymous-chat/handlers"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ограничения на бросок, чтобы ответ оставался коротким
+const (
+	maxDice  = 100
+	maxSides = 1000
+)
+
+// Выражение броска вида 2d6+3
+var diceExpr = regexp.MustCompile(`^(\d*)d(\d+)([+-]\d+)?$`)
+
+// Dice бросает кости по команде /roll NdM[+K]
+type Dice struct{}
+
+func (Dice) Name() string { return "dice" }
+
+func (Dice) Description() string {
+	return "/roll [NdM[+K]] — бросить кости, по умолчанию 1d6"
+}
+
+func (Dice) OnMessage(ev handlers.BotEvent) {
+	if ev.Command != "roll" {
+		return
+	}
+
+	expr, count, sides, modifier, err := parseRoll(ev.Args)
+	if err != nil {
+		ev.Whisper(err.Error())
+		return
+	}
+
+	rolls := make([]string, count)
+	total := modifier
+	for i := range rolls {
+		roll := rand.IntN(sides) + 1
+		total += roll
+		rolls[i] = strconv.Itoa(roll)
+	}
+
+	ev.Reply(fmt.Sprintf("%s бросает %s: [%s] = %d", ev.Message.Nickname, expr, strings.Join(rolls, ", "), total))
+}
+
+// parseRoll разбирает выражение броска и возвращает его в приведённом виде;
+// пустое выражение означает 1d6. Текст ошибки предназначен для отправителя.
+func parseRoll(args string) (expr string, count, sides, modifier int, err error) {
+	expr = strings.ToLower(strings.ReplaceAll(args, " ", ""))
+	if expr == "" {
+		expr = "1d6"
+	}
+	m := diceExpr.FindStringSubmatch(expr)
+	if m == nil {
+		return "", 0, 0, 0, errors.New("Формат: /roll NdM[+K], например /roll 2d6+3")
+	}
+	count = 1
+	if m[1] != "" {
+		count, _ = strconv.Atoi(m[1])
+	}
+	sides, _ = strconv.Atoi(m[2])
+	modifier, _ = strconv.Atoi(m[3])
+	if count < 1 || count > maxDice || sides < 2 || sides > maxSides {
+		return "", 0, 0, 0, fmt.Errorf("Можно бросить от 1 до %d костей с числом граней от 2 до %d", maxDice, maxSides)
+	}
+	return expr, count, sides, modifier, nil
+}
@@ -0,0 +1,34 @@
+package bots
+
+import "testing"
+
+func TestParseRoll(t *testing.T) {
+	tests := []struct {
+		args                   string
+		expr                   string
+		count, sides, modifier int
+	}{
+		{"", "1d6", 1, 6, 0},
+		{"d20", "d20", 1, 20, 0},
+		{"2d6+3", "2d6+3", 2, 6, 3},
+		{" 3 D 8 - 2 ", "3d8-2", 3, 8, -2},
+		{"100d1000", "100d1000", 100, 1000, 0},
+	}
+	for _, tt := range tests {
+		expr, count, sides, modifier, err := parseRoll(tt.args)
+		if err != nil {
+			t.Errorf("parseRoll(%q): %v", tt.args, err)
+			continue
+		}
+		if expr != tt.expr || count != tt.count || sides != tt.sides || modifier != tt.modifier {
+			t.Errorf("parseRoll(%q) = %q %d %d %d, want %q %d %d %d",
+				tt.args, expr, count, sides, modifier, tt.expr, tt.count, tt.sides, tt.modifier)
+		}
+	}
+
+	for _, args := range []string{"6", "2d", "d6+", "2x6", "0d6", "101d6", "1d1", "1d1001", "99999999999999999999d6", "2d6+3+1"} {
+		if _, _, _, _, err := parseRoll(args); err == nil {
+			t.Errorf("parseRoll(%q): want error", args)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package bots
+
+import (
+	"anonymous-chat/handlers"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Ограничения на размер опроса
+const (
+	maxPollOptions = 10
+	maxPollText    = 200
+)
+
+// poll описывает активный опрос комнаты
+type poll struct {
+	question string
+	author   string // ключ личности автора; только он может завершить опрос
+	options  []string
+	votes    map[string]int // голос каждой личности: индекс варианта
+}
+
+// Poll проводит опросы: /poll, /vote, /results, /endpoll.
+// Опросы хранятся в памяти и не переживают перезапуск сервера.
+type Poll struct {
+	mutex sync.Mutex
+	polls map[string]*poll // активный опрос по имени комнаты
+}
+
+// NewPoll создаёт бота опросов
+func NewPoll() *Poll {
+	return &Poll{polls: make(map[string]*poll)}
+}
+
+func (*Poll) Name() string { return "poll" }
+
+func (*Poll) Description() string {
+	return "/poll Вопрос | вариант 1 | вариант 2 — начать опрос; /vote N — проголосовать; /results — итоги; /endpoll — завершить"
+}
+
+func (b *Poll) OnMessage(ev handlers.BotEvent) {
+	switch ev.Command {
+	case "poll":
+		b.start(ev)
+	case "vote":
+		b.vote(ev)
+	case "results":
+		b.mutex.Lock()
+		p := b.polls[ev.Room]
+		var text string
+		if p != nil {
+			text = p.results()
+		}
+		b.mutex.Unlock()
+		if p == nil {
+			ev.Whisper("В комнате нет активного опроса")
+			return
+		}
+		ev.Reply(text)
+	case "endpoll":
+		b.end(ev)
+	}
+}
+
+// parsePoll разбирает аргументы /poll: вопрос и варианты через "|".
+// Текст ошибки предназначен для отправителя.
+func parsePoll(args string) (question string, options []string, err error) {
+	parts := strings.Split(args, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 3 || len(parts) > maxPollOptions+1 || len(args) > maxPollText*len(parts) {
+		return "", nil, fmt.Errorf("Формат: /poll Вопрос | вариант 1 | вариант 2 (от 2 до %d вариантов)", maxPollOptions)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", nil, errors.New("Вопрос и варианты не могут быть пустыми")
+		}
+	}
+	return parts[0], parts[1:], nil
+}
+
+func (b *Poll) start(ev handlers.BotEvent) {
+	question, options, err := parsePoll(ev.Args)
+	if err != nil {
+		ev.Whisper(err.Error())
+		return
+	}
+
+	b.mutex.Lock()
+	if b.polls[ev.Room] != nil {
+		b.mutex.Unlock()
+		ev.Whisper("В комнате уже идёт опрос; завершите его командой /endpoll")
+		return
+	}
+	p := &poll{question: question, author: ev.Identity, options: options, votes: make(map[string]int)}
+	b.polls[ev.Room] = p
+	b.mutex.Unlock()
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s начинает опрос: %s", ev.Message.Nickname, p.question)
+	for i, option := range p.options {
+		fmt.Fprintf(&text, "\n%d. %s", i+1, option)
+	}
+	text.WriteString("\nГолосуйте командой /vote N")
+	ev.Reply(text.String())
+}
+
+func (b *Poll) vote(ev handlers.BotEvent) {
+	if ev.Identity == "" {
+		return
+	}
+	n, err := strconv.Atoi(ev.Args)
+
+	b.mutex.Lock()
+	p := b.polls[ev.Room]
+	ok := p != nil && err == nil && n >= 1 && n <= len(p.options)
+	if ok {
+		p.votes[ev.Identity] = n - 1
+	}
+	b.mutex.Unlock()
+
+	switch {
+	case p == nil:
+		ev.Whisper("В комнате нет активного опроса")
+	case !ok:
+		ev.Whisper(fmt.Sprintf("Укажите номер варианта от 1 до %d", len(p.options)))
+	default:
+		ev.React("✅")
+	}
+}
+
+func (b *Poll) end(ev handlers.BotEvent) {
+	b.mutex.Lock()
+	p := b.polls[ev.Room]
+	allowed := p != nil && p.author == ev.Identity
+	var text string
+	if allowed {
+		delete(b.polls, ev.Room)
+		text = "Опрос завершён. " + p.results()
+	}
+	b.mutex.Unlock()
+
+	switch {
+	case p == nil:
+		ev.Whisper("В комнате нет активного опроса")
+	case !allowed:
+		ev.Whisper("Завершить опрос может только его автор")
+	default:
+		ev.Reply(text)
+	}
+}
+
+// results возвращает текст с итогами; вызывается под мьютексом бота
+func (p *poll) results() string {
+	counts := make([]int, len(p.options))
+	for _, choice := range p.votes {
+		counts[choice]++
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s (голосов: %d)", p.question, len(p.votes))
+	for i, option := range p.options {
+		fmt.Fprintf(&text, "\n%d. %s — %d", i+1, option, counts[i])
+	}
+	return text.String()
+}
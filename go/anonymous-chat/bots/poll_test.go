@@ -0,0 +1,37 @@
+package bots
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePoll(t *testing.T) {
+	question, options, err := parsePoll(" Куда идём? | кино |  парк ")
+	if err != nil {
+		t.Fatalf("parsePoll: %v", err)
+	}
+	if question != "Куда идём?" || !reflect.DeepEqual(options, []string{"кино", "парк"}) {
+		t.Errorf("parsePoll = %q %q", question, options)
+	}
+
+	tooMany := "вопрос" + strings.Repeat(" | вариант", maxPollOptions+1)
+	tooLong := "вопрос | " + strings.Repeat("а", maxPollText*3) + " | б"
+	for _, args := range []string{"", "вопрос", "вопрос | один", "вопрос | | два", " | один | два", tooMany, tooLong} {
+		if _, _, err := parsePoll(args); err == nil {
+			t.Errorf("parsePoll(%q): want error", args)
+		}
+	}
+}
+
+func TestPollResults(t *testing.T) {
+	p := &poll{
+		question: "Куда идём?",
+		options:  []string{"кино", "парк"},
+		votes:    map[string]int{"alice": 1, "bob": 1, "carol": 0},
+	}
+	want := "Куда идём? (голосов: 3)\n1. кино — 1\n2. парк — 2"
+	if got := p.results(); got != want {
+		t.Errorf("results = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package bots
+
+import (
+	"anonymous-chat/handlers"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ограничения на напоминания
+const (
+	maxReminderDelay      = 24 * time.Hour
+	maxRemindersPerPerson = 5
+)
+
+// Reminder отправляет напоминание в комнату по команде /remind <через> <текст>.
+// Напоминания хранятся в памяти и теряются при перезапуске сервера.
+type Reminder struct {
+	mutex   sync.Mutex
+	pending map[string]int // число ожидающих напоминаний по ключу личности
+}
+
+// NewReminder создаёт бота напоминаний
+func NewReminder() *Reminder {
+	return &Reminder{pending: make(map[string]int)}
+}
+
+func (*Reminder) Name() string { return "reminder" }
+
+func (*Reminder) Description() string {
+	return "/remind 10m текст — напомнить через указанное время (до 24h)"
+}
+
+func (b *Reminder) OnMessage(ev handlers.BotEvent) {
+	if ev.Command != "remind" || ev.Identity == "" {
+		return
+	}
+
+	delay, text, ok := parseReminder(ev.Args)
+	if !ok {
+		ev.Whisper("Формат: /remind 10m текст (время от 1s до 24h)")
+		return
+	}
+
+	b.mutex.Lock()
+	if b.pending[ev.Identity] >= maxRemindersPerPerson {
+		b.mutex.Unlock()
+		ev.Whisper(fmt.Sprintf("Можно иметь не больше %d ожидающих напоминаний", maxRemindersPerPerson))
+		return
+	}
+	b.pending[ev.Identity]++
+	b.mutex.Unlock()
+
+	nickname := ev.Message.Nickname
+	time.AfterFunc(delay, func() {
+		b.mutex.Lock()
+		if b.pending[ev.Identity]--; b.pending[ev.Identity] <= 0 {
+			delete(b.pending, ev.Identity)
+		}
+		b.mutex.Unlock()
+		ev.Reply(fmt.Sprintf("%s, напоминание: %s", nickname, text))
+	})
+	ev.React("⏰")
+}
+
+// parseReminder разбирает аргументы /remind: задержку и текст напоминания
+func parseReminder(args string) (time.Duration, string, bool) {
+	delayText, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	delay, err := time.ParseDuration(delayText)
+	if err != nil || delay <= 0 || delay > maxReminderDelay || text == "" {
+		return 0, "", false
+	}
+	return delay, text, true
+}
@@ -0,0 +1,19 @@
+package bots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReminder(t *testing.T) {
+	delay, text, ok := parseReminder("1h30m  купить хлеба ")
+	if !ok || delay != 90*time.Minute || text != "купить хлеба" {
+		t.Errorf("parseReminder = %v %q %v, want 1h30m %q true", delay, text, ok, "купить хлеба")
+	}
+
+	for _, args := range []string{"", "10m", "10m   ", "завтра купить", "0s текст", "-5m текст", "25h текст"} {
+		if _, _, ok := parseReminder(args); ok {
+			t.Errorf("parseReminder(%q): want failure", args)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package certs загружает TLS-сертификат из файлов и подхватывает его
+// замену на диске без перезапуска сервера (например, после продления certbot).
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader хранит текущий сертификат и перечитывает файлы при их изменении
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	version fileVersion
+}
+
+// fileVersion описывает состояние пары файлов на момент загрузки
+type fileVersion struct {
+	certMod, keyMod   time.Time
+	certSize, keySize int64
+}
+
+// NewReloader загружает сертификат и ключ; ошибка означает, что TLS запустить нельзя
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	version, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(version); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate возвращает текущий сертификат; подходит для tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// Watch проверяет файлы с заданным интервалом до отмены контекста.
+// Если новая пара не загружается (например, ключ ещё не записан), продолжает
+// работать старый сертификат, а попытка повторяется на следующей проверке.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			version, err := r.stat()
+			if err != nil {
+				slog.Warn("Не удалось проверить файлы сертификата", "err", err)
+				continue
+			}
+			r.mutex.RLock()
+			changed := version != r.version
+			r.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.load(version); err != nil {
+				slog.Error("Не удалось перезагрузить сертификат, используется прежний", "err", err)
+				continue
+			}
+			slog.Info("Сертификат TLS перезагружен", "cert", r.certFile)
+		}
+	}
+}
+
+// stat возвращает время изменения и размер файлов сертификата и ключа
+func (r *Reloader) stat() (fileVersion, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{
+		certMod:  certInfo.ModTime(),
+		keyMod:   keyInfo.ModTime(),
+		certSize: certInfo.Size(),
+		keySize:  keyInfo.Size(),
+	}, nil
+}
+
+// load читает пару файлов и делает её текущим сертификатом
+func (r *Reloader) load(version fileVersion) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.version = version
+	r.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// Assign записывает обобщённое значение, полученное от Unmarshal, в v —
+// указатель на значение Go — по тем же правилам, что и encoding/json:
+// словари заполняют поля структур по именам из тегов json, null обнуляет
+// указатели, срезы и словари. Так кадр разбирается в структуру без
+// промежуточного JSON. Если disallowUnknownFields, ключи без поля в
+// структуре отклоняются, как json.Decoder.DisallowUnknownFields.
+func Assign(v interface{}, src interface{}, disallowUnknownFields bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("нужен ненулевой указатель, получен %T", v)
+	}
+	a := assigner{strict: disallowUnknownFields}
+	return a.assign(rv.Elem(), src, 0)
+}
+
+type assigner struct {
+	strict bool
+}
+
+func (a assigner) assign(v reflect.Value, src interface{}, depth int) error {
+	if depth > maxDepth {
+		return ErrTooDeep
+	}
+	if src == nil {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			v.SetZero()
+		}
+		return nil
+	}
+
+	// Типы со своим разбором получают строку, как из JSON
+	if v.Kind() != reflect.Pointer && v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		s, ok := src.(string)
+		if !ok {
+			return mismatch(src, v.Type())
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return a.assign(v.Elem(), src, depth+1)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch(src, v.Type())
+		}
+		v.Set(reflect.ValueOf(src))
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch(src, v.Type())
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := toInt(src)
+		if !ok || v.OverflowInt(i) {
+			return mismatch(src, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, ok := toUint(src)
+		if !ok || v.OverflowUint(u) {
+			return mismatch(src, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch n := src.(type) {
+		case float64:
+			f = n
+		case int64:
+			f = float64(n)
+		case uint64:
+			f = float64(n)
+		default:
+			return mismatch(src, v.Type())
+		}
+		if v.OverflowFloat(f) {
+			return mismatch(src, v.Type())
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, ok := src.(string)
+		if !ok {
+			return mismatch(src, v.Type())
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, ok := src.([]byte)
+			if !ok {
+				return mismatch(src, v.Type())
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		items, ok := src.([]interface{})
+		if !ok {
+			return mismatch(src, v.Type())
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := a.assign(slice.Index(i), item, depth+1); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		v.Set(slice)
+	case reflect.Map:
+		entries, ok := src.(map[string]interface{})
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return mismatch(src, v.Type())
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(entries))
+		for key, item := range entries {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := a.assign(elem, item, depth+1); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		entries, ok := src.(map[string]interface{})
+		if !ok {
+			return mismatch(src, v.Type())
+		}
+		fields := structFields(v.Type())
+		for key, item := range entries {
+			f, ok := lookupField(fields, key)
+			if !ok {
+				if a.strict {
+					return fmt.Errorf("неизвестное поле %q", key)
+				}
+				continue
+			}
+			if err := a.assign(fieldForSet(v, f.index), item, depth+1); err != nil {
+				return fmt.Errorf("%s: %w", f.name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("тип не поддерживается: %s", v.Type())
+	}
+	return nil
+}
+
+// lookupField ищет поле по имени; как и в encoding/json, при отсутствии
+// точного совпадения регистр не учитывается
+func lookupField(fields []field, name string) (field, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// fieldForSet возвращает поле для записи, создавая встроенные структуры по nil-указателям
+func fieldForSet(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// toInt приводит число к int64; дробные и слишком большие значения не принимаются
+func toInt(src interface{}) (int64, bool) {
+	switch n := src.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float64:
+		return int64(n), n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64
+	}
+	return 0, false
+}
+
+// toUint приводит число к uint64; отрицательные и дробные значения не принимаются
+func toUint(src interface{}) (uint64, bool) {
+	switch n := src.(type) {
+	case int64:
+		return uint64(n), n >= 0
+	case uint64:
+		return n, true
+	case float64:
+		return uint64(n), n == math.Trunc(n) && n >= 0 && n < math.MaxUint64
+	}
+	return 0, false
+}
+
+func mismatch(src interface{}, t reflect.Type) error {
+	return fmt.Errorf("значение %T нельзя записать в %s", src, t)
+}
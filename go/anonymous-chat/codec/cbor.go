@@ -0,0 +1,358 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// CBOR кодирует сообщения в формате CBOR (RFC 8949)
+var CBOR Codec = cborCodec{}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return SubprotocolCBOR }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	w := &cborWriter{buf: make([]byte, 0, 256)}
+	if err := encodeValue(w, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (cborCodec) Unmarshal(data []byte) (interface{}, error) {
+	if len(data) > MaxFrameSize {
+		return nil, ErrTooLarge
+	}
+	r := &cborReader{data: data}
+	v, err := r.readItem(0)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(data) {
+		return nil, fmt.Errorf("лишние данные после значения: %d байт", len(data)-r.pos)
+	}
+	return v, nil
+}
+
+// Основные типы CBOR
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// Дополнительное значение заголовка для неопределённой длины и break
+const cborIndefinite = 31
+
+// cborWriter записывает примитивы CBOR в буфер
+type cborWriter struct {
+	buf []byte
+}
+
+// head записывает заголовок элемента с основным типом и аргументом
+func (w *cborWriter) head(major byte, arg uint64) {
+	m := major << 5
+	switch {
+	case arg < 24:
+		w.buf = append(w.buf, m|byte(arg))
+	case arg <= math.MaxUint8:
+		w.buf = append(w.buf, m|24, byte(arg))
+	case arg <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, m|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, m|26), uint32(arg))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, m|27), arg)
+	}
+}
+
+func (w *cborWriter) writeNil() { w.buf = append(w.buf, 0xf6) }
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 0xf5)
+	} else {
+		w.buf = append(w.buf, 0xf4)
+	}
+}
+
+func (w *cborWriter) writeInt(i int64) {
+	if i >= 0 {
+		w.head(cborUint, uint64(i))
+	} else {
+		w.head(cborNegint, uint64(-1-i))
+	}
+}
+
+func (w *cborWriter) writeUint(u uint64) { w.head(cborUint, u) }
+
+func (w *cborWriter) writeFloat(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xfb), math.Float64bits(f))
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.head(cborText, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.head(cborBytes, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *cborWriter) writeArrayHeader(n int) { w.head(cborArray, uint64(n)) }
+func (w *cborWriter) writeMapHeader(n int)   { w.head(cborMap, uint64(n)) }
+
+// errBreak сообщает о маркере конца элемента неопределённой длины
+var errBreak = errors.New("неожиданный break")
+
+// cborReader разбирает CBOR в обобщённые значения
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *cborReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, ErrTruncated
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// atBreak пропускает маркер break, если он следующий
+func (r *cborReader) atBreak() bool {
+	if r.pos < len(r.data) && r.data[r.pos] == 0xff {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+// argument читает аргумент заголовка по дополнительному значению ai
+func (r *cborReader) argument(ai byte) (uint64, error) {
+	if ai < 24 {
+		return uint64(ai), nil
+	}
+	if ai > 27 {
+		return 0, fmt.Errorf("некорректный заголовок CBOR: %d", ai)
+	}
+	raw, err := r.next(1 << (ai - 24))
+	if err != nil {
+		return 0, err
+	}
+	var arg uint64
+	for _, x := range raw {
+		arg = arg<<8 | uint64(x)
+	}
+	return arg, nil
+}
+
+// readItem читает один элемент данных
+func (r *cborReader) readItem(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, ai := b[0]>>5, b[0]&0x1f
+
+	if major == cborSimple {
+		return r.readSimple(ai)
+	}
+	if ai == cborIndefinite {
+		return r.readIndefinite(major, depth)
+	}
+	arg, err := r.argument(ai)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if arg <= math.MaxInt64 {
+			return int64(arg), nil
+		}
+		return arg, nil
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("отрицательное число вне диапазона int64")
+		}
+		return -1 - int64(arg), nil
+	case cborBytes:
+		raw, err := r.next(arg)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case cborText:
+		raw, err := r.next(arg)
+		if err != nil {
+			return nil, err
+		}
+		return string(raw), nil
+	case cborArray:
+		// Каждый элемент занимает хотя бы байт, поэтому длина не может превышать остаток данных
+		if arg > uint64(len(r.data)-r.pos) {
+			return nil, ErrTruncated
+		}
+		arr := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := r.readItem(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMap:
+		if arg > uint64(len(r.data)-r.pos) {
+			return nil, ErrTruncated
+		}
+		m := make(map[string]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			if err := r.readEntry(m, depth); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	// Тег (например, дата) не меняет схему: используется помеченное значение
+	return r.readItem(depth + 1)
+}
+
+// readEntry читает пару ключ-значение словаря
+func (r *cborReader) readEntry(m map[string]interface{}, depth int) error {
+	k, err := r.readItem(depth + 1)
+	if err != nil {
+		return err
+	}
+	key, ok := k.(string)
+	if !ok {
+		return fmt.Errorf("ключ словаря должен быть строкой, получен %T", k)
+	}
+	v, err := r.readItem(depth + 1)
+	if err != nil {
+		return err
+	}
+	m[key] = v
+	return nil
+}
+
+// readIndefinite читает строку, массив или словарь неопределённой длины
+func (r *cborReader) readIndefinite(major byte, depth int) (interface{}, error) {
+	switch major {
+	case cborBytes, cborText:
+		// Строка состоит из фрагментов того же типа определённой длины
+		var buf []byte
+		for !r.atBreak() {
+			if r.pos >= len(r.data) {
+				return nil, ErrTruncated
+			}
+			if r.data[r.pos]>>5 != major || r.data[r.pos]&0x1f == cborIndefinite {
+				return nil, errors.New("некорректный фрагмент строки")
+			}
+			v, err := r.readItem(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch chunk := v.(type) {
+			case []byte:
+				buf = append(buf, chunk...)
+			case string:
+				buf = append(buf, chunk...)
+			}
+		}
+		if major == cborText {
+			return string(buf), nil
+		}
+		return buf, nil
+	case cborArray:
+		arr := []interface{}{}
+		for !r.atBreak() {
+			v, err := r.readItem(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMap:
+		m := make(map[string]interface{})
+		for !r.atBreak() {
+			if err := r.readEntry(m, depth); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("неопределённая длина недопустима для типа %d", major)
+}
+
+// readSimple читает простые значения и числа с плавающей точкой
+func (r *cborReader) readSimple(ai byte) (interface{}, error) {
+	switch ai {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null и undefined
+		return nil, nil
+	case 25:
+		raw, err := r.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return halfToFloat(binary.BigEndian.Uint16(raw)), nil
+	case 26:
+		raw, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+	case 27:
+		raw, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+	case cborIndefinite:
+		return nil, errBreak
+	}
+	return nil, fmt.Errorf("неподдерживаемое простое значение CBOR: %d", ai)
+}
+
+// halfToFloat преобразует число половинной точности (IEEE 754 binary16)
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		v = -v
+	}
+	return v
+}
@@ -0,0 +1,282 @@
+// Package codec кодирует сообщения протокола чата в бинарные форматы MessagePack и CBOR.
+//
+// Схема данных та же, что и в JSON: структуры кодируются как словари с именами
+// полей из тегов json (с учётом omitempty и "-"), значения с MarshalText — строками.
+// Входящие данные разбираются в обобщённые значения (map[string]interface{},
+// []interface{}, string, []byte, int64, uint64, float64, bool, nil), которые
+// можно без потерь передать в encoding/json или записать в структуру через Assign.
+package codec
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Codec кодирует и декодирует сообщения в одном формате
+type Codec interface {
+	Name() string // имя подпротокола WebSocket
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// Подпротоколы WebSocket в порядке предпочтения сервера
+const (
+	SubprotocolMsgPack = "chat.msgpack"
+	SubprotocolCBOR    = "chat.cbor"
+	SubprotocolJSON    = "chat.json"
+)
+
+// Максимальная вложенность при кодировании и разборе
+const maxDepth = 64
+
+// MaxFrameSize — максимальный размер входящего кадра в байтах; WebSocket
+// ограничивает им чтение, а Unmarshal отклоняет данные длиннее
+const MaxFrameSize = 64 << 10
+
+// Ошибки разбора
+var (
+	ErrTruncated = errors.New("данные обрезаны")
+	ErrTooDeep   = errors.New("слишком глубокая вложенность")
+	ErrTooLarge  = errors.New("кадр слишком большой")
+)
+
+// byName содержит бинарные кодеки по имени подпротокола
+var byName = map[string]Codec{
+	SubprotocolMsgPack: MsgPack,
+	SubprotocolCBOR:    CBOR,
+}
+
+// ForSubprotocol возвращает кодек для подпротокола или nil для JSON
+func ForSubprotocol(name string) Codec {
+	return byName[name]
+}
+
+// Subprotocols возвращает подпротоколы, которые сервер предлагает при upgrade
+func Subprotocols() []string {
+	return []string{SubprotocolMsgPack, SubprotocolCBOR, SubprotocolJSON}
+}
+
+// writer — примитивы конкретного бинарного формата
+type writer interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(i int64)
+	writeUint(u uint64)
+	writeFloat(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+}
+
+// field описывает поле структуры, попадающее в словарь
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// Поля структур по типу; вычисляются один раз
+var fieldCache sync.Map
+
+// structFields возвращает кодируемые поля структуры по правилам encoding/json
+func structFields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		// Встроенная структура без имени в теге раскрывается в родительскую
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, inner := range structFields(ft) {
+					inner.index = append([]int{i}, inner.index...)
+					fields = append(fields, inner)
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// isEmpty повторяет правила omitempty из encoding/json
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// fieldByIndex возвращает поле; ok равно false, если по пути встретился nil-указатель
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// encodeValue записывает значение через примитивы формата
+func encodeValue(w writer, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return ErrTooDeep
+	}
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+
+	// Типы со своей сериализацией кодируются так же, как в JSON
+	if v.Kind() != reflect.Pointer && v.Kind() != reflect.Interface {
+		if v.Type().Implements(textMarshalerType) {
+			text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				return err
+			}
+			w.writeString(string(text))
+			return nil
+		}
+		if v.Type().Implements(jsonMarshalerType) {
+			return encodeViaJSON(w, v.Interface(), depth)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encodeValue(w, v.Elem(), depth+1)
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.writeFloat(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		w.writeArrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(w, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("ключи словаря должны быть строками: %s", v.Type())
+		}
+		w.writeMapHeader(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			w.writeString(iter.Key().String())
+			if err := encodeValue(w, iter.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		values := make([]reflect.Value, len(fields))
+		count := 0
+		for i, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			values[i] = fv
+			count++
+		}
+		w.writeMapHeader(count)
+		for i, f := range fields {
+			if !values[i].IsValid() {
+				continue
+			}
+			w.writeString(f.name)
+			if err := encodeValue(w, values[i], depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("тип не поддерживается: %s", v.Type())
+	}
+	return nil
+}
+
+// encodeViaJSON кодирует значение с собственным MarshalJSON через обобщённое представление
+func encodeViaJSON(w writer, v interface{}, depth int) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return encodeValue(w, reflect.ValueOf(generic), depth+1)
+}
@@ -0,0 +1,459 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonCodec — текстовый протокол в виде Codec, чтобы бинарные форматы
+// проверялись на тех же данных. Числа не приводятся к float64, как и при
+// разборе кадров в структуры.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return SubprotocolJSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("лишние данные после значения")
+	}
+	return v, nil
+}
+
+// canonicalJSON кодирует значение в JSON с ключами словарей по алфавиту,
+// как после разбора в обобщённые значения
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	generic, err := jsonCodec{}.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
+
+var allCodecs = []Codec{jsonCodec{}, MsgPack, CBOR}
+
+var binaryCodecs = []Codec{MsgPack, CBOR}
+
+type textID int
+
+func (id textID) MarshalText() ([]byte, error) {
+	return []byte("id-" + strings.Repeat("x", int(id))), nil
+}
+
+type sample struct {
+	Name     string `json:"name"`
+	Count    int    `json:"count,omitempty"`
+	Skipped  string `json:"-"`
+	Untagged bool
+	Ptr      *sample           `json:"ptr,omitempty"`
+	Tags     []string          `json:"tags"`
+	Extra    map[string]int    `json:"extra,omitempty"`
+	ID       textID            `json:"id"`
+	At       time.Time         `json:"at"`
+	Raw      json.RawMessage   `json:"raw,omitempty"`
+	Any      interface{}       `json:"any"`
+	Nested   map[string]sample `json:"nested,omitempty"`
+}
+
+// Значения на границах длин и диапазонов, где форматы меняют заголовок
+var roundTripValues = []struct {
+	name  string
+	value interface{}
+}{
+	{"nil", nil},
+	{"true", true},
+	{"false", false},
+	{"zero", 0},
+	{"fixint max", 127},
+	{"uint8", 255},
+	{"uint16", 65535},
+	{"uint32", uint32(math.MaxUint32)},
+	{"int64 max", int64(math.MaxInt64)},
+	{"uint64 max", uint64(math.MaxUint64)},
+	{"negative fixint", -32},
+	{"int8", -128},
+	{"int16", -32768},
+	{"int32", int32(math.MinInt32)},
+	{"int64 min", int64(math.MinInt64)},
+	{"float", 1.5},
+	{"float small", -1e-300},
+	{"empty string", ""},
+	{"unicode string", "привет, 世界"},
+	{"string 23", strings.Repeat("a", 23)},
+	{"string 24", strings.Repeat("a", 24)},
+	{"string 31", strings.Repeat("a", 31)},
+	{"string 32", strings.Repeat("a", 32)},
+	{"string 255", strings.Repeat("a", 255)},
+	{"string 256", strings.Repeat("a", 256)},
+	{"string 60000", strings.Repeat("a", 60000)},
+	{"bytes", []byte{0, 1, 2, 0xff}},
+	{"empty array", []interface{}{}},
+	{"array 15", make([]int, 15)},
+	{"array 16", make([]int, 16)},
+	{"array 256", make([]bool, 256)},
+	{"mixed array", []interface{}{1, "a", nil, true, 2.5, []int{1}}},
+	{"empty map", map[string]interface{}{}},
+	{"map 16", func() map[string]int {
+		m := make(map[string]int)
+		for i := 0; i < 16; i++ {
+			m[strings.Repeat("k", i+1)] = i
+		}
+		return m
+	}()},
+	{"nested map", map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": nil}}}}},
+	{"struct", sample{
+		Name:     "room",
+		Skipped:  "secret",
+		Untagged: true,
+		Ptr:      &sample{Name: "inner", Count: 3},
+		Tags:     []string{"a", "b"},
+		Extra:    map[string]int{"x": 1},
+		ID:       5,
+		At:       time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC),
+		Raw:      json.RawMessage(`{"k":[1,2]}`),
+		Any:      map[string]interface{}{"v": 1},
+		Nested:   map[string]sample{"n": {Name: "n"}},
+	}},
+	{"struct empty", sample{}},
+	{"nil pointer", (*sample)(nil)},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range allCodecs {
+		for _, tt := range roundTripValues {
+			t.Run(c.Name()+"/"+tt.name, func(t *testing.T) {
+				want, err := canonicalJSON(tt.value)
+				if err != nil {
+					t.Fatalf("canonicalJSON: %v", err)
+				}
+				data, err := c.Marshal(tt.value)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				v, err := c.Unmarshal(data)
+				if err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				got, err := json.Marshal(v)
+				if err != nil {
+					t.Fatalf("json.Marshal of decoded value: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("round trip = %.200s, want %.200s", got, want)
+				}
+			})
+		}
+	}
+}
+
+// Кодирование сверяется с примерами из спецификаций форматов
+func TestEncodingVectors(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		value interface{}
+		want  []byte
+	}{
+		{MsgPack, map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{MsgPack, []interface{}{nil, true, false}, []byte{0x93, 0xc0, 0xc3, 0xc2}},
+		{MsgPack, -33, []byte{0xd0, 0xdf}},
+		{MsgPack, 256, []byte{0xcd, 0x01, 0x00}},
+		{MsgPack, strings.Repeat("a", 32), append([]byte{0xd9, 32}, strings.Repeat("a", 32)...)},
+		{CBOR, map[string]int{"a": 1}, []byte{0xa1, 0x61, 'a', 0x01}},
+		{CBOR, []interface{}{nil, true, false}, []byte{0x83, 0xf6, 0xf5, 0xf4}},
+		{CBOR, -1, []byte{0x20}},
+		{CBOR, 1000, []byte{0x19, 0x03, 0xe8}},
+		{CBOR, []byte{1, 2}, []byte{0x42, 0x01, 0x02}},
+	}
+	for _, tt := range tests {
+		got, err := tt.codec.Marshal(tt.value)
+		if err != nil {
+			t.Errorf("%s Marshal(%v): %v", tt.codec.Name(), tt.value, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s Marshal(%v) = % x, want % x", tt.codec.Name(), tt.value, got, tt.want)
+		}
+	}
+}
+
+// Разбор возможностей CBOR, которые сервер сам не порождает
+func TestCBORDecodeExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"indefinite string", []byte{0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff}, `"abc"`},
+		{"indefinite array", []byte{0x9f, 0x01, 0x02, 0xff}, `[1,2]`},
+		{"indefinite map", []byte{0xbf, 0x61, 'a', 0x01, 0xff}, `{"a":1}`},
+		{"tagged value", []byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, `1363896240`},
+		{"half float", []byte{0xf9, 0x3c, 0x00}, `1`},
+		{"single float", []byte{0xfa, 0x3f, 0xc0, 0x00, 0x00}, `1.5`},
+		{"undefined", []byte{0xf7}, `null`},
+	}
+	for _, tt := range tests {
+		v, err := CBOR.Unmarshal(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, _ := json.Marshal(v)
+		if string(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Любой обрезанный кадр должен отклоняться, а не разбираться частично
+func TestUnmarshalTruncated(t *testing.T) {
+	value := map[string]interface{}{
+		"v":       1,
+		"op":      "message.send",
+		"id":      strings.Repeat("i", 40),
+		"payload": map[string]interface{}{"type": "text", "content": strings.Repeat("т", 200), "reply_to": 1 << 40, "waveform": []int{0, 50, 100}},
+	}
+	for _, c := range allCodecs {
+		data, err := c.Marshal(value)
+		if err != nil {
+			t.Fatalf("%s Marshal: %v", c.Name(), err)
+		}
+		for n := 0; n < len(data); n++ {
+			if _, err := c.Unmarshal(data[:n]); err == nil {
+				t.Errorf("%s: Unmarshal of %d of %d bytes succeeded", c.Name(), n, len(data))
+			}
+		}
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	huge := bytes.Repeat([]byte{0xff}, 8)
+	deep := func(open, leaf byte) []byte {
+		return append(bytes.Repeat([]byte{open}, maxDepth+1), leaf)
+	}
+	tests := []struct {
+		name  string
+		codec Codec
+		data  []byte
+		want  error
+	}{
+		{"msgpack string length", MsgPack, append([]byte{0xdb}, huge[:4]...), ErrTruncated},
+		{"msgpack bytes length", MsgPack, append([]byte{0xc6}, huge[:4]...), ErrTruncated},
+		{"msgpack array length", MsgPack, append([]byte{0xdd}, huge[:4]...), ErrTruncated},
+		{"msgpack map length", MsgPack, append([]byte{0xdf}, huge[:4]...), ErrTruncated},
+		{"msgpack depth", MsgPack, deep(0x91, 0xc0), ErrTooDeep},
+		{"msgpack oversized", MsgPack, append([]byte{0xdb, 0x00, 0x01, 0x00, 0x00}, make([]byte, MaxFrameSize)...), ErrTooLarge},
+		{"msgpack trailing data", MsgPack, []byte{0xc0, 0xc0}, nil},
+		{"msgpack non-string key", MsgPack, []byte{0x81, 0x01, 0x01}, nil},
+		{"msgpack unknown type", MsgPack, []byte{0xc1}, nil},
+		{"cbor string length", CBOR, append([]byte{0x7b}, huge...), ErrTruncated},
+		{"cbor bytes length", CBOR, append([]byte{0x5b}, huge...), ErrTruncated},
+		{"cbor array length", CBOR, append([]byte{0x9b}, huge...), ErrTruncated},
+		{"cbor map length", CBOR, append([]byte{0xbb}, huge...), ErrTruncated},
+		{"cbor depth", CBOR, deep(0x81, 0xf6), ErrTooDeep},
+		{"cbor indefinite depth", CBOR, deep(0x9f, 0xf6), ErrTooDeep},
+		{"cbor tag depth", CBOR, deep(0xc1, 0xf6), ErrTooDeep},
+		{"cbor oversized", CBOR, append([]byte{0x5a, 0x00, 0x01, 0x00, 0x00}, make([]byte, MaxFrameSize)...), ErrTooLarge},
+		{"cbor trailing data", CBOR, []byte{0xf6, 0xf6}, nil},
+		{"cbor unterminated indefinite", CBOR, []byte{0x9f, 0x01}, nil},
+		{"cbor stray break", CBOR, []byte{0xff}, nil},
+		{"cbor non-string key", CBOR, []byte{0xa1, 0x01, 0x01}, nil},
+		{"cbor reserved header", CBOR, []byte{0x1c}, nil},
+	}
+	for _, tt := range tests {
+		_, err := tt.codec.Unmarshal(tt.data)
+		if err == nil {
+			t.Errorf("%s: Unmarshal succeeded", tt.name)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Кадр ровно предельного размера ещё принимается
+func TestUnmarshalMaxFrameSize(t *testing.T) {
+	for _, c := range binaryCodecs {
+		var value []byte
+		for n := MaxFrameSize - 16; ; n++ {
+			data, err := c.Marshal(make([]byte, n))
+			if err != nil {
+				t.Fatalf("%s Marshal: %v", c.Name(), err)
+			}
+			if len(data) == MaxFrameSize {
+				value = data
+				break
+			}
+			if len(data) > MaxFrameSize {
+				t.Fatalf("%s: no encoding of exactly %d bytes", c.Name(), MaxFrameSize)
+			}
+		}
+		if _, err := c.Unmarshal(value); err != nil {
+			t.Errorf("%s: Unmarshal of %d bytes: %v", c.Name(), len(value), err)
+		}
+		if _, err := c.Unmarshal(append(value, 0)); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: Unmarshal of %d bytes: err = %v, want %v", c.Name(), len(value)+1, err, ErrTooLarge)
+		}
+	}
+}
+
+func TestMarshalTooDeep(t *testing.T) {
+	var v interface{} = "leaf"
+	for i := 0; i <= maxDepth+1; i++ {
+		v = []interface{}{v}
+	}
+	for _, c := range binaryCodecs {
+		if _, err := c.Marshal(v); !errors.Is(err, ErrTooDeep) {
+			t.Errorf("%s Marshal: err = %v, want %v", c.Name(), err, ErrTooDeep)
+		}
+	}
+}
+
+func TestForSubprotocol(t *testing.T) {
+	for _, name := range Subprotocols() {
+		c := ForSubprotocol(name)
+		if name == SubprotocolJSON {
+			if c != nil {
+				t.Errorf("ForSubprotocol(%q) = %v, want nil", name, c)
+			}
+			continue
+		}
+		if c == nil || c.Name() != name {
+			t.Errorf("ForSubprotocol(%q) = %v", name, c)
+		}
+	}
+	if c := ForSubprotocol("chat.xml"); c != nil {
+		t.Errorf("ForSubprotocol(unknown) = %v, want nil", c)
+	}
+}
+
+type assignSample struct {
+	Name    string                  `json:"name"`
+	Count   int                     `json:"count,omitempty"`
+	Small   uint8                   `json:"small"`
+	Ratio   float32                 `json:"ratio"`
+	Ptr     *assignSample           `json:"ptr,omitempty"`
+	Tags    []string                `json:"tags"`
+	Items   []assignItem            `json:"items"`
+	Extra   map[string]int          `json:"extra,omitempty"`
+	Nested  map[string]assignSample `json:"nested,omitempty"`
+	At      time.Time               `json:"at"`
+	Data    []byte                  `json:"data"`
+	Any     interface{}             `json:"any"`
+	Skipped string                  `json:"-"`
+}
+
+type assignItem struct {
+	ID   int64  `json:"id"`
+	Flag bool   `json:"flag,omitempty"`
+	Text string `json:"text"`
+}
+
+// Значение, закодированное кодеком, записывается обратно в ту же структуру
+func TestAssignRoundTrip(t *testing.T) {
+	want := assignSample{
+		Name:   "room",
+		Count:  -3,
+		Small:  255,
+		Ratio:  0.5,
+		Ptr:    &assignSample{Name: "inner", Tags: []string{}},
+		Tags:   []string{"a", "b"},
+		Items:  []assignItem{{ID: math.MaxInt64, Flag: true, Text: "x"}, {ID: math.MinInt64}},
+		Extra:  map[string]int{"x": 1},
+		Nested: map[string]assignSample{"n": {Name: "n"}},
+		At:     time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC),
+		Data:   []byte{0, 1, 0xff},
+		Any:    map[string]interface{}{"v": int64(1)},
+	}
+	for _, c := range binaryCodecs {
+		data, err := c.Marshal(want)
+		if err != nil {
+			t.Fatalf("%s Marshal: %v", c.Name(), err)
+		}
+		v, err := c.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s Unmarshal: %v", c.Name(), err)
+		}
+		var got assignSample
+		if err := Assign(&got, v, true); err != nil {
+			t.Fatalf("%s Assign: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s Assign = %+v, want %+v", c.Name(), got, want)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	type node struct {
+		Next *node `json:"next"`
+	}
+	var deep interface{} = map[string]interface{}{}
+	for i := 0; i < maxDepth; i++ {
+		deep = map[string]interface{}{"next": deep}
+	}
+
+	tests := []struct {
+		name    string
+		src     interface{}
+		strict  bool
+		wantErr bool
+	}{
+		{"unknown field", map[string]interface{}{"name": "a", "admin": true}, false, false},
+		{"unknown field strict", map[string]interface{}{"name": "a", "admin": true}, true, true},
+		{"case-insensitive name", map[string]interface{}{"NAME": "a"}, true, false},
+		{"skipped field strict", map[string]interface{}{"Skipped": "a"}, true, true},
+		{"string into int", map[string]interface{}{"count": "1"}, false, true},
+		{"integral float into int", map[string]interface{}{"count": 2.0}, false, false},
+		{"fractional float into int", map[string]interface{}{"count": 1.5}, false, true},
+		{"uint8 overflow", map[string]interface{}{"small": int64(256)}, false, true},
+		{"negative into uint", map[string]interface{}{"small": int64(-1)}, false, true},
+		{"int into string", map[string]interface{}{"name": int64(1)}, false, true},
+		{"string into slice", map[string]interface{}{"tags": "a"}, false, true},
+		{"wrong item type", map[string]interface{}{"items": []interface{}{"x"}}, false, true},
+		{"bad time", map[string]interface{}{"at": "вчера"}, false, true},
+		{"string into bytes", map[string]interface{}{"data": "AAE="}, false, true},
+		{"array into struct", []interface{}{}, false, true},
+	}
+	for _, tt := range tests {
+		var dst assignSample
+		err := Assign(&dst, tt.src, tt.strict)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// null обнуляет указатели и срезы, остальные поля не меняет
+	dst := assignSample{Name: "keep", Ptr: &assignSample{}, Tags: []string{"a"}}
+	if err := Assign(&dst, map[string]interface{}{"name": nil, "ptr": nil, "tags": nil}, true); err != nil {
+		t.Fatalf("Assign null: %v", err)
+	}
+	if dst.Name != "keep" || dst.Ptr != nil || dst.Tags != nil {
+		t.Errorf("Assign null = %+v", dst)
+	}
+
+	var n node
+	if err := Assign(&n, deep, true); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("deep nesting: err = %v, want %v", err, ErrTooDeep)
+	}
+	if err := Assign(n, map[string]interface{}{}, true); err == nil {
+		t.Error("Assign to non-pointer: want error")
+	}
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin проверяет токен администратора из заголовка Authorization: Bearer <токен>.
+// При отказе отправляет ошибку и возвращает false.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if models.Config.AdminToken == "" {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Административный доступ отключён")
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(models.Config.AdminToken)) != 1 {
+		slog.Warn("Отказ в административном доступе", logging.IP(r.RemoteAddr))
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Неверный токен администратора")
+		return false
+	}
+	return true
+}
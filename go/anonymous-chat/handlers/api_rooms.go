@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Допустимые значения видимости комнаты
+const (
+	VisibilityPublic  = "public"  // комната видна в списке
+	VisibilityPrivate = "private" // комната доступна только по имени
+)
+
+// Ограничения на длину полей комнаты (в символах)
+const (
+	maxRoomNameLen        = 64
+	maxRoomTitleLen       = 128
+	maxRoomTopicLen       = 256
+	maxRoomDescriptionLen = 2000
+)
+
+// Room представляет комнату в JSON API
+type Room struct {
+	Name         string     `json:"name"`
+	Title        string     `json:"title"`
+	Topic        string     `json:"topic"`
+	Description  string     `json:"description"`
+	Visibility   string     `json:"visibility"`
+	Encrypted    bool       `json:"encrypted"`
+	Online       int        `json:"online"`
+	MessageCount int        `json:"message_count"`
+	LastActivity *time.Time `json:"last_activity"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Unread       *int       `json:"unread,omitempty"` // только для комнат, где участвует личность запроса
+}
+
+// roomInput описывает тело запросов на создание и изменение комнаты.
+// Указатели позволяют отличить отсутствующее поле от пустого значения.
+type roomInput struct {
+	Name        *string `json:"name"`
+	Title       *string `json:"title"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+	Visibility  *string `json:"visibility"`
+	Encrypted   *bool   `json:"encrypted"` // задаётся только при создании
+}
+
+// apiError описывает объект ошибки JSON API
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSON отправляет значение в формате JSON с указанным кодом
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError отправляет ошибку в едином формате {"error": {"code", "message"}}
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{Error: apiError{Code: code, Message: message}})
+}
+
+// roomSelect выбирает комнату вместе со статистикой сообщений
+const roomSelect = `
+	SELECT r.name, r.title, r.topic, r.description, r.visibility, r.encrypted, r.created_at,
+		COUNT(m.id), MAX(m.created_at)
+	FROM rooms r
+	LEFT JOIN messages m ON m.room_id = r.id
+`
+
+// scanRoom читает строку, полученную запросом roomSelect
+func scanRoom(row pgx.Row) (Room, error) {
+	var room Room
+	var lastMessage *time.Time
+	err := row.Scan(&room.Name, &room.Title, &room.Topic, &room.Description, &room.Visibility,
+		&room.Encrypted, &room.CreatedAt, &room.MessageCount, &lastMessage)
+	if err != nil {
+		return room, err
+	}
+	room.LastActivity = lastMessage
+	room.Online = onlineCount(room.Name)
+	return room, nil
+}
+
+// loadRoom загружает комнату по имени
+func loadRoom(ctx context.Context, name string) (Room, error) {
+	row := models.DB.QueryRow(ctx, roomSelect+" WHERE r.name = $1 GROUP BY r.id", name)
+	return scanRoom(row)
+}
+
+// validateRoomInput проверяет поля запроса и возвращает описание первой ошибки
+func validateRoomInput(in roomInput) string {
+	if in.Name != nil {
+		name := *in.Name
+		if name == "" {
+			return "Имя комнаты обязательно"
+		}
+		if utf8.RuneCountInString(name) > maxRoomNameLen {
+			return "Имя комнаты слишком длинное"
+		}
+		if strings.ContainsAny(name, "/?#") {
+			return "Имя комнаты содержит недопустимые символы"
+		}
+	}
+	if in.Title != nil && utf8.RuneCountInString(*in.Title) > maxRoomTitleLen {
+		return "Заголовок слишком длинный"
+	}
+	if in.Topic != nil && utf8.RuneCountInString(*in.Topic) > maxRoomTopicLen {
+		return "Тема слишком длинная"
+	}
+	if in.Description != nil && utf8.RuneCountInString(*in.Description) > maxRoomDescriptionLen {
+		return "Описание слишком длинное"
+	}
+	if in.Visibility != nil {
+		switch *in.Visibility {
+		case VisibilityPublic, VisibilityPrivate:
+		default:
+			return "Видимость должна быть public или private"
+		}
+	}
+	return ""
+}
+
+// decodeRoomInput разбирает тело запроса и отправляет ошибку, если оно некорректно
+func decodeRoomInput(w http.ResponseWriter, r *http.Request) (roomInput, bool) {
+	var in roomInput
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Некорректное тело запроса")
+		return in, false
+	}
+	if msg := validateRoomInput(in); msg != "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", msg)
+		return in, false
+	}
+	return in, true
+}
+
+// stringOr возвращает значение указателя или значение по умолчанию
+func stringOr(p *string, def string) string {
+	if p != nil {
+		return *p
+	}
+	return def
+}
+
+// APIListRoomsHandler возвращает список публичных комнат
+func APIListRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := models.DB.Query(r.Context(),
+		roomSelect+" WHERE r.visibility = $1 GROUP BY r.id ORDER BY r.name", VisibilityPublic)
+	if err != nil {
+		slog.Error("Ошибка при получении комнат", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении комнат")
+		return
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	fillUnread(r, rooms)
+
+	writeJSON(w, http.StatusOK, struct {
+		Rooms []Room `json:"rooms"`
+	}{Rooms: rooms})
+}
+
+// APICreateRoomHandler создаёт комнату с метаданными
+func APICreateRoomHandler(w http.ResponseWriter, r *http.Request) {
+	in, ok := decodeRoomInput(w, r)
+	if !ok {
+		return
+	}
+	if in.Name == nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Имя комнаты обязательно")
+		return
+	}
+
+	_, err := models.DB.Exec(r.Context(),
+		"INSERT INTO rooms(name, title, topic, description, visibility, encrypted) VALUES($1, $2, $3, $4, $5, $6)",
+		*in.Name, stringOr(in.Title, ""), stringOr(in.Topic, ""), stringOr(in.Description, ""),
+		stringOr(in.Visibility, VisibilityPublic), in.Encrypted != nil && *in.Encrypted)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			writeAPIError(w, http.StatusConflict, "already_exists", "Комната уже существует")
+			return
+		}
+		slog.Error("Ошибка при создании комнаты", "err", err, logging.Room(*in.Name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при создании комнаты")
+		return
+	}
+
+	room, err := loadRoom(r.Context(), *in.Name)
+	if err != nil {
+		slog.Error("Ошибка при получении комнаты", "err", err, logging.Room(*in.Name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении комнаты")
+		return
+	}
+
+	slog.Info("Комната создана через API", logging.Room(room.Name))
+	w.Header().Set("Location", "/api/rooms/"+url.PathEscape(room.Name))
+	writeJSON(w, http.StatusCreated, room)
+}
+
+// APIGetRoomHandler возвращает одну комнату
+func APIGetRoomHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["room"]
+	room, err := loadRoom(r.Context(), name)
+	if err == nil && room.Visibility == VisibilityDirect {
+		// Личные комнаты видны только их участникам
+		identity, _ := identityFromRequest(r)
+		var allowed bool
+		if allowed, err = canAccessRoom(r.Context(), identity, name); err == nil && !allowed {
+			err = pgx.ErrNoRows
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+		return
+	}
+	if err != nil {
+		slog.Error("Ошибка при получении комнаты", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении комнаты")
+		return
+	}
+	rooms := []Room{room}
+	fillUnread(r, rooms)
+	writeJSON(w, http.StatusOK, rooms[0])
+}
+
+// APIUpdateRoomHandler изменяет настройки комнаты; имя комнаты не меняется.
+// Доступен только администратору; личные комнаты через API не изменяются.
+func APIUpdateRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name := mux.Vars(r)["room"]
+	in, ok := decodeRoomInput(w, r)
+	if !ok {
+		return
+	}
+	if in.Name != nil && *in.Name != name {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Имя комнаты нельзя изменить")
+		return
+	}
+	if in.Encrypted != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Шифрование задаётся только при создании комнаты")
+		return
+	}
+
+	// Отсутствующие поля сохраняют текущее значение
+	tag, err := models.DB.Exec(r.Context(), `
+		UPDATE rooms SET
+			title = COALESCE($2, title),
+			topic = COALESCE($3, topic),
+			description = COALESCE($4, description),
+			visibility = COALESCE($5, visibility)
+		WHERE name = $1 AND visibility <> $6`,
+		name, in.Title, in.Topic, in.Description, in.Visibility, VisibilityDirect)
+	if err != nil {
+		slog.Error("Ошибка при изменении комнаты", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при изменении комнаты")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+		return
+	}
+
+	APIGetRoomHandler(w, r)
+}
+
+// APIDeleteRoomHandler удаляет комнату вместе с историей и отключает её участников.
+// Доступен только администратору; личные комнаты через API не удаляются.
+func APIDeleteRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name := mux.Vars(r)["room"]
+
+	tx, err := models.DB.Begin(r.Context())
+	if err != nil {
+		slog.Error("Ошибка при начале транзакции", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при удалении комнаты")
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	for _, table := range []string{"messages", "room_members"} {
+		if err == nil {
+			_, err = tx.Exec(r.Context(),
+				"DELETE FROM "+table+" WHERE room_id = (SELECT id FROM rooms WHERE name = $1)", name)
+		}
+	}
+	if err == nil {
+		var tag pgconn.CommandTag
+		tag, err = tx.Exec(r.Context(), "DELETE FROM rooms WHERE name = $1 AND visibility <> $2", name, VisibilityDirect)
+		if err == nil && tag.RowsAffected() == 0 {
+			writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+			return
+		}
+	}
+	if err == nil {
+		err = tx.Commit(r.Context())
+	}
+	if err != nil {
+		slog.Error("Ошибка при удалении комнаты", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при удалении комнаты")
+		return
+	}
+
+	disconnectRoom(name)
+	slog.Info("Комната удалена через API", logging.Room(name))
+	w.WriteHeader(http.StatusNoContent)
+}
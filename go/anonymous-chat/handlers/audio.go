@@ -0,0 +1,789 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Число столбцов осциллограммы голосового сообщения
+const waveformBars = 64
+
+// Блоки WebM и пакеты Ogg длиннее этого не бывают у звука; больше —
+// признак испорченного или подложного файла
+const maxAudioPacket = 1 << 20
+
+// errInvalidAudio означает, что контейнер звукозаписи не удалось разобрать
+var errInvalidAudio = errors.New("файл не является корректной звукозаписью")
+
+// audioInfo — длительность и осциллограмма звукозаписи
+type audioInfo struct {
+	Duration float64 // секунды
+	Waveform []int   // уровни 0–100, waveformBars значений
+}
+
+// audioLevel — уровень сигнала на отрезке записи, начинающемся в момент at (секунды)
+type audioLevel struct {
+	at    float64
+	value float64
+}
+
+// analyzeAudio разбирает контейнер звукозаписи, проверяет его и вычисляет
+// длительность и осциллограмму. Кодеки не декодируются: для WAV уровень —
+// среднеквадратичное значение отсчётов, для сжатых форматов — число бит,
+// которое кодер потратил на единицу времени (тишина кодируется почти даром).
+// После разбора файл перемотан в начало.
+func analyzeAudio(file io.ReadSeeker, mimeType string) (audioInfo, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return audioInfo{}, err
+	}
+	r := bufio.NewReader(file)
+
+	var duration float64
+	var levels []audioLevel
+	var err error
+	switch mimeType {
+	case "audio/wav":
+		duration, levels, err = parseWAV(r)
+	case "audio/mpeg":
+		duration, levels, err = parseMP3(r)
+	case "audio/ogg":
+		duration, levels, err = parseOgg(r)
+	case "audio/webm":
+		duration, levels, err = parseWebM(r)
+	default:
+		err = errUnsupportedType
+	}
+	if err == nil && (duration <= 0 || math.IsInf(duration, 0) || math.IsNaN(duration)) {
+		err = errors.New("не удалось определить длительность")
+	}
+	if err != nil {
+		if errors.Is(err, errUnsupportedType) {
+			return audioInfo{}, err
+		}
+		return audioInfo{}, fmt.Errorf("%w: %v", errInvalidAudio, err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return audioInfo{}, err
+	}
+	return audioInfo{Duration: math.Round(duration*1000) / 1000, Waveform: buildWaveform(levels, duration)}, nil
+}
+
+// buildWaveform усредняет уровни по waveformBars равным отрезкам и
+// нормирует их по максимуму
+func buildWaveform(levels []audioLevel, duration float64) []int {
+	if len(levels) == 0 || duration <= 0 {
+		return nil
+	}
+	sums := make([]float64, waveformBars)
+	counts := make([]int, waveformBars)
+	for _, l := range levels {
+		i := min(max(int(l.at/duration*waveformBars), 0), waveformBars-1)
+		sums[i] += l.value
+		counts[i]++
+	}
+
+	peak := 0.0
+	for i := range sums {
+		switch {
+		case counts[i] > 0:
+			sums[i] /= float64(counts[i])
+		case i > 0:
+			sums[i] = sums[i-1] // отрезок короче одного пакета
+		}
+		peak = max(peak, sums[i])
+	}
+	bars := make([]int, waveformBars)
+	if peak > 0 {
+		for i, v := range sums {
+			bars[i] = int(math.Round(v / peak * 100))
+		}
+	}
+	return bars
+}
+
+// waveformJSON готовит осциллограмму для столбца JSONB; отсутствие хранится как []
+func waveformJSON(bars []int) []byte {
+	if len(bars) == 0 {
+		return []byte("[]")
+	}
+	data, _ := json.Marshal(bars)
+	return data
+}
+
+// parseWAV читает заголовок fmt и отсчёты из блока data. Уровень считается
+// по окнам в 20 мс; для сжатых вариантов WAV известна только длительность.
+func parseWAV(r *bufio.Reader) (float64, []audioLevel, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return 0, nil, errors.New("нет заголовка RIFF/WAVE")
+	}
+
+	var format, channels, blockAlign, bits uint16
+	var sampleRate, byteRate uint32
+	haveFormat := false
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return 0, nil, errors.New("нет блока data")
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:8])
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return 0, nil, errors.New("некорректный блок fmt")
+			}
+			buf := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return 0, nil, err
+			}
+			format = binary.LittleEndian.Uint16(buf[0:2])
+			channels = binary.LittleEndian.Uint16(buf[2:4])
+			sampleRate = binary.LittleEndian.Uint32(buf[4:8])
+			byteRate = binary.LittleEndian.Uint32(buf[8:12])
+			blockAlign = binary.LittleEndian.Uint16(buf[12:14])
+			bits = binary.LittleEndian.Uint16(buf[14:16])
+			if format == 0xfffe && size >= 26 { // WAVE_FORMAT_EXTENSIBLE: формат в начале GUID
+				format = binary.LittleEndian.Uint16(buf[24:26])
+			}
+			if channels == 0 || sampleRate == 0 || byteRate == 0 || blockAlign == 0 {
+				return 0, nil, errors.New("некорректный блок fmt")
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return 0, nil, errors.New("блок data раньше блока fmt")
+			}
+			// Записывающие потоком программы оставляют размер нулевым или максимальным
+			var data io.Reader = r
+			if size != 0 && size != math.MaxUint32 {
+				data = io.LimitReader(r, int64(size))
+			}
+			return readPCM(data, format, channels, bits, blockAlign, sampleRate, byteRate)
+		default:
+			if _, err := r.Discard(int(size) + int(size%2)); err != nil {
+				return 0, nil, errors.New("нет блока data")
+			}
+		}
+	}
+}
+
+// readPCM читает отсчёты целиком; уровень окна — среднеквадратичное по всем каналам
+func readPCM(data io.Reader, format, channels, bits, blockAlign uint16, sampleRate, byteRate uint32) (float64, []audioLevel, error) {
+	sample := pcmSampleReader(format, bits)
+	if sample == nil || int(blockAlign) != int(channels)*int(bits/8) {
+		// Сжатый WAV (например, ADPCM): длительность по скорости потока
+		n, err := io.Copy(io.Discard, data)
+		if err != nil {
+			return 0, nil, err
+		}
+		return float64(n) / float64(byteRate), nil, nil
+	}
+
+	window := max(int(sampleRate)/50, 1) // 20 мс
+	frame := make([]byte, blockAlign)
+	var levels []audioLevel
+	var frames int
+	var sum float64
+	for {
+		if _, err := io.ReadFull(data, frame); err != nil {
+			break // неполный последний кадр отбрасывается
+		}
+		for ch := 0; ch < int(channels); ch++ {
+			v := sample(frame[ch*int(bits/8):])
+			sum += v * v
+		}
+		frames++
+		if frames%window == 0 {
+			levels = append(levels, audioLevel{
+				at:    float64(frames-window) / float64(sampleRate),
+				value: math.Sqrt(sum / float64(window*int(channels))),
+			})
+			sum = 0
+		}
+	}
+	return float64(frames) / float64(sampleRate), levels, nil
+}
+
+// pcmSampleReader возвращает функцию чтения отсчёта, приведённого к [-1, 1]
+func pcmSampleReader(format, bits uint16) func([]byte) float64 {
+	switch {
+	case format == 1 && bits == 8:
+		return func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == 1 && bits == 16:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == 1 && bits == 24:
+		return func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == 1 && bits == 32:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == 3 && bits == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	}
+	return nil
+}
+
+// Битрейты MPEG Audio Layer III в кбит/с по индексу: MPEG-1 и MPEG-2/2.5
+var (
+	mp3BitratesV1 = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3Rates      = [3]int{44100, 48000, 32000}
+)
+
+// mp3Frame — разобранный заголовок кадра MPEG Audio Layer III
+type mp3Frame struct {
+	mpeg1      bool
+	mono       bool
+	crc        bool
+	sampleRate int
+	length     int // байт вместе с заголовком
+	samples    int // отсчётов на канал
+}
+
+// parseMP3Header разбирает четырёхбайтовый заголовок кадра; принимается только Layer III
+func parseMP3Header(h []byte) (mp3Frame, bool) {
+	if h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return mp3Frame{}, false
+	}
+	version := (h[1] >> 3) & 3 // 0 — MPEG-2.5, 2 — MPEG-2, 3 — MPEG-1
+	layer := (h[1] >> 1) & 3   // 1 — Layer III
+	bitrateIndex := h[2] >> 4
+	rateIndex := (h[2] >> 2) & 3
+	if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	f := mp3Frame{
+		mpeg1:      version == 3,
+		mono:       h[3]>>6 == 3,
+		crc:        h[1]&1 == 0,
+		sampleRate: mp3Rates[rateIndex],
+	}
+	padding := int(h[2]>>1) & 1
+	if f.mpeg1 {
+		f.length = 144*mp3BitratesV1[bitrateIndex]*1000/f.sampleRate + padding
+		f.samples = 1152
+	} else {
+		f.sampleRate /= 2
+		if version == 0 {
+			f.sampleRate /= 2
+		}
+		f.length = 72*mp3BitratesV2[bitrateIndex]*1000/f.sampleRate + padding
+		f.samples = 576
+	}
+	return f, f.length > 4
+}
+
+// parseMP3 проходит по кадрам после тега ID3v2 до конца файла или тега в конце.
+// Уровень гранулы — сумма part2_3_length по каналам: столько бит заняли её данные.
+func parseMP3(r *bufio.Reader) (float64, []audioLevel, error) {
+	if head, err := r.Peek(10); err == nil && string(head[:3]) == "ID3" {
+		size := int(head[6]&0x7f)<<21 | int(head[7]&0x7f)<<14 | int(head[8]&0x7f)<<7 | int(head[9]&0x7f)
+		if head[5]&0x10 != 0 {
+			size += 10 // нижний колонтитул тега
+		}
+		if _, err := r.Discard(10 + size); err != nil {
+			return 0, nil, errors.New("обрезанный тег ID3")
+		}
+	}
+
+	var levels []audioLevel
+	var samples, frames int
+	var rate int
+	buf := make([]byte, 2048)
+	for {
+		head, err := r.Peek(4)
+		if err != nil || string(head[:3]) == "TAG" || string(head) == "APET" {
+			break // конец файла, ID3v1 или APE
+		}
+		f, ok := parseMP3Header(head)
+		if !ok {
+			if frames == 0 {
+				return 0, nil, errors.New("нет кадров MPEG Audio Layer III")
+			}
+			break // мусор в конце файла
+		}
+		if rate == 0 {
+			rate = f.sampleRate
+		}
+		if f.length > len(buf) {
+			return 0, nil, errors.New("некорректная длина кадра")
+		}
+		frame := buf[:f.length]
+		if _, err := io.ReadFull(r, frame); err != nil {
+			break // обрезанный последний кадр
+		}
+
+		// Кадр Xing/Info/VBRI в начале содержит только служебные данные и тишину
+		if frames == 0 && (bytes.Contains(frame, []byte("Xing")) || bytes.Contains(frame, []byte("Info")) || bytes.Contains(frame, []byte("VBRI"))) {
+			frames++
+			continue
+		}
+
+		start := float64(samples) / float64(rate)
+		granules := mp3GranuleBits(frame, f)
+		granuleSeconds := 576 / float64(f.sampleRate)
+		for i, bits := range granules {
+			levels = append(levels, audioLevel{at: start + float64(i)*granuleSeconds, value: float64(bits) / granuleSeconds})
+		}
+		samples += f.samples * rate / f.sampleRate
+		frames++
+	}
+	if samples == 0 {
+		return 0, nil, errors.New("нет кадров MPEG Audio Layer III")
+	}
+	return float64(samples) / float64(rate), levels, nil
+}
+
+// mp3GranuleBits читает part2_3_length из побочной информации кадра и
+// возвращает объём данных каждой гранулы в битах
+func mp3GranuleBits(frame []byte, f mp3Frame) []int {
+	br := bitReader{data: frame, pos: 32}
+	if f.crc {
+		br.pos += 16
+	}
+	channels := 2
+	if f.mono {
+		channels = 1
+	}
+	granules := 1
+	granuleInfoBits := 63 // без part2_3_length: 51 бит
+	if f.mpeg1 {
+		granules = 2
+		granuleInfoBits = 59
+		br.pos += 9 // main_data_begin
+		if f.mono {
+			br.pos += 5
+		} else {
+			br.pos += 3
+		}
+		br.pos += 4 * channels // scfsi
+	} else {
+		br.pos += 8
+		if f.mono {
+			br.pos++
+		} else {
+			br.pos += 2
+		}
+	}
+
+	bits := make([]int, granules)
+	for gr := 0; gr < granules; gr++ {
+		for ch := 0; ch < channels; ch++ {
+			v, ok := br.read(12)
+			if !ok {
+				return bits[:gr]
+			}
+			bits[gr] += v
+			br.pos += granuleInfoBits - 12
+		}
+	}
+	return bits
+}
+
+// bitReader читает биты от старшего к младшему
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (b *bitReader) read(n int) (int, bool) {
+	if b.pos+n > len(b.data)*8 {
+		return 0, false
+	}
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := b.data[(b.pos+i)/8] >> (7 - uint((b.pos+i)%8)) & 1
+		v = v<<1 | int(bit)
+	}
+	b.pos += n
+	return v, true
+}
+
+// opusPacketDuration возвращает длительность пакета Opus в секундах по байту TOC (RFC 6716, 3.1)
+func opusPacketDuration(packet []byte) float64 {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+	var frameMs float64
+	switch {
+	case config < 12: // SILK
+		frameMs = [4]float64{10, 20, 40, 60}[config%4]
+	case config < 16: // гибридный режим
+		frameMs = [2]float64{10, 20}[config%2]
+	default: // CELT
+		frameMs = [4]float64{2.5, 5, 10, 20}[config%4]
+	}
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frameMs * float64(frames) / 1000
+}
+
+// parseOgg читает страницы первого логического потока и собирает пакеты.
+// Принимаются Opus и Vorbis; длительность берётся из позиции последней страницы.
+func parseOgg(r *bufio.Reader) (float64, []audioLevel, error) {
+	const (
+		codecOpus = iota + 1
+		codecVorbis
+	)
+	var codec int
+	var serial uint32
+	var rate float64
+	var preSkip int64
+	var lastGranule int64 = -1
+	var levels []audioLevel
+	var packets int
+	var elapsed float64 // для Opus: начало следующего пакета
+	var packet []byte   // начало текущего пакета, не больше 64 байт
+	var packetSize int
+	var pageBytes int // для Vorbis: данные страницы
+
+	for page := 0; ; page++ {
+		var header [27]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		if string(header[0:4]) != "OggS" || header[4] != 0 {
+			if page == 0 {
+				return 0, nil, errors.New("нет страницы Ogg")
+			}
+			break
+		}
+		granule := int64(binary.LittleEndian.Uint64(header[6:14]))
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		lacing := make([]byte, header[26])
+		if _, err := io.ReadFull(r, lacing); err != nil {
+			break
+		}
+		if page == 0 {
+			serial = pageSerial
+		}
+		if pageSerial != serial {
+			// Другие логические потоки (например, видео) пропускаются
+			total := 0
+			for _, l := range lacing {
+				total += int(l)
+			}
+			if _, err := r.Discard(total); err != nil {
+				break
+			}
+			continue
+		}
+
+		pageBytes = 0
+		for _, l := range lacing {
+			seg := make([]byte, l)
+			if _, err := io.ReadFull(r, seg); err != nil {
+				return 0, nil, errors.New("обрезанная страница Ogg")
+			}
+			pageBytes += int(l)
+			if len(packet) < 64 {
+				packet = append(packet, seg[:min(len(seg), 64-len(packet))]...)
+			}
+			packetSize += int(l)
+			if packetSize > maxAudioPacket {
+				return 0, nil, errors.New("слишком большой пакет")
+			}
+			if l == 255 {
+				continue // пакет продолжается в следующем сегменте
+			}
+
+			switch {
+			case packets == 0 && bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 19:
+				codec = codecOpus
+				rate = 48000 // позиция Opus всегда в отсчётах 48 кГц
+				preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+			case packets == 0 && bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+				codec = codecVorbis
+				rate = float64(binary.LittleEndian.Uint32(packet[12:16]))
+			case packets == 0:
+				return 0, nil, errors.New("поток Ogg не содержит Opus или Vorbis")
+			case codec == codecOpus && packets >= 2: // после OpusHead и OpusTags
+				if d := opusPacketDuration(packet); d > 0 {
+					levels = append(levels, audioLevel{at: elapsed, value: float64(packetSize) / d})
+					elapsed += d
+				}
+			}
+			packets++
+			packet = packet[:0]
+			packetSize = 0
+		}
+
+		if granule >= 0 {
+			// Для Vorbis уровень считается по страницам
+			if codec == codecVorbis && packets > 3 && lastGranule >= 0 && granule > lastGranule {
+				span := float64(granule-lastGranule) / rate
+				levels = append(levels, audioLevel{at: float64(lastGranule) / rate, value: float64(pageBytes) / span})
+			}
+			lastGranule = granule
+		}
+	}
+
+	if codec == 0 || rate <= 0 || lastGranule < 0 {
+		return 0, nil, errors.New("нет звукового потока Ogg")
+	}
+	return float64(lastGranule-preSkip) / rate, levels, nil
+}
+
+// Идентификаторы элементов Matroska/WebM, которые нужны для разбора
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549a966
+	ebmlTimecodeScale = 0x2ad7b1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654ae6b
+	ebmlTrackEntry    = 0xae
+	ebmlTrackNumber   = 0xd7
+	ebmlTrackType     = 0x83
+	ebmlCodecID       = 0x86
+	ebmlCluster       = 0x1f43b675
+	ebmlTimecode      = 0xe7
+	ebmlBlockGroup    = 0xa0
+	ebmlBlock         = 0xa1
+	ebmlSimpleBlock   = 0xa3
+)
+
+// Элементы, в которые разбор заходит, а не пропускает. MediaRecorder пишет
+// Segment и Cluster с неизвестным размером, поэтому границы вложенности не
+// отслеживаются: дочерние элементы читаются как плоский поток.
+var ebmlContainers = map[uint64]bool{
+	ebmlSegment: true, ebmlInfo: true, ebmlTracks: true, ebmlTrackEntry: true,
+	ebmlCluster: true, ebmlBlockGroup: true,
+}
+
+// webmTrack — дорожка из элемента Tracks
+type webmTrack struct {
+	number    uint64
+	trackType uint64 // 1 — видео, 2 — звук
+	codec     string
+}
+
+// parseWebM читает дорожки и блоки звуковой дорожки. Длительность — конец
+// последнего блока (для Opus с учётом длины пакета), а если блоков нет —
+// значение Duration из Info.
+func parseWebM(r *bufio.Reader) (float64, []audioLevel, error) {
+	scale := uint64(1_000_000) // TimecodeScale по умолчанию: 1 мс
+	var infoDuration float64
+	var tracks []webmTrack
+	var cluster uint64
+	var levels []audioLevel
+	var first, end float64
+	haveBlocks := false
+
+	for {
+		id, err := readEBMLID(r)
+		if err != nil {
+			break
+		}
+		size, known, err := readEBMLSize(r)
+		if err != nil {
+			return 0, nil, errors.New("обрезанный элемент EBML")
+		}
+		if ebmlContainers[id] {
+			if id == ebmlTrackEntry {
+				tracks = append(tracks, webmTrack{})
+			}
+			continue
+		}
+		if !known {
+			return 0, nil, fmt.Errorf("элемент %#x неизвестного размера", id)
+		}
+		if size > maxAudioPacket {
+			if _, err := r.Discard(int(size)); err != nil {
+				break
+			}
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break // обрезанный последний элемент
+		}
+
+		switch id {
+		case ebmlTimecodeScale:
+			if v := ebmlUint(data); v > 0 {
+				scale = v
+			}
+		case ebmlDuration:
+			infoDuration = ebmlFloat(data)
+		case ebmlTrackNumber, ebmlTrackType, ebmlCodecID:
+			if len(tracks) == 0 {
+				continue
+			}
+			t := &tracks[len(tracks)-1]
+			switch id {
+			case ebmlTrackNumber:
+				t.number = ebmlUint(data)
+			case ebmlTrackType:
+				t.trackType = ebmlUint(data)
+			case ebmlCodecID:
+				t.codec = string(data)
+			}
+		case ebmlTimecode:
+			cluster = ebmlUint(data)
+		case ebmlSimpleBlock, ebmlBlock:
+			audio := webmAudioTrack(tracks)
+			if audio == nil {
+				return 0, nil, errors.New("блок раньше описания звуковой дорожки")
+			}
+			track, n := ebmlVint(data)
+			if n == 0 || len(data) < n+3 || track != audio.number {
+				continue
+			}
+			relative := int16(binary.BigEndian.Uint16(data[n : n+2]))
+			at := float64(int64(cluster)+int64(relative)) * float64(scale) / 1e9
+			payload := data[n+3:]
+			frames := 1
+			if data[n+2]&0x06 != 0 && len(payload) > 0 { // кадры с лейсингом
+				frames = int(payload[0]) + 1
+				payload = payload[1:]
+			}
+
+			var span float64
+			if audio.codec == "A_OPUS" {
+				span = opusPacketDuration(payload) * float64(frames)
+			}
+			if !haveBlocks || at < first {
+				first = at
+			}
+			haveBlocks = true
+			end = max(end, at+span)
+			value := float64(len(data))
+			if span > 0 {
+				value /= span
+			}
+			levels = append(levels, audioLevel{at: at, value: value})
+		}
+	}
+
+	for _, t := range tracks {
+		if t.trackType == 1 {
+			return 0, nil, errors.New("в файле есть видеодорожка")
+		}
+	}
+	if webmAudioTrack(tracks) == nil {
+		return 0, nil, errors.New("нет звуковой дорожки")
+	}
+	if !haveBlocks {
+		return infoDuration * float64(scale) / 1e9, nil, nil
+	}
+	for i := range levels {
+		levels[i].at -= first
+	}
+	return end - first, levels, nil
+}
+
+// webmAudioTrack возвращает первую звуковую дорожку
+func webmAudioTrack(tracks []webmTrack) *webmTrack {
+	for i := range tracks {
+		if tracks[i].trackType == 2 {
+			return &tracks[i]
+		}
+	}
+	return nil
+}
+
+// readEBMLID читает идентификатор элемента вместе с маркером длины (1–4 байта)
+func readEBMLID(r *bufio.Reader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 4 && b&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 4 {
+		return 0, errors.New("некорректный идентификатор EBML")
+	}
+	id := uint64(b)
+	for i := 1; i < length; i++ {
+		next, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		id = id<<8 | uint64(next)
+	}
+	return id, nil
+}
+
+// readEBMLSize читает размер элемента; known == false для «неизвестного размера»
+func readEBMLSize(r *bufio.Reader) (size uint64, known bool, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && b&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, false, errors.New("некорректный размер EBML")
+	}
+	value := uint64(b) & (0xff >> length)
+	allOnes := value == 0xff>>length
+	for i := 1; i < length; i++ {
+		next, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		value = value<<8 | uint64(next)
+		allOnes = allOnes && next == 0xff
+	}
+	return value, !allOnes, nil
+}
+
+// ebmlVint разбирает число переменной длины в начале данных (номер дорожки в блоке)
+func ebmlVint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0]) & (0xff >> length)
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// ebmlUint разбирает беззнаковое целое элемента (big-endian, 0–8 байт)
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data[:min(len(data), 8)] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// ebmlFloat разбирает число с плавающей точкой элемента (4 или 8 байт)
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
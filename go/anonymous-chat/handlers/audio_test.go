@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+// Образцы собираются в коде по спецификациям контейнеров: в тестах важна
+// разметка, а не звук, а двоичные файлы в репозитории не нужны. Уровень
+// сигнала во всех образцах растёт к концу записи.
+
+// wavFixture — PCM WAV, 16 бит, моно, 8 кГц, 1 с синуса с нарастающей
+// громкостью; перед data стоит блок LIST нечётного размера
+func wavFixture() []byte {
+	const rate = 8000
+	var data bytes.Buffer
+	for i := 0; i < rate; i++ {
+		v := math.Sin(float64(i)/4) * float64(i) / rate * 30000
+		binary.Write(&data, binary.LittleEndian, int16(v))
+	}
+
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 1) // PCM
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], rate)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], rate*2)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+
+	var body bytes.Buffer
+	body.WriteString("WAVE")
+	riffChunk(&body, "fmt ", fmtChunk)
+	riffChunk(&body, "LIST", []byte("INFOISFT\x05\x00\x00\x00test\x00"))
+	riffChunk(&body, "data", data.Bytes())
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// adpcmWAVFixture — сжатый WAV: 2 с при 4000 байт/с, отсчёты не читаются
+func adpcmWAVFixture() []byte {
+	fmtChunk := make([]byte, 20)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 2) // MS ADPCM
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 8000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 4000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 256)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 4)
+
+	var b bytes.Buffer
+	b.WriteString("RIFF\x00\x00\x00\x00WAVE")
+	riffChunk(&b, "fmt ", fmtChunk)
+	riffChunk(&b, "data", make([]byte, 8000))
+	return b.Bytes()
+}
+
+func riffChunk(b *bytes.Buffer, id string, data []byte) {
+	b.WriteString(id)
+	binary.Write(b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)%2 == 1 {
+		b.WriteByte(0)
+	}
+}
+
+// mp3Fixture — тег ID3v2, кадр Xing и 38 кадров MPEG-1 Layer III, 128 кбит/с,
+// 44,1 кГц, моно (около 1 с); в побочной информации растёт part2_3_length
+func mp3Fixture() []byte {
+	var b bytes.Buffer
+	tag := []byte("TSSE\x00\x00\x00\x05\x00\x00\x00test")
+	b.WriteString("ID3\x03\x00\x00")
+	b.Write([]byte{0, 0, 0, byte(len(tag))}) // размер в 7-битных байтах
+	b.Write(tag)
+
+	header := []byte{0xff, 0xfb, 0x90, 0xc0} // без CRC, без дополнения, моно
+	const length = 417                       // 144 * 128000 / 44100
+
+	xing := make([]byte, length)
+	copy(xing, header)
+	copy(xing[4+17:], "Xing")
+	b.Write(xing)
+
+	for i := 0; i < 38; i++ {
+		frame := make([]byte, length)
+		copy(frame, header)
+		// part2_3_length гранул: после заголовка 9 бит main_data_begin,
+		// 5 бит private_bits и 4 бита scfsi; гранулы по 59 бит
+		bits := 100 + i*50
+		putBits(frame, 32+18, 12, bits)
+		putBits(frame, 32+18+59, 12, bits)
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+// putBits записывает n младших бит v начиная с бита pos (от старшего к младшему)
+func putBits(data []byte, pos, n, v int) {
+	for i := 0; i < n; i++ {
+		bit := byte(v>>(n-1-i)) & 1
+		data[(pos+i)/8] |= bit << (7 - uint((pos+i)%8))
+	}
+}
+
+// oggOpusFixture — Ogg/Opus с pre-skip 312: OpusHead, OpusTags и 50 пакетов
+// CELT по 20 мс (1 с). Пакеты растут, последний длиннее 255 байт и занимает
+// несколько сегментов. Контрольная сумма страниц разбором не проверяется.
+func oggOpusFixture() []byte {
+	const preSkip = 312
+	head := []byte("OpusHead\x01\x01")
+	head = binary.LittleEndian.AppendUint16(head, preSkip)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	var b bytes.Buffer
+	oggPage(&b, 0x02, 0, [][]byte{head})
+	oggPage(&b, 0, 0, [][]byte{[]byte("OpusTags\x04\x00\x00\x00test\x00\x00\x00\x00")})
+	granule := int64(preSkip)
+	for page := 0; page < 5; page++ {
+		var packets [][]byte
+		for i := 0; i < 10; i++ {
+			n := page*10 + i
+			packet := make([]byte, 10+n*6)
+			packet[0] = 31 << 3 // CELT, 20 мс, один кадр
+			packets = append(packets, packet)
+			granule += 960
+		}
+		flags := byte(0)
+		if page == 4 {
+			flags = 0x04
+		}
+		oggPage(&b, flags, granule, packets)
+	}
+	return b.Bytes()
+}
+
+func oggPage(b *bytes.Buffer, flags byte, granule int64, packets [][]byte) {
+	var lacing []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+	}
+	b.WriteString("OggS\x00")
+	b.WriteByte(flags)
+	binary.Write(b, binary.LittleEndian, granule)
+	binary.Write(b, binary.LittleEndian, uint32(0x4f505553)) // serial
+	binary.Write(b, binary.LittleEndian, uint32(0))          // номер страницы
+	binary.Write(b, binary.LittleEndian, uint32(0))          // контрольная сумма
+	b.WriteByte(byte(len(lacing)))
+	b.Write(lacing)
+	for _, p := range packets {
+		b.Write(p)
+	}
+}
+
+// webmFixture — WebM, как его пишет MediaRecorder: Segment и Cluster
+// неизвестного размера, дорожка A_OPUS без Duration в Info и 50 блоков
+// по 20 мс в двух кластерах (1 с); trackType 1 делает дорожку видео
+func webmFixture(trackType byte) []byte {
+	var b bytes.Buffer
+	b.Write(ebmlBytes(0x1a45dfa3, ebmlBytes(0x4282, []byte("webm"))))
+	b.Write([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	b.Write(ebmlBytes(ebmlInfo, ebmlBytes(ebmlTimecodeScale, []byte{0x0f, 0x42, 0x40})))
+	entry := append(ebmlBytes(ebmlTrackNumber, []byte{1}), ebmlBytes(ebmlTrackType, []byte{trackType})...)
+	entry = append(entry, ebmlBytes(ebmlCodecID, []byte("A_OPUS"))...)
+	b.Write(ebmlBytes(ebmlTracks, ebmlBytes(ebmlTrackEntry, entry)))
+
+	for cluster := 0; cluster < 2; cluster++ {
+		b.Write([]byte{0x1f, 0x43, 0xb6, 0x75, 0xff}) // Cluster неизвестного размера
+		b.Write(ebmlBytes(ebmlTimecode, binary.BigEndian.AppendUint16(nil, uint16(cluster*500))))
+		for i := 0; i < 25; i++ {
+			n := cluster*25 + i
+			block := binary.BigEndian.AppendUint16([]byte{0x81}, uint16(i*20)) // дорожка и время в кластере
+			block = append(block, 0x80, 31<<3)                                 // ключевой кадр; CELT, 20 мс
+			block = append(block, make([]byte, 10+n*6)...)
+			b.Write(ebmlBytes(ebmlSimpleBlock, block))
+		}
+	}
+	return b.Bytes()
+}
+
+// ebmlBytes кодирует элемент EBML с размером из восьми байт
+func ebmlBytes(id uint64, data []byte) []byte {
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if v := byte(id >> shift); v != 0 || len(out) > 0 {
+			out = append(out, v)
+		}
+	}
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	size[0] = 0x01 // маркер длины из восьми байт
+	out = append(out, size...)
+	return append(out, data...)
+}
+
+var audioFixtures = []struct {
+	name     string
+	mime     string
+	data     []byte
+	duration float64
+	bars     int
+}{
+	{"wav", "audio/wav", wavFixture(), 1, waveformBars},
+	{"wav adpcm", "audio/wav", adpcmWAVFixture(), 2, 0},
+	{"mp3", "audio/mpeg", mp3Fixture(), 0.993, waveformBars},
+	{"ogg opus", "audio/ogg", oggOpusFixture(), 1, waveformBars},
+	{"webm opus", "audio/webm", webmFixture(2), 1, waveformBars},
+}
+
+func TestAnalyzeAudio(t *testing.T) {
+	for _, tt := range audioFixtures {
+		t.Run(tt.name, func(t *testing.T) {
+			file := bytes.NewReader(tt.data)
+			info, err := analyzeAudio(file, tt.mime)
+			if err != nil {
+				t.Fatalf("analyzeAudio: %v", err)
+			}
+			if info.Duration != tt.duration {
+				t.Errorf("Duration = %v, want %v", info.Duration, tt.duration)
+			}
+			if len(info.Waveform) != tt.bars {
+				t.Fatalf("len(Waveform) = %d, want %d", len(info.Waveform), tt.bars)
+			}
+			if tt.bars > 0 {
+				// Громкость растёт, поэтому максимум приходится на конец записи
+				if first, last := info.Waveform[0], info.Waveform[len(info.Waveform)-1]; first >= last || last != 100 {
+					t.Errorf("Waveform = %v, want rising to 100", info.Waveform)
+				}
+			}
+			if pos, _ := file.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Errorf("file position = %d, want 0", pos)
+			}
+		})
+	}
+}
+
+// checkAudioError проверяет, что разбор испорченного файла завершился
+// errInvalidAudio или успешно, но с правдоподобным результатом
+func checkAudioError(t *testing.T, info audioInfo, err error) {
+	t.Helper()
+	if err != nil {
+		if !errors.Is(err, errInvalidAudio) {
+			t.Errorf("err = %v, want errInvalidAudio", err)
+		}
+		return
+	}
+	if info.Duration <= 0 {
+		t.Errorf("Duration = %v, want > 0", info.Duration)
+	}
+	if n := len(info.Waveform); n != 0 && n != waveformBars {
+		t.Errorf("len(Waveform) = %d, want 0 or %d", n, waveformBars)
+	}
+	for _, v := range info.Waveform {
+		if v < 0 || v > 100 {
+			t.Errorf("Waveform = %v, want levels 0–100", info.Waveform)
+			break
+		}
+	}
+}
+
+// Обрезанный файл разбирается до последнего целого пакета или отклоняется
+func TestAnalyzeAudioTruncated(t *testing.T) {
+	for _, tt := range audioFixtures {
+		for n := 0; n < len(tt.data); n += max(len(tt.data)/500, 1) {
+			info, err := analyzeAudio(bytes.NewReader(tt.data[:n]), tt.mime)
+			checkAudioError(t, info, err)
+		}
+		// Без заголовка разбирать нечего
+		if _, err := analyzeAudio(bytes.NewReader(tt.data[:8]), tt.mime); !errors.Is(err, errInvalidAudio) {
+			t.Errorf("%s: 8 bytes: err = %v, want errInvalidAudio", tt.name, err)
+		}
+	}
+}
+
+func TestAnalyzeAudioGarbage(t *testing.T) {
+	garbage := map[string][]byte{
+		"empty":  nil,
+		"zeros":  make([]byte, 4096),
+		"text":   bytes.Repeat([]byte("not audio "), 100),
+		"ones":   bytes.Repeat([]byte{0xff}, 4096),
+		"random": pseudoRandom(4096),
+	}
+	for _, mime := range []string{"audio/wav", "audio/mpeg", "audio/ogg", "audio/webm"} {
+		for name, data := range garbage {
+			if _, err := analyzeAudio(bytes.NewReader(data), mime); !errors.Is(err, errInvalidAudio) {
+				t.Errorf("%s/%s: err = %v, want errInvalidAudio", mime, name, err)
+			}
+		}
+	}
+
+	// Видео в WebM голосовым сообщением не считается
+	if _, err := analyzeAudio(bytes.NewReader(webmFixture(1)), "audio/webm"); !errors.Is(err, errInvalidAudio) {
+		t.Errorf("webm with video track: err = %v, want errInvalidAudio", err)
+	}
+
+	if _, err := analyzeAudio(bytes.NewReader(wavFixture()), "audio/flac"); !errors.Is(err, errUnsupportedType) {
+		t.Errorf("audio/flac: err = %v, want errUnsupportedType", err)
+	}
+}
+
+// pseudoRandom возвращает воспроизводимую последовательность байт
+func pseudoRandom(n int) []byte {
+	data := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x)
+	}
+	return data
+}
+
+var audioMIMETypes = []string{"audio/wav", "audio/mpeg", "audio/ogg", "audio/webm"}
+
+func FuzzAnalyzeAudio(f *testing.F) {
+	for _, tt := range audioFixtures {
+		for i, mime := range audioMIMETypes {
+			if mime == tt.mime {
+				f.Add(tt.data, uint8(i))
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte, kind uint8) {
+		mime := audioMIMETypes[int(kind)%len(audioMIMETypes)]
+		info, err := analyzeAudio(bytes.NewReader(data), mime)
+		checkAudioError(t, info, err)
+	})
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Тип служебного сообщения с реакцией на сообщение (ReplyTo); не сохраняется
+const TypeReaction = "reaction"
+
+// Bot — встроенный бот, получающий сообщения комнат, в которых он включён.
+// OnMessage вызывается в отдельной горутине и не должен надолго блокироваться.
+type Bot interface {
+	Name() string        // уникальное имя, оно же ник в чате
+	Description() string // краткая справка о командах
+	OnMessage(ev BotEvent)
+}
+
+// BotEvent описывает сообщение, полученное ботом, и позволяет ответить на него
+type BotEvent struct {
+	Room     string
+	Message  Message
+	Identity string // ключ личности отправителя; пуст для системных сообщений
+	Command  string // имя команды без "/", если сообщение — команда
+	Args     string // текст после имени команды
+
+	bot Bot
+}
+
+// Reply отправляет в комнату текстовое сообщение от имени бота
+func (ev BotEvent) Reply(text string) {
+	broadcast <- MessageWithRoom{
+		Room: ev.Room,
+		Message: Message{
+			Nickname:  ev.bot.Name(),
+			Type:      "text",
+			Content:   text,
+			CreatedAt: getCurrentTimestamp(),
+			Bot:       true,
+		},
+		Bot: ev.bot.Name(),
+	}
+}
+
+// Whisper отправляет ответ только отправителю сообщения, не сохраняя его
+func (ev BotEvent) Whisper(text string) {
+	if ev.Identity == "" {
+		return
+	}
+	broadcast <- MessageWithRoom{
+		Room: ev.Room,
+		Message: Message{
+			Nickname:  ev.bot.Name(),
+			Type:      "text",
+			Content:   text,
+			CreatedAt: getCurrentTimestamp(),
+			Bot:       true,
+		},
+		Transient: true,
+		To:        ev.Identity,
+		Bot:       ev.bot.Name(),
+	}
+}
+
+// React добавляет к сообщению реакцию; реакции не сохраняются в истории
+func (ev BotEvent) React(emoji string) {
+	if ev.Message.ID == 0 {
+		return
+	}
+	broadcast <- MessageWithRoom{
+		Room: ev.Room,
+		Message: Message{
+			Nickname:  ev.bot.Name(),
+			Type:      TypeReaction,
+			Content:   emoji,
+			ReplyTo:   ev.Message.ID,
+			CreatedAt: getCurrentTimestamp(),
+			Bot:       true,
+		},
+		Transient: true,
+		Bot:       ev.bot.Name(),
+	}
+}
+
+// Зарегистрированные при запуске боты по имени
+var botRegistry = make(map[string]Bot)
+
+// Ник служебных сообщений сервера
+const systemNickname = "System"
+
+// reservedBotName сообщает, что имя занято сервером или встроенным ботом.
+// Регистр не учитывается: "system" в чате не отличить от "System".
+func reservedBotName(name string) bool {
+	if strings.EqualFold(name, systemNickname) {
+		return true
+	}
+	for registered := range botRegistry {
+		if strings.EqualFold(name, registered) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterBot регистрирует встроенного бота. Вызывается при запуске до HandleMessages.
+func RegisterBot(b Bot) {
+	if _, exists := botRegistry[b.Name()]; exists {
+		panic("бот уже зарегистрирован: " + b.Name())
+	}
+	botRegistry[b.Name()] = b
+}
+
+// reservedNickname сообщает, что ник занят сервером или ботом комнаты —
+// встроенным или с действующим токеном. Людям такие ники не выдаются, чтобы
+// нельзя было писать от имени бота.
+func reservedNickname(ctx context.Context, room, nickname string) (bool, error) {
+	nickname = strings.TrimSpace(nickname)
+	if reservedBotName(nickname) {
+		return true, nil
+	}
+	var taken bool
+	err := models.DB.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM bot_tokens b JOIN rooms r ON b.room_id = r.id
+			WHERE r.name = $1 AND lower(b.name) = lower($2) AND b.revoked_at IS NULL
+		)`, room, nickname).Scan(&taken)
+	return taken, err
+}
+
+// checkNickname отклоняет ник, занятый ботом. При отказе отправляет ответ и возвращает false.
+func checkNickname(w http.ResponseWriter, r *http.Request, room, nickname string) bool {
+	taken, err := reservedNickname(r.Context(), room, nickname)
+	if err != nil {
+		slog.Error("Ошибка при проверке ника", "err", err, logging.Room(room))
+		http.Error(w, "Ошибка при проверке ника", http.StatusInternalServerError)
+		return false
+	}
+	if taken {
+		http.Error(w, "Ник занят ботом, выберите другой", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// parseCommand выделяет команду вида "/имя аргументы"
+func parseCommand(content string) (string, string, bool) {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "/") {
+		return "", "", false
+	}
+	name, args, _ := strings.Cut(content[1:], " ")
+	if name == "" {
+		return "", "", false
+	}
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// enabledBots возвращает имена ботов, включённых в комнате
+func enabledBots(ctx context.Context, room string) ([]string, error) {
+	rows, err := models.DB.Query(ctx, `
+		SELECT b.bot FROM room_bots b JOIN rooms r ON b.room_id = r.id
+		WHERE r.name = $1`, room)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// dispatchBots передаёт сохранённое сообщение ботам, включённым в комнате.
+// Сообщения ботов (встроенных и внешних, публикующих через API) и
+// зашифрованные сообщения ботам не передаются, чтобы боты не отвечали
+// друг другу по кругу.
+func dispatchBots(msgWithRoom MessageWithRoom, msg Message) {
+	if len(botRegistry) == 0 || msgWithRoom.Bot != "" || msg.Bot || msg.Type == TypeEncrypted {
+		return
+	}
+
+	names, err := enabledBots(context.Background(), msgWithRoom.Room)
+	if err != nil {
+		slog.Error("Ошибка при получении ботов комнаты", "err", err, logging.Room(msgWithRoom.Room))
+		return
+	}
+
+	ev := BotEvent{Room: msgWithRoom.Room, Message: msg, Identity: msgWithRoom.From}
+	if msg.Type == "text" {
+		ev.Command, ev.Args, _ = parseCommand(msg.Content)
+	}
+	for _, name := range names {
+		b, ok := botRegistry[name]
+		if !ok {
+			continue
+		}
+		ev.bot = b
+		go runBot(b, ev)
+	}
+}
+
+// runBot вызывает обработчик бота; паника в боте не должна останавливать сервер
+func runBot(b Bot, ev BotEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Паника в боте", "bot", b.Name(), "panic", r, logging.Room(ev.Room))
+		}
+	}()
+	b.OnMessage(ev)
+}
+
+// BuiltinBot описывает встроенного бота и его состояние в комнате
+type BuiltinBot struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// APIListBuiltinBotsHandler возвращает зарегистрированных ботов и признак включения в комнате
+func APIListBuiltinBotsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	room := mux.Vars(r)["room"]
+
+	enabled, err := enabledBots(r.Context(), room)
+	if err != nil {
+		slog.Error("Ошибка при получении ботов комнаты", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении ботов комнаты")
+		return
+	}
+
+	bots := []BuiltinBot{}
+	for name, b := range botRegistry {
+		bots = append(bots, BuiltinBot{
+			Name:        name,
+			Description: b.Description(),
+			Enabled:     slices.Contains(enabled, name),
+		})
+	}
+	sort.Slice(bots, func(i, j int) bool { return bots[i].Name < bots[j].Name })
+
+	writeJSON(w, http.StatusOK, struct {
+		Bots []BuiltinBot `json:"bots"`
+	}{Bots: bots})
+}
+
+// APIEnableBuiltinBotHandler включает встроенного бота в комнате
+func APIEnableBuiltinBotHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	room, name := vars["room"], vars["name"]
+	if _, ok := botRegistry[name]; !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Бот не найден")
+		return
+	}
+
+	// Боты читают и пишут открытый текст, поэтому в зашифрованных и личных комнатах недоступны
+	var encrypted bool
+	var visibility string
+	var roomID int
+	err := models.DB.QueryRow(r.Context(), "SELECT id, encrypted, visibility FROM rooms WHERE name = $1", room).
+		Scan(&roomID, &encrypted, &visibility)
+	if errors.Is(err, pgx.ErrNoRows) || visibility == VisibilityDirect {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+		return
+	}
+	if err != nil {
+		slog.Error("Ошибка при получении комнаты", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении комнаты")
+		return
+	}
+	if encrypted {
+		writeAPIError(w, http.StatusConflict, "encrypted_room", "Боты недоступны в зашифрованной комнате")
+		return
+	}
+
+	_, err = models.DB.Exec(r.Context(),
+		"INSERT INTO room_bots(room_id, bot) VALUES($1, $2) ON CONFLICT DO NOTHING", roomID, name)
+	if err != nil {
+		slog.Error("Ошибка при включении бота", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при включении бота")
+		return
+	}
+
+	slog.Info("Бот включён", "bot", name, logging.Room(room))
+	writeJSON(w, http.StatusOK, BuiltinBot{Name: name, Description: botRegistry[name].Description(), Enabled: true})
+}
+
+// APIDisableBuiltinBotHandler выключает встроенного бота в комнате
+func APIDisableBuiltinBotHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	room, name := vars["room"], vars["name"]
+
+	_, err := models.DB.Exec(r.Context(), `
+		DELETE FROM room_bots b USING rooms r
+		WHERE b.room_id = r.id AND r.name = $1 AND b.bot = $2`, room, name)
+	if err != nil {
+		slog.Error("Ошибка при выключении бота", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при выключении бота")
+		return
+	}
+
+	slog.Info("Бот выключен", "bot", name, logging.Room(room))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Префикс токенов ботов; помогает узнать токен в логах и конфигурации
+const botTokenPrefix = "bot_"
+
+// Максимальная длина имени бота
+const maxBotNameLength = 32
+
+// botUploadKinds сопоставляет типы файлов, которые бот может отправить, с видом
+// загрузки. Списки те же, что и для загрузок из браузера; тип, разрешённый
+// и как вложение, и как изображение или звук, отправляется изображением или звуком.
+func botUploadKinds() map[string]string {
+	kinds := make(map[string]string)
+	for _, kind := range []string{"file", "voice", "image"} {
+		types, _ := uploadAllowedTypes(kind)
+		for _, t := range types {
+			kinds[t] = kind
+		}
+	}
+	return kinds
+}
+
+// BotToken описывает токен бота, привязанный к комнате
+type BotToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"` // отдаётся только при создании
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// botPrincipal описывает бота, прошедшего проверку токена
+type botPrincipal struct {
+	id   int64
+	name string
+	room string
+}
+
+// authenticateBot проверяет токен из заголовка Authorization: Bearer <токен>.
+// Токен действителен только для своей комнаты и до отзыва.
+func authenticateBot(ctx context.Context, r *http.Request, room string) (botPrincipal, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(token, botTokenPrefix) {
+		return botPrincipal{}, false
+	}
+
+	// В базе хранится только хеш токена
+	bot := botPrincipal{room: room}
+	err := models.DB.QueryRow(ctx, `
+		UPDATE bot_tokens b SET last_used_at = NOW()
+		FROM rooms r
+		WHERE b.room_id = r.id AND r.name = $1 AND b.token_hash = $2 AND b.revoked_at IS NULL
+		RETURNING b.id, b.name`,
+		room, identityKey(token)).Scan(&bot.id, &bot.name)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			slog.Error("Ошибка при проверке токена бота", "err", err, logging.Room(room))
+		}
+		return botPrincipal{}, false
+	}
+	return bot, true
+}
+
+// botMessageInput описывает тело JSON-запроса бота
+type botMessageInput struct {
+	Content   string     `json:"content"`
+	Encrypted *Encrypted `json:"encrypted"` // для зашифрованных комнат
+}
+
+// APIBotPostHandler публикует сообщение в комнате от имени бота.
+// Принимает JSON {"content": "..."} или multipart-форму с полем file и необязательной подписью content.
+func APIBotPostHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+
+	bot, ok := authenticateBot(r.Context(), r, room)
+	if !ok {
+		slog.Warn("Отказ в доступе боту", logging.Room(room), logging.IP(r.RemoteAddr))
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Неверный или отозванный токен бота")
+		return
+	}
+
+	encrypted, err := roomEncrypted(r.Context(), room)
+	if err != nil {
+		slog.Error("Ошибка при получении настроек комнаты", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении настроек комнаты")
+		return
+	}
+
+	msg := Message{
+		Nickname:  bot.name,
+		Type:      "text",
+		CreatedAt: getCurrentTimestamp(),
+		Bot:       true,
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if encrypted {
+			writeAPIError(w, http.StatusConflict, "encrypted_room", "Боты не могут отправлять файлы в зашифрованную комнату")
+			return
+		}
+		if !botMediaMessage(w, r, &msg) {
+			return
+		}
+	} else {
+		var in botMessageInput
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&in); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", "Некорректное тело запроса")
+			return
+		}
+		msg.Content = strings.TrimSpace(in.Content)
+		if encrypted {
+			// Сервер не знает ключа комнаты, поэтому бот сам присылает зашифрованный конверт
+			msg.Type = TypeEncrypted
+			msg.Content = in.Content
+			msg.Encrypted = in.Encrypted
+			if err := validateEncryptedMessage(&msg); err != nil {
+				writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+				return
+			}
+		} else if in.Encrypted != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Комната не зашифрована")
+			return
+		} else if msg.Content == "" {
+			writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "content не может быть пустым")
+			return
+		}
+	}
+	if utf8.RuneCountInString(msg.Content) > maxMessageLength {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed",
+			fmt.Sprintf("content длиннее %d символов", maxMessageLength))
+		return
+	}
+
+	broadcast <- MessageWithRoom{
+		Room:    room,
+		Message: msg,
+	}
+
+	slog.Info("Сообщение бота опубликовано", "bot", bot.id, "type", msg.Type, logging.Room(room))
+	writeJSON(w, http.StatusAccepted, struct {
+		Type     string `json:"type"`
+		MediaURL string `json:"media_url,omitempty"`
+	}{Type: msg.Type, MediaURL: msg.MediaURL})
+}
+
+// botMediaMessage сохраняет файл из multipart-формы и заполняет сообщение.
+// При ошибке отправляет ответ и возвращает false.
+func botMediaMessage(w http.ResponseWriter, r *http.Request, msg *Message) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, models.Config.MaxUploadBytes)
+	if err := r.ParseMultipartForm(models.Config.MaxUploadBytes); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_form", "Ошибка при разборе формы")
+		return false
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_form", "Поле file обязательно")
+		return false
+	}
+	defer file.Close()
+
+	kinds := botUploadKinds()
+	allowed := make([]string, 0, len(kinds))
+	for t := range kinds {
+		allowed = append(allowed, t)
+	}
+	sniffed, err := sniffUpload(file, header.Header.Get("Content-Type"), allowed)
+	if err == nil {
+		// Файл проверяется и сохраняется по тем же правилам, что и из браузера
+		msg.Type = kinds[sniffed.MIME]
+		err = storeUploadedFile(file, sniffed, msg.Type, header.Filename, msg)
+	}
+	switch {
+	case errors.Is(err, errUnsupportedType):
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", "Неподдерживаемый тип файла")
+		return false
+	case errors.Is(err, errUploadTooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", err.Error())
+		return false
+	case errors.Is(err, errSaveUpload):
+		slog.Error("Ошибка при сохранении файла", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при сохранении файла")
+		return false
+	case err != nil:
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return false
+	}
+
+	msg.Content = strings.TrimSpace(r.FormValue("content"))
+	if msg.Content == "" {
+		msg.Content = fmt.Sprintf("файл: %s", header.Filename)
+	}
+	return true
+}
+
+// APICreateBotTokenHandler выпускает токен бота для комнаты; сам токен возвращается один раз
+func APICreateBotTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	room := mux.Vars(r)["room"]
+
+	var in struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Некорректное тело запроса")
+		return
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" || utf8.RuneCountInString(in.Name) > maxBotNameLength {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed",
+			fmt.Sprintf("name должен содержать от 1 до %d символов", maxBotNameLength))
+		return
+	}
+	if reservedBotName(in.Name) {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Имя зарезервировано: "+in.Name)
+		return
+	}
+
+	// Личные комнаты закрыты для ботов так же, как для административных изменений
+	bot := BotToken{Name: in.Name, Token: botTokenPrefix + randomHex(24)}
+	err := models.DB.QueryRow(r.Context(), `
+		INSERT INTO bot_tokens(room_id, name, token_hash)
+		SELECT id, $2, $3 FROM rooms WHERE name = $1 AND visibility <> $4
+		RETURNING id, created_at`,
+		room, bot.Name, identityKey(bot.Token), VisibilityDirect).Scan(&bot.ID, &bot.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+		return
+	}
+	if err != nil {
+		slog.Error("Ошибка при создании токена бота", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при создании токена бота")
+		return
+	}
+
+	slog.Info("Токен бота выпущен", logging.Room(room), "bot", bot.ID)
+	writeJSON(w, http.StatusCreated, bot)
+}
+
+// APIListBotTokensHandler возвращает токены ботов комнаты без самих токенов
+func APIListBotTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	room := mux.Vars(r)["room"]
+
+	rows, err := models.DB.Query(r.Context(), `
+		SELECT b.id, b.name, b.created_at, b.last_used_at, b.revoked_at
+		FROM bot_tokens b JOIN rooms r ON b.room_id = r.id
+		WHERE r.name = $1 ORDER BY b.id`, room)
+	if err != nil {
+		slog.Error("Ошибка при получении токенов ботов", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении токенов ботов")
+		return
+	}
+	defer rows.Close()
+
+	bots := []BotToken{}
+	for rows.Next() {
+		var bot BotToken
+		if err := rows.Scan(&bot.ID, &bot.Name, &bot.CreatedAt, &bot.LastUsedAt, &bot.RevokedAt); err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		bots = append(bots, bot)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Bots []BotToken `json:"bots"`
+	}{Bots: bots})
+}
+
+// APIRevokeBotTokenHandler отзывает токен бота; запись остаётся для истории
+func APIRevokeBotTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Токен не найден")
+		return
+	}
+
+	tag, err := models.DB.Exec(r.Context(), `
+		UPDATE bot_tokens b SET revoked_at = COALESCE(b.revoked_at, NOW())
+		FROM rooms r
+		WHERE b.room_id = r.id AND b.id = $1 AND r.name = $2`,
+		id, vars["room"])
+	if err != nil {
+		slog.Error("Ошибка при отзыве токена бота", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при отзыве токена бота")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Токен не найден")
+		return
+	}
+
+	slog.Info("Токен бота отозван", logging.Room(vars["room"]), "bot", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,18 +1,23 @@
 package handlers
 
 import (
+	"anonymous-chat/codec"
+	"anonymous-chat/logging"
 	"anonymous-chat/models"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -20,32 +25,95 @@ import (
 
 // Message представляет структуру сообщения чата
 type Message struct {
-	Nickname  string `json:"nickname"`
-	Type      string `json:"type"`      // 'text', 'image', 'voice'
-	Content   string `json:"content"`   // для текстовых сообщений
-	MediaURL  string `json:"media_url"` // URL к медиафайлу
-	CreatedAt string `json:"created_at"`
+	ID         int64      `json:"id,omitempty"` // ID сохранённого сообщения
+	Nickname   string     `json:"nickname"`
+	Type       string     `json:"type"`      // 'text', 'image', 'voice', 'video', 'file', 'read', 'seen'
+	Content    string     `json:"content"`   // для текстовых сообщений
+	MediaURL   string     `json:"media_url"` // URL к медиафайлу
+	CreatedAt  string     `json:"created_at"`
+	LastReadID int64      `json:"last_read_id,omitempty"` // для 'read' и 'seen'
+	Target     string     `json:"target,omitempty"`       // ник собеседника для 'dm_*'
+	Invite     string     `json:"invite,omitempty"`       // ID приглашения для 'dm_*'
+	Room       string     `json:"room,omitempty"`         // имя личной комнаты для 'dm_ready'
+	Encrypted  *Encrypted `json:"encrypted,omitempty"`    // для 'encrypted'
+	ReplyTo    int64      `json:"reply_to,omitempty"`     // ID сообщения для 'reaction'
+	Bot        bool       `json:"bot,omitempty"`          // сообщение отправлено ботом
+
+	// Размеры изображения и его миниатюры для 'image'
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+
+	// Исходное имя и размер файла для 'file' и 'video'
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+
+	// Длительность в секундах и осциллограмма (уровни 0–100) для 'voice'
+	Duration float64 `json:"duration,omitempty"`
+	Waveform []int   `json:"waveform,omitempty"`
+
+	createdAt time.Time // время сохранения; заполняется loadHistory
 }
 
 // MessageWithRoom связывает сообщение с комнатой
 type MessageWithRoom struct {
-	Room    string
-	Message Message
+	Room      string
+	Message   Message
+	Transient bool   // не сохранять сообщение в базе данных
+	To        string // если задан, доставить только соединениям этой личности
+	From      string // ключ личности отправителя, если сообщение пришло от клиента
+	Bot       string // имя встроенного бота, отправившего сообщение
 }
 
-// Client представляет клиента WebSocket
+// Client представляет подключённого клиента чата
 type Client struct {
-	Conn *websocket.Conn
-	Send chan Message // Буферизованный канал
-	Room string
-	Nick string
+	Conn      Transport  // WebSocket или поток SSE
+	Send      chan Frame // Буферизованный канал
+	Room      string
+	Nick      string
+	Identity  string // ключ анонимной личности из cookie
+	Encrypted bool   // в комнате включено сквозное шифрование
+	Protocol  int    // согласованная версия протокола
+
+	limiter    rateLimiter
+	sendMutex  sync.Mutex // защищает Send от записи после закрытия
+	sendClosed bool
+}
+
+// trySend ставит кадр в очередь отправки без блокировки.
+// Возвращает false, если очередь заполнена или уже закрыта.
+func (c *Client) trySend(f Frame) bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.Send <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend закрывает очередь отправки; повторный вызов ничего не делает
+func (c *Client) closeSend() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.Send)
+	}
 }
 
 // Хранилище клиентов по комнатам
 var clients = make(map[string]map[*Client]bool)
 var broadcast = make(chan MessageWithRoom)
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	// Подключения с чужих сайтов отклоняются, кроме источников из ALLOWED_ORIGINS
+	CheckOrigin: originAllowed,
+	// Клиент может выбрать бинарную кодировку; без подпротокола используется JSON
+	Subprotocols: codec.Subprotocols(),
 }
 
 // Инициализация мьютекса для защиты доступа к map clients
@@ -56,9 +124,33 @@ func ChatHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	room := vars["room"]
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Во время остановки сервера новые подключения не принимаются
+	if IsShuttingDown() {
+		http.Error(w, "Сервер останавливается", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Анонимная личность; при отсутствии cookie выдаётся вместе с ответом на upgrade
+	var responseHeader http.Header
+	identity, ok := identityFromRequest(r)
+	if !ok {
+		var cookie *http.Cookie
+		cookie, identity = newIdentityCookie(r)
+		responseHeader = http.Header{"Set-Cookie": {cookie.String()}}
+	}
+
+	// Личные комнаты доступны только их участникам
+	if allowed, err := canAccessRoom(r.Context(), identity, room); err != nil || !allowed {
+		if err != nil {
+			slog.Error("Ошибка при проверке доступа к комнате", "err", err, logging.Room(room))
+		}
+		http.Error(w, "Доступ к комнате запрещён", http.StatusForbidden)
+		return
+	}
+
+	protocol, err := negotiateProtocol(r)
 	if err != nil {
-		log.Println("Ошибка при обновлении соединения:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -66,109 +158,180 @@ func ChatHandler(w http.ResponseWriter, r *http.Request) {
 	if nickname == "" {
 		nickname = "Anonymous"
 	}
-
-	client := &Client{
-		Conn: conn,
-		Send: make(chan Message, 256), // Буферизованный канал
-		Room: room,
-		Nick: nickname,
+	if !checkNickname(w, r, room, nickname) {
+		return
 	}
 
-	// Добавление клиента в комнату
-	mutex.Lock()
-	if clients[room] == nil {
-		clients[room] = make(map[*Client]bool)
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		slog.Warn("Ошибка при обновлении соединения", "err", err, logging.IP(r.RemoteAddr))
+		return
 	}
-	clients[room][client] = true
-	mutex.Unlock()
-
-	log.Printf("Клиент %s подключен к комнате %s", nickname, room)
+	conn.SetReadLimit(codec.MaxFrameSize)
 
-	// Отправка истории сообщений из базы данных
-	sendHistory(client)
+	transport := wsTransport{conn: conn, codec: codec.ForSubprotocol(conn.Subprotocol())}
+	client := connectClient(r, transport, protocol, room, nickname, identity)
 
 	// Запуск горутин для чтения и записи сообщений
-	go client.readPump()
+	go client.readPump(transport)
 	go client.writePump()
 }
 
-// sendHistory отправляет историю сообщений клиенту
-func sendHistory(c *Client) {
+// onlineCount возвращает число подключённых клиентов в комнате
+func onlineCount(room string) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(clients[room])
+}
+
+// disconnectRoom закрывает соединения всех клиентов комнаты
+func disconnectRoom(room string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for client := range clients[room] {
+		client.Conn.Close()
+	}
+}
+
+// loadHistory загружает последние limit сообщений комнаты (0 — все) в хронологическом порядке
+func loadHistory(ctx context.Context, room string, limit int) ([]Message, error) {
 	query := `
-		SELECT m.nickname, m.type, m.content, m.media_url, m.created_at 
-		FROM messages m 
-		JOIN rooms r ON m.room_id = r.id 
-		WHERE r.name = $1 
-		ORDER BY m.created_at ASC
+		SELECT * FROM (
+			SELECT m.id, m.nickname, m.type, m.content, m.media_url, m.created_at,
+				m.ciphertext, m.nonce, m.key_id, m.media_width, m.media_height, m.thumbnails,
+				m.media_filename, m.media_size, m.media_duration, m.waveform, m.bot
+			FROM messages m
+			JOIN rooms r ON m.room_id = r.id
+			WHERE r.name = $1
+			ORDER BY m.created_at DESC, m.id DESC
+			LIMIT NULLIF($2, 0)
+		) recent
+		ORDER BY created_at ASC, id ASC
 	`
-	rows, err := models.DB.Query(context.Background(), query, c.Room)
+	rows, err := models.DB.Query(ctx, query, room, limit)
 	if err != nil {
-		log.Println("Ошибка при получении истории сообщений:", err)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
+	var history []Message
 	for rows.Next() {
 		var msg Message
 		var createdAt time.Time
-		err := rows.Scan(&msg.Nickname, &msg.Type, &msg.Content, &msg.MediaURL, &createdAt)
+		var envelope Encrypted
+		err := rows.Scan(&msg.ID, &msg.Nickname, &msg.Type, &msg.Content, &msg.MediaURL, &createdAt,
+			&envelope.Ciphertext, &envelope.Nonce, &envelope.KeyID, &msg.Width, &msg.Height, &msg.Thumbnails,
+			&msg.Filename, &msg.Size, &msg.Duration, &msg.Waveform, &msg.Bot)
 		if err != nil {
-			log.Println("Ошибка при сканировании строки:", err)
+			slog.Error("Ошибка при сканировании строки", "err", err)
 			continue
 		}
-		msg.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
-		select {
-		case c.Send <- msg:
-			// Успешная отправка сообщения
-		default:
-			// Если канал заполнен, пропустить отправку
-			log.Printf("Канал отправки заполнен для клиента %s в комнате %s", c.Nick, c.Room)
+		if envelope.Nonce != "" {
+			msg.Encrypted = &envelope
 		}
+		msg.createdAt = createdAt
+		msg.CreatedAt = createdAt.Format(models.Config.TimestampFormat)
+		history = append(history, msg)
 	}
+	return history, rows.Err()
 }
 
-// readPump читает сообщения от клиента и отправляет их в канал broadcast
-func (c *Client) readPump() {
-	defer func() {
-		c.Conn.Close()
-		mutex.Lock()
-		delete(clients[c.Room], c)
-		mutex.Unlock()
-		log.Printf("Клиент %s отключен от комнаты %s", c.Nick, c.Room)
-	}()
+// sendHistory отправляет историю сообщений клиенту
+func sendHistory(c *Client) {
+	history, err := loadHistory(context.Background(), c.Room, models.Config.HistoryLimit)
+	if err != nil {
+		slog.Error("Ошибка при получении истории сообщений", "err", err, logging.Room(c.Room))
+		return
+	}
+
+	for _, msg := range history {
+		// Если канал заполнен, сообщение пропускается
+		c.sendFrame(messageFrame(msg))
+	}
+}
+
+// readPump читает сообщения из WebSocket и передаёт их в обработку
+func (c *Client) readPump(conn wsTransport) {
+	defer disconnectClient(c)
 
 	for {
-		var msg Message
-		err := c.Conn.ReadJSON(&msg)
+		data, err := conn.Read()
+		var perr *ProtocolError
+		if errors.As(err, &perr) {
+			c.sendFrame(Frame{Op: OpError, Payload: perr})
+			continue
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Неожиданная ошибка закрытия: %v", err)
+				slog.Warn("Неожиданная ошибка закрытия", "err", err)
 			}
 			break
 		}
-
-		if msg.Type == "" {
-			msg.Type = "text"
+		// Ошибка уже сообщена клиенту кадром error или записана в лог
+		if conn.codec != nil {
+			c.handleBinary(conn.codec, data)
+		} else {
+			c.handleData(data)
 		}
+	}
+}
 
-		msg.Nickname = c.Nick
-		msg.CreatedAt = getCurrentTimestamp()
-
-		log.Printf("Получено сообщение от %s в комнате %s: %+v", c.Nick, c.Room, msg)
+// handleIncoming обрабатывает сообщение клиента независимо от транспорта
+// и отправляет сообщения чата в канал broadcast. Отказ возвращается как *ProtocolError.
+func (c *Client) handleIncoming(msg Message) error {
+	if !c.limiter.allow() {
+		slog.Warn("Превышена частота сообщений", logging.Nick(c.Nick), logging.Room(c.Room))
+		return protocolError(ErrRateLimited, "слишком много сообщений, повторите позже")
+	}
+
+	// Служебные сообщения не сохраняются и не рассылаются как сообщения чата
+	switch msg.Type {
+	case TypeRead:
+		c.handleReadReceipt(msg)
+		return nil
+	case TypeDMRequest:
+		c.handleDMRequest(msg)
+		return nil
+	case TypeDMAccept, TypeDMDecline:
+		c.handleDMAnswer(msg)
+		return nil
+	}
+	msg.ID = 0
+	msg.LastReadID = 0
+	msg.Target = ""
+	msg.Invite = ""
+	msg.Room = ""
+	msg.ReplyTo = 0
+	msg.Bot = false
+	msg.MediaURL = ""
+	msg.Width, msg.Height, msg.Thumbnails = 0, 0, nil
+	msg.Filename, msg.Size = "", 0
+	msg.Duration, msg.Waveform = 0, nil
+
+	if err := c.validateClientMessage(&msg); err != nil {
+		slog.Warn("Сообщение отклонено", "err", err, logging.Nick(c.Nick), logging.Room(c.Room))
+		return err
+	}
+
+	msg.Nickname = c.Nick
+	msg.CreatedAt = getCurrentTimestamp()
+
+	slog.Debug("Получено сообщение", logging.Nick(c.Nick), logging.Room(c.Room), "type", msg.Type, logging.Content(msg.Content))
 
-		broadcast <- MessageWithRoom{
-			Room:    c.Room,
-			Message: msg,
-		}
+	broadcast <- MessageWithRoom{
+		Room:    c.Room,
+		Message: msg,
+		From:    c.Identity,
 	}
+	return nil
 }
 
 // writePump отправляет сообщения клиенту из канала Send
 func (c *Client) writePump() {
-	for msg := range c.Send {
-		err := c.Conn.WriteJSON(msg)
+	for f := range c.Send {
+		err := c.writeFrame(f)
 		if err != nil {
-			log.Println("Ошибка при отправке сообщения:", err)
+			slog.Warn("Ошибка при отправке сообщения", "err", err)
 			c.Conn.Close()
 			break
 		}
@@ -177,82 +340,122 @@ func (c *Client) writePump() {
 
 // HandleMessages обрабатывает сообщения из канала broadcast
 func HandleMessages() {
+	ticker := time.NewTicker(hubHeartbeatInterval)
+	defer ticker.Stop()
+	markHubAlive()
+
 	for {
-		msgWithRoom := <-broadcast
+		var msgWithRoom MessageWithRoom
+		select {
+		case <-ticker.C:
+			markHubAlive()
+			continue
+		case msgWithRoom = <-broadcast:
+			markHubAlive()
+		}
 		room := msgWithRoom.Room
 		msg := msgWithRoom.Message
 
-		log.Printf("Обработка сообщения в комнате %s: %+v", room, msg)
+		slog.Debug("Обработка сообщения", logging.Room(room), "type", msg.Type, logging.Content(msg.Content))
 
 		// Сохранение сообщения в базе данных
-		saveMessage(room, msg)
+		if !msgWithRoom.Transient {
+			msg.ID = saveMessage(room, msg)
+			emitMessageEvent(room, msg)
+			go dispatchBots(msgWithRoom, msg)
+		}
 
 		// Рассылка сообщения всем клиентам в комнате
 		mutex.Lock()
 		roomClients := clients[room]
 		mutex.Unlock()
 
+		// Кадр кодируется один раз на формат и версию протокола, а не для каждого клиента
+		frame := messageFrame(msg)
+		frame.shared = &sharedEncoding{}
 		for client := range roomClients {
-			select {
-			case client.Send <- msg:
-				// Сообщение отправлено успешно
-			default:
+			if msgWithRoom.To != "" && client.Identity != msgWithRoom.To {
+				continue
+			}
+			if !client.trySend(frame) {
 				// Если канал заполнен, закрыть его и удалить клиента
-				close(client.Send)
+				client.closeSend()
 				mutex.Lock()
 				delete(clients[room], client)
 				mutex.Unlock()
-				log.Printf("Канал отправки закрыт для клиента %s в комнате %s из-за переполнения", client.Nick, room)
+				slog.Warn("Канал отправки закрыт из-за переполнения", logging.Nick(client.Nick), logging.Room(room))
 			}
 		}
 	}
 }
 
-// saveMessage сохраняет сообщение в базе данных
-func saveMessage(room string, msg Message) {
-	// Получение ID комнаты
-	var roomID int
-	err := models.DB.QueryRow(context.Background(), "SELECT id FROM rooms WHERE name=$1", room).Scan(&roomID)
+// saveMessage сохраняет сообщение в базе данных и возвращает его ID (0 при ошибке)
+func saveMessage(room string, msg Message) int64 {
+	// Получение ID комнаты; если комнаты нет, она создаётся
+	roomID, err := ensureRoomID(context.Background(), room)
 	if err != nil {
-		// Если комнаты нет, создать её
-		err = models.DB.QueryRow(context.Background(), "INSERT INTO rooms(name) VALUES($1) RETURNING id", room).Scan(&roomID)
-		if err != nil {
-			log.Println("Ошибка при создании комнаты:", err)
-			return
-		}
+		slog.Error("Ошибка при создании комнаты", "err", err, logging.Room(room))
+		return 0
 	}
 
 	// Вставка сообщения
-	_, err = models.DB.Exec(context.Background(),
-		"INSERT INTO messages(room_id, nickname, type, content, media_url) VALUES($1, $2, $3, $4, $5)",
-		roomID, msg.Nickname, msg.Type, msg.Content, msg.MediaURL)
+	// Зашифрованная нагрузка хранится как есть, без расшифровки
+	var envelope Encrypted
+	if msg.Encrypted != nil {
+		envelope = *msg.Encrypted
+	}
+	var id int64
+	err = models.DB.QueryRow(context.Background(),
+		`INSERT INTO messages(room_id, nickname, type, content, media_url, ciphertext, nonce, key_id,
+			media_width, media_height, thumbnails, media_filename, media_size, media_duration, waveform, bot)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id`,
+		roomID, msg.Nickname, msg.Type, msg.Content, msg.MediaURL,
+		envelope.Ciphertext, envelope.Nonce, envelope.KeyID,
+		msg.Width, msg.Height, thumbnailsJSON(msg.Thumbnails), msg.Filename, msg.Size,
+		msg.Duration, waveformJSON(msg.Waveform), msg.Bot).Scan(&id)
 	if err != nil {
-		log.Println("Ошибка при сохранении сообщения:", err)
-	} else {
-		log.Printf("Сообщение сохранено в базе данных для комнаты %s: %+v", room, msg)
+		slog.Error("Ошибка при сохранении сообщения", "err", err, logging.Room(room))
+		return 0
 	}
+	slog.Debug("Сообщение сохранено в базе данных", logging.Room(room), "type", msg.Type)
+	return id
 }
 
 // getCurrentTimestamp возвращает текущую временную метку в формате строки
 func getCurrentTimestamp() string {
-	return time.Now().Format("2006-01-02 15:04:05")
+	return time.Now().Format(models.Config.TimestampFormat)
 }
 
 // IndexHandler обрабатывает главную страницу
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	identity := ensureIdentity(w, r)
+
 	if r.Method == "POST" {
+		if !requireAllowedOrigin(w, r) {
+			return
+		}
+		if !validCSRFToken(r, identity) {
+			slog.Warn("Неверный CSRF-токен", logging.IP(r.RemoteAddr))
+			http.Error(w, "Форма устарела, обновите страницу", http.StatusForbidden)
+			return
+		}
 		room := r.FormValue("room")
 		nickname := r.FormValue("nickname")
 		if room == "" || nickname == "" {
 			http.Error(w, "Комната и Никнейм обязательны", http.StatusBadRequest)
 			return
 		}
+		if !checkNickname(w, r, room, nickname) {
+			return
+		}
+		// Шифрование применяется только к новой комнате
+		encrypted := r.FormValue("encrypted") != ""
 
 		// Вставка комнаты в базу данных, если она еще не существует
 		_, err := models.DB.Exec(context.Background(),
-			"INSERT INTO rooms(name) VALUES($1) ON CONFLICT (name) DO NOTHING", room)
+			"INSERT INTO rooms(name, encrypted) VALUES($1, $2) ON CONFLICT (name) DO NOTHING", room, encrypted)
 		if err != nil {
-			log.Println("Ошибка при вставке комнаты:", err)
+			slog.Error("Ошибка при вставке комнаты", "err", err, logging.Room(room))
 			http.Error(w, "Ошибка при создании комнаты", http.StatusInternalServerError)
 			return
 		}
@@ -261,21 +464,21 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получение списка комнат из базы данных
-	rows, err := models.DB.Query(context.Background(), "SELECT name FROM rooms")
+	// Получение страницы комнат с учётом поиска, сортировки и пагинации
+	lobby, err := loadLobby(r.Context(), parseLobbyQuery(r.URL.Query()))
 	if err != nil {
+		slog.Error("Ошибка при получении комнат", "err", err)
 		http.Error(w, "Ошибка при получении комнат", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	fillUnread(r, lobby.Rooms)
 
-	var rooms []string
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err == nil {
-			rooms = append(rooms, name)
-		}
+	// Комнаты, в которых участвует посетитель, с числом непрочитанных сообщений
+	joined, err := joinedRooms(r.Context(), identity)
+	if err != nil {
+		slog.Error("Ошибка при получении комнат участника", "err", err)
 	}
+	fillUnread(r, joined)
 
 	// Парсинг шаблона
 	tmpl, err := template.ParseFiles("templates/index.html")
@@ -286,9 +489,15 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Передача данных в шаблон
 	data := struct {
-		Rooms []string
+		Lobby     lobbyPage
+		Joined    []Room
+		Join      string
+		CSRFToken string
 	}{
-		Rooms: rooms,
+		Lobby:     lobby,
+		Joined:    joined,
+		Join:      r.URL.Query().Get("join"),
+		CSRFToken: csrfToken(identity),
 	}
 
 	tmpl.Execute(w, data)
@@ -304,6 +513,22 @@ func ChatPageHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Комната и Никнейм обязательны", http.StatusBadRequest)
 		return
 	}
+	if !checkNickname(w, r, room, nickname) {
+		return
+	}
+	identity := ensureIdentity(w, r)
+
+	// Личные комнаты доступны только их участникам
+	if allowed, err := canAccessRoom(r.Context(), identity, room); err != nil || !allowed {
+		http.Error(w, "Доступ к комнате запрещён", http.StatusForbidden)
+		return
+	}
+
+	encrypted, err := roomEncrypted(r.Context(), room)
+	if err != nil {
+		http.Error(w, "Ошибка при получении настроек комнаты", http.StatusInternalServerError)
+		return
+	}
 
 	// Парсинг шаблона
 	tmpl, err := template.ParseFiles("templates/chat.html")
@@ -314,145 +539,348 @@ func ChatPageHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Передача данных в шаблон
 	data := struct {
-		Room     string
-		Nickname string
+		Room      string
+		Nickname  string
+		Encrypted bool
 	}{
-		Room:     room,
-		Nickname: nickname,
+		Room:      room,
+		Nickname:  nickname,
+		Encrypted: encrypted,
 	}
 
 	tmpl.Execute(w, data)
 }
 
+// Типы файлов, которые принимаются для изображений и голосовых сообщений;
+// типы вложений (вид file) задаются в конфигурации
+var uploadKinds = map[string][]string{
+	"image": {"image/jpeg", "image/png"},
+	"voice": {"audio/mpeg", "audio/wav", "audio/ogg", "audio/webm"},
+}
+
+// Типы вложений из конфигурации и их предельные размеры; 0 — без отдельного ограничения
+var (
+	attachmentLimits map[string]int64
+	attachmentTypes  []string
+)
+
+// SetAttachmentTypes задаёт разрешённые типы вложений. Тип загрузки определяется
+// по содержимому, поэтому тип, которого нет в uploadTypes, отклонялся бы при
+// каждой загрузке; такая конфигурация считается ошибкой.
+func SetAttachmentTypes(limits map[string]int64) error {
+	var unknown []string
+	types := make([]string, 0, len(limits))
+	for t := range limits {
+		if !slices.ContainsFunc(uploadTypes, func(u uploadType) bool { return u.mime == t }) {
+			unknown = append(unknown, t)
+		}
+		types = append(types, t)
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("типы не распознаются по содержимому: %s; поддерживаются: %s",
+			strings.Join(unknown, ", "), strings.Join(detectableTypes(), ", "))
+	}
+	slices.Sort(types)
+	attachmentLimits, attachmentTypes = limits, types
+	return nil
+}
+
+// uploadAllowedTypes возвращает типы, разрешённые для вида загрузки
+func uploadAllowedTypes(kind string) ([]string, bool) {
+	if kind != "file" {
+		types, ok := uploadKinds[kind]
+		return types, ok
+	}
+	return attachmentTypes, true
+}
+
+// attachmentLimit возвращает предельный размер вложения типа; 0 — без отдельного ограничения
+func attachmentLimit(mimeType string) int64 {
+	return attachmentLimits[mimeType]
+}
+
 // ImageUploadHandler обрабатывает загрузку изображений
 func ImageUploadHandler(w http.ResponseWriter, r *http.Request) {
-	handleFileUpload(w, r, "image", []string{"image/jpeg", "image/png"})
+	handleFileUpload(w, r, "image")
 }
 
 // VoiceUploadHandler обрабатывает загрузку голосовых сообщений
 func VoiceUploadHandler(w http.ResponseWriter, r *http.Request) {
-	handleFileUpload(w, r, "voice", []string{"audio/mpeg", "audio/wav"})
+	handleFileUpload(w, r, "voice")
 }
 
-// handleFileUpload универсальная функция для обработки загрузки файлов
-func handleFileUpload(w http.ResponseWriter, r *http.Request, fileField string, allowedTypes []string) {
-	if r.Method != "POST" {
-		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
-		return
+// FileUploadHandler обрабатывает загрузку вложений: документов, архивов и видео
+func FileUploadHandler(w http.ResponseWriter, r *http.Request) {
+	handleFileUpload(w, r, "file")
+}
+
+// fileUpload описывает файл, отправляемый в комнату из браузера,
+// независимо от того, пришёл он одной формой или по частям
+type fileUpload struct {
+	Room        string
+	Kind        string // image, voice или file
+	Filename    string
+	ContentType string     // тип, заявленный клиентом
+	Envelope    *Encrypted // конверт зашифрованной комнаты; nil для обычной
+}
+
+// Ошибки загрузки, кроме отклонения по содержимому
+var (
+	// errSaveUpload отличает сбой хранилища от отклонённого файла
+	errSaveUpload     = errors.New("ошибка при сохранении файла")
+	errUploadTooLarge = errors.New("файл слишком большой")
+)
+
+// uploadErrorStatus выбирает код ответа для ошибки publishUpload
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errSaveUpload):
+		return http.StatusInternalServerError
+	case errors.Is(err, errUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedType):
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
 	}
+}
 
-	// Ограничение размера загружаемого файла (например, 10MB)
-	err := r.ParseMultipartForm(10 << 20) // 10MB
-	if err != nil {
-		log.Printf("Ошибка при разборе формы: %v", err)
-		http.Error(w, "Ошибка при разборе формы", http.StatusBadRequest)
-		return
+// Предельная длина имени вложения в символах
+const maxAttachmentNameLength = 255
+
+// attachmentFilename оставляет от имени файла клиента только последний
+// компонент пути без управляющих символов
+func attachmentFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
 	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxAttachmentNameLength {
+		name = string(runes[:maxAttachmentNameLength])
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
 
-	file, handler, err := r.FormFile(fileField)
+// checkUploadRoom проверяет, что личность может загружать файлы в комнату,
+// и сообщает, зашифрована ли комната. При отказе отвечает клиенту сам.
+func checkUploadRoom(w http.ResponseWriter, r *http.Request, identity, room string) (encrypted bool, ok bool) {
+	// Загружать файлы в личную комнату могут только её участники
+	if allowed, err := canAccessRoom(r.Context(), identity, room); err != nil || !allowed {
+		http.Error(w, "Доступ к комнате запрещён", http.StatusForbidden)
+		return false, false
+	}
+	encrypted, err := roomEncrypted(r.Context(), room)
 	if err != nil {
-		log.Printf("Ошибка при получении файла: %v", err)
-		http.Error(w, "Ошибка при получении файла", http.StatusBadRequest)
-		return
+		slog.Error("Ошибка при получении настроек комнаты", "err", err)
+		http.Error(w, "Ошибка при получении настроек комнаты", http.StatusInternalServerError)
+		return false, false
 	}
-	defer file.Close()
+	return encrypted, true
+}
 
-	// Проверка типа файла
-	fileType := handler.Header.Get("Content-Type")
-	isAllowed := false
-	for _, t := range allowedTypes {
-		if fileType == t {
-			isAllowed = true
-			break
+// publishUpload проверяет содержимое файла, сохраняет его и рассылает сообщение
+// в комнату. Ошибка errSaveUpload означает сбой сервера, остальные — что файл отклонён.
+func publishUpload(file io.ReadSeeker, u fileUpload) (Message, error) {
+	var sniffed sniffedUpload
+	if u.Envelope != nil {
+		// В зашифрованной комнате файл принимается как непрозрачный блок,
+		// а его тип и имя передаются только внутри зашифрованных метаданных
+		sniffed.Ext = ".bin"
+	} else {
+		// Тип определяется по содержимому, заявленный клиентом тип только сверяется;
+		// расширение для хранения выбирается по определённому типу
+		allowed, _ := uploadAllowedTypes(u.Kind)
+		var err error
+		if sniffed, err = sniffUpload(file, u.ContentType, allowed); err != nil {
+			return Message{}, err
 		}
 	}
-	if !isAllowed {
-		log.Printf("Неподдерживаемый тип файла: %s", fileType)
-		http.Error(w, "Неподдерживаемый тип файла", http.StatusBadRequest)
-		return
+
+	msg := Message{
+		Nickname:  systemNickname,
+		Type:      u.Kind,
+		Content:   fmt.Sprintf("файл: %s", u.Filename),
+		CreatedAt: getCurrentTimestamp(),
+	}
+	if err := storeUploadedFile(file, sniffed, u.Kind, u.Filename, &msg); err != nil {
+		return Message{}, err
 	}
 
-	// Генерация уникального имени файла
-	timestamp := time.Now().UnixNano()
-	ext := filepath.Ext(handler.Filename)
-	filename := fmt.Sprintf("%d%s", timestamp, ext)
+	if u.Envelope != nil {
+		msg.Type = TypeEncrypted
+		msg.Content = ""
+		msg.Encrypted = u.Envelope
+	}
 
-	// Создание директории uploads, если не существует
-	uploadDir := "./uploads"
-	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		err = os.Mkdir(uploadDir, os.ModePerm)
+	slog.Debug("Создание сообщения", "type", msg.Type, "media_url", msg.MediaURL)
+
+	broadcast <- MessageWithRoom{
+		Room:    u.Room,
+		Message: msg,
+	}
+	return msg, nil
+}
+
+// storeUploadedFile сохраняет проверенный файл вида kind и заполняет поля
+// сообщения. Зашифрованный файл (тип не определён) сохраняется как есть: для
+// него известны только размер, а имя передаётся внутри конверта. Ошибка
+// errSaveUpload означает сбой сервера, остальные — что файл отклонён.
+func storeUploadedFile(file io.ReadSeeker, sniffed sniffedUpload, kind, filename string, msg *Message) error {
+	// Вложения хранят исходное имя и размер; видео показывается проигрывателем
+	if kind == "file" {
+		size, err := file.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
 		if err != nil {
-			log.Printf("Ошибка при создании директории для загрузок: %v", err)
-			http.Error(w, "Ошибка при создании директории для загрузок", http.StatusInternalServerError)
-			return
+			return fmt.Errorf("%w: %v", errSaveUpload, err)
+		}
+		if limit := attachmentLimit(sniffed.MIME); limit > 0 && size > limit {
+			return fmt.Errorf("%w: %s больше %d байт", errUploadTooLarge, sniffed.MIME, limit)
+		}
+		msg.Size = size
+		if sniffed.MIME != "" {
+			msg.Filename = attachmentFilename(filename)
+		}
+		if strings.HasPrefix(sniffed.MIME, "video/") {
+			msg.Type = "video"
 		}
 	}
 
-	// Сохранение файла
-	filePath := filepath.Join(uploadDir, filename)
-	dst, err := os.Create(filePath)
+	// Голосовое сообщение должно разбираться как звукозапись; длительность
+	// и осциллограмма показываются до начала воспроизведения
+	if kind == "voice" && sniffed.MIME != "" {
+		audio, err := analyzeAudio(file, sniffed.MIME)
+		if err != nil {
+			return err
+		}
+		msg.Duration, msg.Waveform = audio.Duration, audio.Waveform
+	}
+
+	// Сохранение файла под уникальным именем; изображение перекодируется
+	// без метаданных и сохраняется вместе с миниатюрами
+	var err error
+	if sniffed.Image != nil {
+		err = storeImage(file, sniffed, msg)
+	} else {
+		var name string
+		name, err = saveUpload(file, sniffed.Ext)
+		msg.MediaURL = uploadsURLPrefix + name
+	}
 	if err != nil {
-		log.Printf("Ошибка при создании файла: %v", err)
-		http.Error(w, "Ошибка при создании файла", http.StatusInternalServerError)
+		return fmt.Errorf("%w: %v", errSaveUpload, err)
+	}
+	return nil
+}
+
+// uploadEnvelope собирает конверт зашифрованного файла из полей запроса
+func uploadEnvelope(ciphertext, nonce, keyID string) (*Encrypted, error) {
+	envelope := &Encrypted{Ciphertext: ciphertext, Nonce: nonce, KeyID: keyID}
+	if err := envelope.Validate(); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// handleFileUpload принимает файл одной формой multipart
+func handleFileUpload(w http.ResponseWriter, r *http.Request, fileField string) {
+	if r.Method != "POST" {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAllowedOrigin(w, r) {
 		return
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	// Ограничение размера загружаемого файла
+	r.Body = http.MaxBytesReader(w, r.Body, models.Config.MaxUploadBytes)
+	err := r.ParseMultipartForm(models.Config.MaxUploadBytes)
 	if err != nil {
-		log.Printf("Ошибка при копировании файла: %v", err)
-		http.Error(w, "Ошибка при копировании файла", http.StatusInternalServerError)
+		slog.Warn("Ошибка при разборе формы", "err", err)
+		http.Error(w, "Ошибка при разборе формы", http.StatusBadRequest)
 		return
 	}
 
-	// Формирование URL для доступа к файлу
-	fileURL := fmt.Sprintf("/uploads/%s", filename)
+	file, handler, err := r.FormFile(fileField)
+	if err != nil {
+		slog.Warn("Ошибка при получении файла", "err", err)
+		http.Error(w, "Ошибка при получении файла", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
 
 	// Получение комнаты из формы
 	room := r.FormValue("room")
 	if room == "" {
-		log.Println("Комната обязательна, но не была предоставлена")
+		slog.Warn("Комната обязательна, но не была предоставлена")
 		http.Error(w, "Комната обязательна", http.StatusBadRequest)
 		return
 	}
 
-	// Определение типа сообщения
-	var msgType string
-	if fileField == "image" {
-		msgType = "image"
-	} else if fileField == "voice" {
-		msgType = "voice"
-	} else {
-		msgType = "file"
+	identity, _ := identityFromRequest(r)
+	encrypted, ok := checkUploadRoom(w, r, identity, room)
+	if !ok {
+		return
 	}
 
-	// Создание сообщения
-	msg := Message{
-		Nickname:  "System",
-		Type:      msgType,
-		Content:   fmt.Sprintf("файл: %s", handler.Filename),
-		MediaURL:  fileURL,
-		CreatedAt: getCurrentTimestamp(),
+	upload := fileUpload{
+		Room:        room,
+		Kind:        fileField,
+		Filename:    handler.Filename,
+		ContentType: handler.Header.Get("Content-Type"),
+	}
+	if encrypted {
+		upload.Envelope, err = uploadEnvelope(r.FormValue("ciphertext"), r.FormValue("nonce"), r.FormValue("key_id"))
+		if err != nil {
+			slog.Warn("Некорректный конверт зашифрованного файла", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	log.Printf("Создание сообщения: %+v", msg)
-
-	broadcast <- MessageWithRoom{
-		Room:    room,
-		Message: msg,
+	msg, err := publishUpload(file, upload)
+	if errors.Is(err, errSaveUpload) {
+		slog.Error("Ошибка при сохранении файла", "err", err)
+		http.Error(w, "Ошибка при сохранении файла", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		slog.Warn("Файл отклонён при проверке содержимого", "err", err, "content_type", upload.ContentType)
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
 	}
 
 	// Возврат URL файла и типа
 	response := struct {
-		MediaURL string `json:"media_url"`
-		Type     string `json:"type"`
+		MediaURL   string      `json:"media_url"`
+		Type       string      `json:"type"`
+		Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+		Filename   string      `json:"filename,omitempty"`
+		Size       int64       `json:"size,omitempty"`
+		Duration   float64     `json:"duration,omitempty"`
+		Waveform   []int       `json:"waveform,omitempty"`
 	}{
-		MediaURL: fileURL,
-		Type:     msgType,
+		MediaURL:   msg.MediaURL,
+		Type:       msg.Type,
+		Thumbnails: msg.Thumbnails,
+		Filename:   msg.Filename,
+		Size:       msg.Size,
+		Duration:   msg.Duration,
+		Waveform:   msg.Waveform,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 
-	log.Printf("Файл успешно загружен: %s (%s) в комнату: %s", handler.Filename, fileType, room)
+	slog.Info("Файл успешно загружен", "type", msg.Type, logging.Room(room), logging.IP(r.RemoteAddr))
 }
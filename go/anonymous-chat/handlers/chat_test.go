@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSetAttachmentTypes(t *testing.T) {
+	defer SetAttachmentTypes(nil)
+
+	if err := SetAttachmentTypes(map[string]int64{"application/pdf": 1 << 20, "image/gif": 0}); err == nil {
+		t.Fatal("SetAttachmentTypes accepted image/gif, which is not detected by content")
+	}
+	if err := SetAttachmentTypes(map[string]int64{"video/mp4": 200 << 20, "application/pdf": 0}); err != nil {
+		t.Fatalf("SetAttachmentTypes: %v", err)
+	}
+	types, ok := uploadAllowedTypes("file")
+	if !ok || !slices.Equal(types, []string{"application/pdf", "video/mp4"}) {
+		t.Errorf("uploadAllowedTypes(file) = %v, %v", types, ok)
+	}
+	if got := attachmentLimit("video/mp4"); got != 200<<20 {
+		t.Errorf("attachmentLimit(video/mp4) = %d", got)
+	}
+	if got := attachmentLimit("application/zip"); got != 0 {
+		t.Errorf("attachmentLimit(application/zip) = %d, want 0", got)
+	}
+}
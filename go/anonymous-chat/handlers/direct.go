@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Видимость скрытой комнаты для личной переписки двух участников
+const VisibilityDirect = "direct"
+
+// Типы служебных сообщений для личной переписки
+const (
+	TypeDMRequest = "dm_request" // клиент приглашает участника по нику (Target)
+	TypeDMInvite  = "dm_invite"  // сервер передаёт приглашение адресату
+	TypeDMAccept  = "dm_accept"  // адресат принимает приглашение (Invite)
+	TypeDMDecline = "dm_decline" // адресат отклоняет приглашение (Invite)
+	TypeDMReady   = "dm_ready"   // комната создана, её имя в поле Room
+	TypeDMError   = "dm_error"   // приглашение не удалось, причина в Content
+)
+
+// Время, в течение которого приглашение можно принять
+const dmInviteTTL = 5 * time.Minute
+
+// dmInvite описывает ожидающее приглашение в личную переписку
+type dmInvite struct {
+	Room         string // комната, из которой отправлено приглашение
+	FromIdentity string
+	FromNick     string
+	ToIdentity   string
+	ToNick       string
+	ExpiresAt    time.Time
+}
+
+// Ожидающие приглашения по их идентификатору
+var dmInvites = make(map[string]dmInvite)
+var dmMutex = &sync.Mutex{}
+
+// randomHex возвращает случайную строку из n байт в шестнадцатеричном виде
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// sendTo отправляет служебное сообщение только соединениям указанной личности в комнате
+func sendTo(room, identity string, msg Message) {
+	msg.CreatedAt = getCurrentTimestamp()
+	broadcast <- MessageWithRoom{
+		Room:      room,
+		Message:   msg,
+		Transient: true,
+		To:        identity,
+	}
+}
+
+// findClientByNick ищет подключённого клиента комнаты по нику
+func findClientByNick(room, nickname string) *Client {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for client := range clients[room] {
+		if client.Nick == nickname {
+			return client
+		}
+	}
+	return nil
+}
+
+// handleDMRequest отправляет приглашение в личную переписку участнику той же комнаты
+func (c *Client) handleDMRequest(msg Message) {
+	target := findClientByNick(c.Room, msg.Target)
+	if target == nil {
+		sendTo(c.Room, c.Identity, Message{Type: TypeDMError, Target: msg.Target, Content: "Участник не найден в комнате"})
+		return
+	}
+	if target.Identity == c.Identity {
+		sendTo(c.Room, c.Identity, Message{Type: TypeDMError, Target: msg.Target, Content: "Нельзя пригласить самого себя"})
+		return
+	}
+
+	id := randomHex(16)
+	dmMutex.Lock()
+	for key, invite := range dmInvites {
+		if time.Now().After(invite.ExpiresAt) {
+			delete(dmInvites, key)
+		}
+	}
+	dmInvites[id] = dmInvite{
+		Room:         c.Room,
+		FromIdentity: c.Identity,
+		FromNick:     c.Nick,
+		ToIdentity:   target.Identity,
+		ToNick:       target.Nick,
+		ExpiresAt:    time.Now().Add(dmInviteTTL),
+	}
+	dmMutex.Unlock()
+
+	slog.Info("Приглашение в личную переписку", logging.Nick(c.Nick), logging.Room(c.Room))
+	sendTo(c.Room, target.Identity, Message{Type: TypeDMInvite, Nickname: c.Nick, Invite: id})
+}
+
+// takeInvite извлекает приглашение, адресованное личности
+func takeInvite(id, identity string) (dmInvite, bool) {
+	dmMutex.Lock()
+	defer dmMutex.Unlock()
+	invite, ok := dmInvites[id]
+	if !ok || invite.ToIdentity != identity || time.Now().After(invite.ExpiresAt) {
+		return dmInvite{}, false
+	}
+	delete(dmInvites, id)
+	return invite, true
+}
+
+// handleDMAnswer обрабатывает принятие или отклонение приглашения
+func (c *Client) handleDMAnswer(msg Message) {
+	invite, ok := takeInvite(msg.Invite, c.Identity)
+	if !ok {
+		sendTo(c.Room, c.Identity, Message{Type: TypeDMError, Content: "Приглашение не найдено или истекло"})
+		return
+	}
+
+	if msg.Type == TypeDMDecline {
+		sendTo(invite.Room, invite.FromIdentity, Message{Type: TypeDMError, Target: invite.ToNick, Content: "Приглашение отклонено"})
+		return
+	}
+
+	room, err := createDirectRoom(context.Background(), invite)
+	if err != nil {
+		slog.Error("Ошибка при создании личной комнаты", "err", err)
+		sendTo(c.Room, c.Identity, Message{Type: TypeDMError, Content: "Ошибка при создании комнаты"})
+		sendTo(invite.Room, invite.FromIdentity, Message{Type: TypeDMError, Target: invite.ToNick, Content: "Ошибка при создании комнаты"})
+		return
+	}
+
+	sendTo(invite.Room, invite.FromIdentity, Message{Type: TypeDMReady, Target: invite.ToNick, Room: room})
+	sendTo(invite.Room, invite.ToIdentity, Message{Type: TypeDMReady, Target: invite.FromNick, Room: room})
+}
+
+// createDirectRoom создаёт скрытую комнату, доступную только двум участникам приглашения
+func createDirectRoom(ctx context.Context, invite dmInvite) (string, error) {
+	name := "dm-" + randomHex(12)
+
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(context.Background())
+
+	var roomID int
+	err = tx.QueryRow(ctx,
+		"INSERT INTO rooms(name, title, visibility) VALUES($1, $2, $3) RETURNING id",
+		name, invite.FromNick+" и "+invite.ToNick, VisibilityDirect).Scan(&roomID)
+	if err != nil {
+		return "", err
+	}
+
+	members := [][2]string{
+		{invite.FromIdentity, invite.FromNick},
+		{invite.ToIdentity, invite.ToNick},
+	}
+	for _, m := range members {
+		_, err = tx.Exec(ctx,
+			"INSERT INTO room_members(identity, room_id, nickname) VALUES($1, $2, $3)",
+			m[0], roomID, m[1])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return name, tx.Commit(ctx)
+}
+
+// canAccessRoom проверяет, что личность может читать комнату и писать в неё.
+// Личные комнаты доступны только участникам; несуществующие комнаты доступны всем.
+func canAccessRoom(ctx context.Context, identity, room string) (bool, error) {
+	var visibility string
+	var member bool
+	err := models.DB.QueryRow(ctx, `
+		SELECT r.visibility,
+			EXISTS(SELECT 1 FROM room_members rm WHERE rm.room_id = r.id AND rm.identity = $2)
+		FROM rooms r WHERE r.name = $1`, room, identity).Scan(&visibility, &member)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return visibility != VisibilityDirect || member, nil
+}
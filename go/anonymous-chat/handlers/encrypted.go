@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"anonymous-chat/models"
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Тип сообщения с зашифрованным содержимым; в зашифрованных комнатах допускается только он
+const TypeEncrypted = "encrypted"
+
+// Ограничения конверта зашифрованного сообщения
+const (
+	maxCiphertextLen = 64 << 10 // размер шифртекста после декодирования base64
+	minNonceLen      = 12
+	maxNonceLen      = 24
+	maxKeyIDLen      = 64
+)
+
+// Encrypted описывает конверт зашифрованного сообщения.
+// Сервер не расшифровывает полезную нагрузку и проверяет только форму конверта.
+type Encrypted struct {
+	Ciphertext string `json:"ciphertext"` // base64
+	Nonce      string `json:"nonce"`      // base64
+	KeyID      string `json:"key_id"`
+}
+
+// Validate проверяет форму и размер конверта.
+// Пустой шифртекст допускается для вложений, у которых зашифрован только файл.
+func (e *Encrypted) Validate() error {
+	ciphertext, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+	if err != nil {
+		return errors.New("шифртекст должен быть в base64")
+	}
+	if len(ciphertext) > maxCiphertextLen {
+		return errors.New("шифртекст слишком большой")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil {
+		return errors.New("nonce должен быть в base64")
+	}
+	if len(nonce) < minNonceLen || len(nonce) > maxNonceLen {
+		return errors.New("недопустимая длина nonce")
+	}
+	if e.KeyID == "" || len(e.KeyID) > maxKeyIDLen {
+		return errors.New("недопустимый идентификатор ключа")
+	}
+	return nil
+}
+
+// roomEncrypted сообщает, включено ли в комнате сквозное шифрование.
+// Несуществующие комнаты считаются незашифрованными.
+func roomEncrypted(ctx context.Context, room string) (bool, error) {
+	var encrypted bool
+	err := models.DB.QueryRow(ctx, "SELECT encrypted FROM rooms WHERE name = $1", room).Scan(&encrypted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return encrypted, err
+}
+
+// validateEncryptedMessage проверяет сообщение, отправленное в зашифрованную комнату
+func validateEncryptedMessage(msg *Message) error {
+	if msg.Type != TypeEncrypted || msg.Encrypted == nil {
+		return errors.New("в зашифрованной комнате допускаются только зашифрованные сообщения")
+	}
+	if msg.Content != "" || msg.MediaURL != "" {
+		return errors.New("открытый текст в зашифрованной комнате запрещён")
+	}
+	if msg.Encrypted.Ciphertext == "" {
+		return errors.New("пустой шифртекст")
+	}
+	return msg.Encrypted.Validate()
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Форматы экспорта истории комнаты
+const (
+	ExportJSON     = "json"
+	ExportHTML     = "html"
+	ExportMarkdown = "md"
+)
+
+// Версия формата JSON-экспорта; увеличивается при несовместимых изменениях.
+// Во второй версии время сообщений записывается в RFC 3339.
+const exportFormatVersion = 2
+
+// Префикс URL загруженных файлов и каталог с файлами внутри архива
+const (
+	uploadsURLPrefix = "/uploads/"
+	exportMediaDir   = "media"
+)
+
+// Transcript описывает экспортированную историю комнаты
+type Transcript struct {
+	FormatVersion int       `json:"format_version"`
+	ExportedAt    time.Time `json:"exported_at"`
+	Room          Room      `json:"room"`
+	Messages      []Message `json:"messages"`
+}
+
+// uploadFileName возвращает имя файла в директории загрузок для URL вида /uploads/<имя>.
+// Для прочих URL возвращается пустая строка.
+func uploadFileName(mediaURL string) string {
+	if !strings.HasPrefix(mediaURL, uploadsURLPrefix) {
+		return ""
+	}
+	name := path.Base(mediaURL)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// bundleMediaURLs заменяет ссылки на загруженные файлы и миниатюры относительными
+// ссылками внутри архива и возвращает имена файлов, которые нужно включить в архив
+func bundleMediaURLs(messages []Message) []string {
+	var files []string
+	seen := make(map[string]bool)
+	bundle := func(url *string) {
+		name := uploadFileName(*url)
+		if name == "" {
+			return
+		}
+		*url = exportMediaDir + "/" + name
+		if !seen[name] {
+			seen[name] = true
+			files = append(files, name)
+		}
+	}
+	for i := range messages {
+		bundle(&messages[i].MediaURL)
+		// Миниатюры копируются, чтобы не менять срез, общий с исходным сообщением
+		thumbs := make([]Thumbnail, len(messages[i].Thumbnails))
+		copy(thumbs, messages[i].Thumbnails)
+		for j := range thumbs {
+			bundle(&thumbs[j].URL)
+		}
+		if len(thumbs) > 0 {
+			messages[i].Thumbnails = thumbs
+		}
+	}
+	return files
+}
+
+// renderTranscript записывает историю в выбранном формате
+func renderTranscript(w io.Writer, format string, t Transcript) error {
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	case ExportHTML:
+		tmpl, err := template.ParseFiles("templates/export.html")
+		if err != nil {
+			return err
+		}
+		return tmpl.Execute(w, t)
+	case ExportMarkdown:
+		return renderMarkdown(w, t)
+	}
+	return fmt.Errorf("неизвестный формат экспорта: %s", format)
+}
+
+// markdownEscaper экранирует символы разметки Markdown
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", "&lt;", ">", "&gt;", "#", `\#`, "|", `\|`,
+)
+
+// renderMarkdown записывает историю в формате Markdown
+func renderMarkdown(w io.Writer, t Transcript) error {
+	var b strings.Builder
+	title := t.Room.Title
+	if title == "" {
+		title = t.Room.Name
+	}
+	fmt.Fprintf(&b, "# %s\n\n", markdownEscaper.Replace(title))
+	if t.Room.Topic != "" {
+		fmt.Fprintf(&b, "_%s_\n\n", markdownEscaper.Replace(t.Room.Topic))
+	}
+	fmt.Fprintf(&b, "Экспортировано: %s, сообщений: %d\n\n", t.ExportedAt.Format("2006-01-02 15:04:05"), len(t.Messages))
+
+	for _, msg := range t.Messages {
+		sender := markdownEscaper.Replace(msg.Nickname)
+		if msg.Bot {
+			sender += ` \[бот\]`
+		}
+		fmt.Fprintf(&b, "**[%s] %s:** ", msg.CreatedAt, sender)
+		switch {
+		case msg.Encrypted != nil:
+			b.WriteString("_[зашифрованное сообщение]_")
+			if msg.MediaURL != "" {
+				fmt.Fprintf(&b, " [файл](<%s>)", msg.MediaURL)
+			}
+		case msg.Type == "image":
+			fmt.Fprintf(&b, "![изображение](<%s>)", msg.MediaURL)
+		case msg.Type == "file" && msg.Filename != "":
+			fmt.Fprintf(&b, "[%s](<%s>)", markdownEscaper.Replace(msg.Filename), msg.MediaURL)
+		case msg.MediaURL != "":
+			fmt.Fprintf(&b, "[%s](<%s>)", markdownEscaper.Replace(msg.Type), msg.MediaURL)
+		default:
+			b.WriteString(markdownEscaper.Replace(msg.Content))
+		}
+		b.WriteString("\n\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeExportZip записывает архив с уже подготовленной историей и файлами files.
+// Файлы копируются в архив по одному, не накапливаясь в памяти.
+func writeExportZip(ctx context.Context, w io.Writer, format string, transcript []byte, files []string) error {
+	zw := zip.NewWriter(w)
+	dst, err := zw.Create("transcript." + format)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(transcript); err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		src, _, err := blobs.Open(ctx, name)
+		if err != nil {
+			// Отсутствующий файл не мешает экспорту остальной истории
+			slog.Warn("Файл для экспорта не найден", "file", name, "err", err)
+			continue
+		}
+		dst, err := zw.Create(exportMediaDir + "/" + name)
+		if err == nil {
+			_, err = io.Copy(dst, src)
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// exportContentTypes сопоставляет форматы экспорта и типы содержимого
+var exportContentTypes = map[string]string{
+	ExportJSON:     "application/json; charset=utf-8",
+	ExportHTML:     "text/html; charset=utf-8",
+	ExportMarkdown: "text/markdown; charset=utf-8",
+}
+
+// exportFileName возвращает безопасное имя файла для заголовка Content-Disposition
+func exportFileName(room, ext string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, room)
+	return fmt.Sprintf("room-%s-%s.%s", safe, time.Now().Format("20060102-150405"), ext)
+}
+
+// ExportRoomHandler отдаёт историю комнаты в формате json, html или md.
+// С параметром media=1 отдаётся ZIP-архив с историей и файлами из директории загрузок.
+func ExportRoomHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["room"]
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportJSON
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_format", "Формат должен быть json, html или md")
+		return
+	}
+	withMedia := r.URL.Query().Get("media") == "1"
+
+	identity, _ := identityFromRequest(r)
+	room, err := loadRoom(r.Context(), name)
+	if err == nil {
+		var allowed bool
+		if allowed, err = canAccessRoom(r.Context(), identity, name); err == nil && !allowed {
+			err = pgx.ErrNoRows
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+		return
+	}
+	if err != nil {
+		slog.Error("Ошибка при получении комнаты", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении комнаты")
+		return
+	}
+
+	messages, err := loadHistory(r.Context(), name, 0)
+	if err != nil {
+		slog.Error("Ошибка при получении истории сообщений", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении истории сообщений")
+		return
+	}
+	if messages == nil {
+		messages = []Message{}
+	}
+	// Формат отображения зависит от настроек сервера, поэтому в JSON для обмена
+	// между серверами время записывается в RFC 3339, как и created_at комнаты
+	if format == ExportJSON {
+		for i := range messages {
+			messages[i].CreatedAt = messages[i].createdAt.Format(time.RFC3339Nano)
+		}
+	}
+
+	t := Transcript{
+		FormatVersion: exportFormatVersion,
+		ExportedAt:    time.Now(),
+		Room:          room,
+		Messages:      messages,
+	}
+
+	var files []string
+	if withMedia {
+		files = bundleMediaURLs(t.Messages)
+	}
+
+	// История собирается в памяти, чтобы при ошибке шаблона вернуть корректный ответ;
+	// файлы из загрузок в память не читаются
+	var buf bytes.Buffer
+	if err := renderTranscript(&buf, format, t); err != nil {
+		slog.Error("Ошибка при экспорте комнаты", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при экспорте комнаты")
+		return
+	}
+
+	ext := format
+	if withMedia {
+		contentType = "application/zip"
+		ext = "zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(name, ext)))
+	if !withMedia {
+		w.Write(buf.Bytes())
+		slog.Info("Комната экспортирована", logging.Room(name), "format", format, "media", false)
+		return
+	}
+
+	// Архив передаётся потоком; после начала ответа ошибку можно только записать в журнал,
+	// а клиент получит оборванный архив
+	if err := writeExportZip(r.Context(), w, format, buf.Bytes(), files); err != nil {
+		slog.Error("Ошибка при экспорте комнаты", "err", err, logging.Room(name))
+		return
+	}
+	slog.Info("Комната экспортирована", logging.Room(name), "format", format, "media", true)
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"anonymous-chat/models"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Интервал, с которым HandleMessages отмечает, что он жив
+const hubHeartbeatInterval = 5 * time.Second
+
+// Время последней активности горутины HandleMessages (UnixNano)
+var hubHeartbeat atomic.Int64
+
+// Признак того, что сервер находится в процессе остановки
+var shuttingDown atomic.Bool
+
+// markHubAlive отмечает, что горутина HandleMessages работает
+func markHubAlive() {
+	hubHeartbeat.Store(time.Now().UnixNano())
+}
+
+// hubAlive сообщает, отмечалась ли горутина HandleMessages в последние три интервала
+func hubAlive() bool {
+	last := hubHeartbeat.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) < 3*hubHeartbeatInterval
+}
+
+// SetShuttingDown переводит сервер в режим остановки: готовность начинает возвращать ошибку
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// IsShuttingDown сообщает, находится ли сервер в процессе остановки
+func IsShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// healthResponse описывает ответ эндпоинтов /healthz и /readyz
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// writeHealth отправляет результат проверок с кодом 200 или 503
+func writeHealth(w http.ResponseWriter, checks map[string]string) {
+	resp := healthResponse{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			resp.Status = "fail"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// LivenessHandler сообщает, что процесс и горутина HandleMessages живы
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"hub": "ok"}
+	if !hubAlive() {
+		checks["hub"] = "горутина обработки сообщений не отвечает"
+	}
+	writeHealth(w, checks)
+}
+
+// ReadinessHandler проверяет доступность базы данных и директории загрузок
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"shutdown": "ok",
+		"database": "ok",
+		"uploads":  "ok",
+	}
+
+	if IsShuttingDown() {
+		checks["shutdown"] = "сервер останавливается"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	// Текст ошибки может содержать адреса и параметры подключения, поэтому
+	// он пишется только в журнал, а ответ содержит общее описание
+	if err := models.DB.Ping(ctx); err != nil {
+		slog.Warn("База данных недоступна", "err", err)
+		checks["database"] = "недоступна"
+	}
+
+	if err := blobs.Ping(ctx); err != nil {
+		slog.Warn("Хранилище загрузок недоступно", "err", err)
+		checks["uploads"] = "недоступно"
+	}
+
+	writeHealth(w, checks)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Имя cookie с анонимным идентификатором участника
+const identityCookieName = "anon_id"
+
+// Срок жизни cookie с идентификатором (один год)
+const identityCookieMaxAge = 365 * 24 * 60 * 60
+
+// identityKey превращает секретный токен из cookie в ключ, который хранится в базе.
+// Сам токен на сервере не сохраняется.
+func identityKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validIdentityToken проверяет, что токен имеет формат, выдаваемый сервером
+func validIdentityToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// identityFromRequest возвращает ключ анонимной личности из cookie запроса
+func identityFromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(identityCookieName)
+	if err != nil || !validIdentityToken(cookie.Value) {
+		return "", false
+	}
+	return identityKey(cookie.Value), true
+}
+
+// newIdentityCookie создаёт cookie с новым случайным токеном
+func newIdentityCookie(r *http.Request) (*http.Cookie, string) {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+	cookie := &http.Cookie{
+		Name:     identityCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   identityCookieMaxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie, identityKey(token)
+}
+
+// ensureIdentity возвращает ключ анонимной личности, выдавая новую cookie при её отсутствии
+func ensureIdentity(w http.ResponseWriter, r *http.Request) string {
+	if key, ok := identityFromRequest(r); ok {
+		return key
+	}
+	cookie, key := newIdentityCookie(r)
+	http.SetCookie(w, cookie)
+	return key
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Размеры миниатюр по большей стороне; размеры не меньше оригинала пропускаются
+var thumbnailSizes = []int{160, 480, 1024}
+
+// Качество JPEG для оригинала и миниатюр
+const (
+	imageJPEGQuality     = 90
+	thumbnailJPEGQuality = 80
+)
+
+// Thumbnail описывает уменьшенную копию изображения
+type Thumbnail struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// storeImage сохраняет изображение без метаданных и его миниатюры и заполняет
+// поля сообщения. Исходный файл не сохраняется: изображение перекодируется,
+// поэтому EXIF (GPS, серийный номер камеры) и другие блоки не попадают на диск.
+// Ориентация из EXIF применяется к пикселям до перекодирования.
+func storeImage(file io.ReadSeeker, sniffed sniffedUpload, msg *Message) error {
+	orientation := 1
+	if sniffed.MIME == "image/jpeg" {
+		orientation = jpegOrientation(file)
+	}
+	img := orientedRGBA(sniffed.Image, orientation)
+
+	filename, err := saveEncodedImage(img, sniffed, imageJPEGQuality)
+	if err != nil {
+		return err
+	}
+	msg.MediaURL = uploadsURLPrefix + filename
+	msg.Width, msg.Height = img.Rect.Dx(), img.Rect.Dy()
+
+	msg.Thumbnails = nil
+	for _, size := range thumbnailSizes {
+		w, h := fitSize(msg.Width, msg.Height, size)
+		if w >= msg.Width && h >= msg.Height {
+			break
+		}
+		filename, err := saveEncodedImage(downscale(img, w, h), sniffed, thumbnailJPEGQuality)
+		if err != nil {
+			return err
+		}
+		msg.Thumbnails = append(msg.Thumbnails, Thumbnail{URL: uploadsURLPrefix + filename, Width: w, Height: h})
+	}
+	return nil
+}
+
+// thumbnailsJSON готовит миниатюры для столбца JSONB; отсутствие миниатюр хранится как []
+func thumbnailsJSON(thumbs []Thumbnail) []byte {
+	if len(thumbs) == 0 {
+		return []byte("[]")
+	}
+	data, _ := json.Marshal(thumbs)
+	return data
+}
+
+// saveEncodedImage кодирует изображение в формат загрузки и сохраняет его
+func saveEncodedImage(img image.Image, sniffed sniffedUpload, quality int) (string, error) {
+	var buf bytes.Buffer
+	var err error
+	if sniffed.MIME == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return "", err
+	}
+	return saveUpload(&buf, sniffed.Ext)
+}
+
+// orientedRGBA приводит изображение к *image.RGBA с началом координат в нуле,
+// поворачивая и отражая его по значению тега EXIF Orientation (1–8).
+// Строки исходного изображения переводятся в RGBA по одной и сразу
+// переставляются, поэтому в памяти появляется только одна полноразмерная копия.
+func orientedRGBA(src image.Image, orientation int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation < 2 || orientation > 8 {
+		if rgba, ok := src.(*image.RGBA); ok && b.Min == (image.Point{}) {
+			return rgba
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(dst, dst.Rect, src, b.Min, draw.Src)
+		return dst
+	}
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w // повороты на 90° меняют стороны местами
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	row := image.NewRGBA(image.Rect(0, 0, w, 1))
+	for sy := 0; sy < h; sy++ {
+		draw.Draw(row, row.Rect, src, image.Pt(b.Min.X, b.Min.Y+sy), draw.Src)
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // отражение по горизонтали
+				dx, dy = w-1-sx, sy
+			case 3: // поворот на 180°
+				dx, dy = w-1-sx, h-1-sy
+			case 4: // отражение по вертикали
+				dx, dy = sx, h-1-sy
+			case 5: // транспонирование
+				dx, dy = sy, sx
+			case 6: // поворот на 90° по часовой стрелке
+				dx, dy = h-1-sy, sx
+			case 7: // поперечное транспонирование
+				dx, dy = h-1-sy, w-1-sx
+			case 8: // поворот на 90° против часовой стрелки
+				dx, dy = sy, w-1-sx
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], row.Pix[sx*4:sx*4+4])
+		}
+	}
+	return dst
+}
+
+// fitSize вписывает размеры в квадрат size×size с сохранением пропорций
+func fitSize(w, h, size int) (int, int) {
+	if w >= h {
+		return size, max(1, h*size/w)
+	}
+	return max(1, w*size/h), size
+}
+
+// downscale уменьшает изображение усреднением пикселей исходной области
+func downscale(src *image.RGBA, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := max((y+1)*sh/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := max((x+1)*sw/w, x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4 : y*dst.Stride+x*4+4]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// jpegOrientation читает тег Orientation из блока EXIF (APP1) файла JPEG.
+// При отсутствии или ошибке разбора возвращает 1 — без преобразования.
+func jpegOrientation(file io.ReadSeeker) int {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 1
+	}
+	r := bufio.NewReader(file)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return 1
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil || b != 0xff {
+			return 1
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff { // заполняющие байты
+			marker, err = r.ReadByte()
+		}
+		if err != nil || marker == 0xd9 || marker == 0xda {
+			return 1 // EXIF находится до начала данных изображения
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue // маркеры без длины
+		}
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(lenBuf[:])) - 2
+		if length < 0 {
+			return 1
+		}
+		if marker != 0xe1 {
+			if _, err := r.Discard(length); err != nil {
+				return 1
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return exifOrientation(tiff)
+		}
+	}
+}
+
+// exifOrientation ищет тег Orientation (0x0112) в первом каталоге TIFF
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrientedRGBA(t *testing.T) {
+	// Исходник 3×2 с началом координат не в нуле:
+	//	1 2 3
+	//	4 5 6
+	src := image.NewNRGBA(image.Rect(10, 20, 13, 22))
+	for i := 0; i < 6; i++ {
+		src.Set(10+i%3, 20+i/3, color.NRGBA{R: uint8(i + 1), A: 255})
+	}
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{0, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		img := orientedRGBA(src, tt.orientation)
+		if img.Rect.Min != (image.Point{}) || img.Rect.Dx() != len(tt.want[0]) || img.Rect.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: bounds = %v, want %dx%d at origin", tt.orientation, img.Rect, len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, want := range row {
+				if got := img.RGBAAt(x, y); got.R != want || got.A != 255 {
+					t.Errorf("orientation %d: pixel (%d,%d) = %v, want R=%d", tt.orientation, x, y, got, want)
+				}
+			}
+		}
+	}
+}
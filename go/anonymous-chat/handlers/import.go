@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"anonymous-chat/storage"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Режимы обработки конфликта, когда комната с таким именем уже существует
+const (
+	ConflictFail   = "fail"   // отказаться от импорта
+	ConflictMerge  = "merge"  // добавить сообщения в существующую комнату
+	ConflictRename = "rename" // создать комнату с другим именем
+)
+
+// Максимальный размер импортируемого архива
+const maxImportSize = 512 << 20
+
+// Максимальный размер transcript.json после распаковки; защищает от ZIP-бомб
+const maxTranscriptSize = 64 << 20
+
+// Ошибка импорта, вызванная конфликтом имён комнат
+var ErrImportConflict = errors.New("комната уже существует")
+
+// Ошибка слияния с комнатой, шифрование которой не совпадает с архивом
+var ErrImportEncryption = errors.New("шифрование комнаты не совпадает с архивом")
+
+// ImportOptions задаёт параметры импорта
+type ImportOptions struct {
+	Room     string // имя комнаты; по умолчанию берётся из архива
+	Conflict string // fail, merge или rename
+	DryRun   bool   // только проверить архив, ничего не записывая
+}
+
+// ImportResult описывает итог импорта
+type ImportResult struct {
+	Room             string   `json:"room"`
+	Created          bool     `json:"created"`
+	DryRun           bool     `json:"dry_run"`
+	MessagesImported int      `json:"messages_imported"`
+	MessagesSkipped  int      `json:"messages_skipped"`
+	MediaImported    int      `json:"media_imported"`
+	MediaMissing     []string `json:"media_missing"`
+}
+
+// importArchive содержит разобранный архив экспорта
+type importArchive struct {
+	Transcript Transcript
+	Media      map[string]*zip.File // файлы из каталога media/ по имени
+}
+
+// readTranscript читает transcript.json не больше maxTranscriptSize байт
+func readTranscript(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxTranscriptSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTranscriptSize {
+		return nil, fmt.Errorf("transcript.json больше %d байт", maxTranscriptSize)
+	}
+	return data, nil
+}
+
+// parseImportArchive разбирает JSON-экспорт или ZIP-архив с transcript.json.
+// Архив читается по месту: в память попадает только сама история.
+func parseImportArchive(r io.ReaderAt, size int64) (importArchive, error) {
+	archive := importArchive{Media: make(map[string]*zip.File)}
+
+	magic := make([]byte, 4)
+	if n, _ := r.ReadAt(magic, 0); n < len(magic) || !bytes.Equal(magic, []byte("PK\x03\x04")) {
+		data, err := readTranscript(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return archive, err
+		}
+		return archive, decodeTranscript(data, &archive.Transcript)
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return archive, fmt.Errorf("некорректный ZIP-архив: %w", err)
+	}
+	var transcriptData []byte
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "transcript.json":
+			rc, err := f.Open()
+			if err != nil {
+				return archive, err
+			}
+			transcriptData, err = readTranscript(rc)
+			rc.Close()
+			if err != nil {
+				return archive, err
+			}
+		case path.Dir(f.Name) == exportMediaDir && !f.FileInfo().IsDir():
+			archive.Media[path.Base(f.Name)] = f
+		}
+	}
+	if transcriptData == nil {
+		return archive, errors.New("в архиве нет transcript.json; импортируется только JSON-экспорт")
+	}
+	return archive, decodeTranscript(transcriptData, &archive.Transcript)
+}
+
+// decodeTranscript разбирает и проверяет историю из архива экспорта
+func decodeTranscript(data []byte, t *Transcript) error {
+	if err := json.Unmarshal(data, t); err != nil {
+		return fmt.Errorf("некорректный JSON экспорта: %w", err)
+	}
+	if t.FormatVersion != exportFormatVersion {
+		return fmt.Errorf("неподдерживаемая версия формата: %d", t.FormatVersion)
+	}
+	if msg := validateRoomInput(roomInput{Name: &t.Room.Name}); msg != "" {
+		return errors.New(msg)
+	}
+	for i, msg := range t.Messages {
+		if _, err := time.Parse(time.RFC3339, msg.CreatedAt); err != nil {
+			return fmt.Errorf("сообщение %d: некорректное время %q", i+1, msg.CreatedAt)
+		}
+	}
+	return nil
+}
+
+// importableMessage сообщает, является ли сообщение сообщением чата, а не служебным событием
+func importableMessage(msg Message) bool {
+	switch msg.Type {
+	case TypeRead, TypeSeen, TypeDMRequest, TypeDMInvite, TypeDMAccept, TypeDMDecline, TypeDMReady, TypeDMError, TypeReaction:
+		return false
+	}
+	return msg.Type != ""
+}
+
+// messageKey возвращает ключ для поиска дубликатов при слиянии.
+// URL вложения не учитывается, так как при импорте файлы получают новые имена.
+func messageKey(msg Message, createdAt time.Time) string {
+	return strings.Join([]string{createdAt.UTC().Format(time.RFC3339Nano), msg.Nickname, msg.Type, msg.Content}, "\x00")
+}
+
+// importMedia — файл вложения из архива, распакованный и проверенный до записи в хранилище
+type importMedia struct {
+	file *os.File
+	ext  string
+	size int64
+}
+
+// close удаляет временный файл вложения
+func (m importMedia) close() {
+	m.file.Close()
+	os.Remove(m.file.Name())
+}
+
+// importMediaKind возвращает вид загрузки, по правилам которого проверяется
+// вложение сообщения; пустая строка — зашифрованное вложение без проверки типа
+func importMediaKind(msg Message) string {
+	switch {
+	case msg.Encrypted != nil:
+		return ""
+	case msg.Type == "video":
+		return "file"
+	}
+	return msg.Type
+}
+
+// extractImportMedia распаковывает файл архива во временный файл и проверяет
+// его содержимое так же, как при обычной загрузке: тип определяется по
+// содержимому и должен быть разрешён для вида загрузки, а расширение для
+// хранения берётся из определённого типа, а не из имени в архиве.
+// Зашифрованные вложения непрозрачны и сохраняются как .bin.
+func extractImportMedia(f *zip.File, kind string) (importMedia, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return importMedia{}, err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp("", "chat-import-*")
+	if err != nil {
+		return importMedia{}, err
+	}
+	m := importMedia{file: tmp, ext: ".bin"}
+
+	// Размер в заголовке ZIP не проверяется: распакованный объём ограничивается при чтении
+	limit := max(models.Config.MaxUploadBytes, models.Config.MaxResumableBytes)
+	size, err := io.Copy(tmp, io.LimitReader(rc, limit+1))
+	if err == nil && size > limit {
+		err = fmt.Errorf("%w: больше %d байт", errUploadTooLarge, limit)
+	}
+	m.size = size
+	if err == nil && kind != "" {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err == nil && kind != "" {
+		allowed, ok := uploadAllowedTypes(kind)
+		var sniffed sniffedUpload
+		if !ok {
+			err = errUnsupportedType
+		} else if sniffed, err = sniffUpload(tmp, "", allowed); err == nil {
+			m.ext = sniffed.Ext
+			if limit := attachmentLimit(sniffed.MIME); kind == "file" && limit > 0 && size > limit {
+				err = fmt.Errorf("%w: %s больше %d байт", errUploadTooLarge, sniffed.MIME, limit)
+			}
+		}
+	}
+	if err != nil {
+		m.close()
+		return importMedia{}, err
+	}
+	return m, nil
+}
+
+// importVoiceInfo проверяет длительность и осциллограмму голосового сообщения
+// из архива; значения вне допустимых не сохраняются
+func importVoiceInfo(duration float64, waveform []int) (float64, []int) {
+	duration = max(duration, 0)
+	if len(waveform) > waveformBars {
+		return duration, nil
+	}
+	for _, level := range waveform {
+		if level < 0 || level > 100 {
+			return duration, nil
+		}
+	}
+	return duration, waveform
+}
+
+// uploadExists проверяет, что файл загрузок есть в хранилище этого сервера
+func uploadExists(ctx context.Context, name string) (bool, error) {
+	rc, _, err := blobs.Open(ctx, name)
+	if errors.Is(err, storage.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rc.Close()
+	return true, nil
+}
+
+// resolveImportRoom определяет имя комнаты с учётом режима конфликта.
+// Возвращает имя и признак того, что комнату нужно создать. Слить историю можно
+// только с комнатой с тем же шифрованием, что и в архиве: иначе открытые
+// сообщения попали бы в зашифрованную комнату или наоборот.
+func resolveImportRoom(ctx context.Context, name, conflict string, encrypted bool) (string, bool, error) {
+	var roomEncrypted bool
+	exists := func(n string) (bool, error) {
+		err := models.DB.QueryRow(ctx, "SELECT encrypted FROM rooms WHERE name = $1", n).Scan(&roomEncrypted)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	found, err := exists(name)
+	if err != nil || !found {
+		return name, true, err
+	}
+
+	switch conflict {
+	case ConflictMerge:
+		if roomEncrypted != encrypted {
+			return "", false, ErrImportEncryption
+		}
+		return name, false, nil
+	case ConflictRename:
+		for i := 1; i < 1000; i++ {
+			candidate := fmt.Sprintf("%s-imported-%d", name, i)
+			found, err := exists(candidate)
+			if err != nil {
+				return "", false, err
+			}
+			if !found {
+				return candidate, true, nil
+			}
+		}
+		return "", false, errors.New("не удалось подобрать свободное имя комнаты")
+	}
+	return "", false, ErrImportConflict
+}
+
+// ImportRoom восстанавливает комнату из архива экспорта: метаданные, сообщения
+// с исходными временем и никами, а также вложенные файлы, которые перекладываются
+// в директорию загрузок под новыми именами.
+func ImportRoom(ctx context.Context, r io.ReaderAt, size int64, opts ImportOptions) (result ImportResult, err error) {
+	result = ImportResult{DryRun: opts.DryRun, MediaMissing: []string{}}
+
+	archive, err := parseImportArchive(r, size)
+	if err != nil {
+		return result, err
+	}
+	t := archive.Transcript
+
+	name := t.Room.Name
+	if opts.Room != "" {
+		name = opts.Room
+		if msg := validateRoomInput(roomInput{Name: &name}); msg != "" {
+			return result, errors.New(msg)
+		}
+	}
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictFail
+	}
+	name, create, err := resolveImportRoom(ctx, name, opts.Conflict, t.Room.Encrypted)
+	if err != nil {
+		return result, err
+	}
+	result.Room = name
+	result.Created = create
+
+	// При слиянии уже существующие сообщения не дублируются
+	existing := make(map[string]bool)
+	if !create {
+		var history []Message
+		history, err = loadHistory(ctx, name, 0)
+		if err != nil {
+			return result, err
+		}
+		for _, msg := range history {
+			existing[messageKey(msg, msg.createdAt)] = true
+		}
+	}
+
+	// Сопоставление вложений: файлы из архива проверяются и получат новые URL,
+	// ссылки на загрузки этого сервера остаются как есть, если файл существует,
+	// а всё, что не удалось найти, попадает в отчёт как отсутствующее
+	media := make(map[string]importMedia)
+	defer func() {
+		for _, m := range media {
+			m.close()
+		}
+	}()
+	checked := make(map[string]bool)
+	addMedia := func(mediaURL, kind string) error {
+		if mediaURL == "" || strings.HasPrefix(mediaURL, "http") || checked[mediaURL] {
+			return nil
+		}
+		checked[mediaURL] = true
+		if f, ok := archive.Media[path.Base(mediaURL)]; ok {
+			m, err := extractImportMedia(f, kind)
+			if err != nil {
+				return fmt.Errorf("файл %s: %w", mediaURL, err)
+			}
+			media[mediaURL] = m
+			return nil
+		}
+		found := false
+		if name := uploadFileName(mediaURL); name != "" {
+			var err error
+			if found, err = uploadExists(ctx, name); err != nil {
+				return err
+			}
+		}
+		if !found {
+			result.MediaMissing = append(result.MediaMissing, mediaURL)
+		}
+		return nil
+	}
+	var messages []Message
+	for _, msg := range t.Messages {
+		// Время уже проверено при разборе архива; в базе оно хранится без зоны,
+		// в UTC, так же как его читает экспорт
+		createdAt, _ := time.Parse(time.RFC3339, msg.CreatedAt)
+		msg.createdAt = createdAt.UTC()
+		if !importableMessage(msg) || existing[messageKey(msg, msg.createdAt)] {
+			result.MessagesSkipped++
+			continue
+		}
+		if err = addMedia(msg.MediaURL, importMediaKind(msg)); err != nil {
+			return result, err
+		}
+		for _, thumb := range msg.Thumbnails {
+			if err = addMedia(thumb.URL, "image"); err != nil {
+				return result, err
+			}
+		}
+		messages = append(messages, msg)
+	}
+	result.MessagesImported = len(messages)
+	result.MediaImported = len(media)
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// Файлы записываются до транзакции. Если она не завершится, на них не сошлётся
+	// ни одно сообщение и их удалит сборщик мусора; удалять их здесь нельзя —
+	// такой же файл может уже использоваться другими сообщениями
+	rehosted := make(map[string]string)
+	for oldURL, m := range media {
+		if _, err = m.file.Seek(0, io.SeekStart); err != nil {
+			return result, err
+		}
+		var filename string
+		if filename, err = saveUpload(m.file, m.ext); err != nil {
+			return result, err
+		}
+		rehosted[oldURL] = uploadsURLPrefix + filename
+	}
+
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Личные комнаты привязаны к участникам исходного сервера и восстанавливаются как приватные
+	visibility := t.Room.Visibility
+	if visibility != VisibilityPublic {
+		visibility = VisibilityPrivate
+	}
+
+	var roomID int
+	if create {
+		err = tx.QueryRow(ctx, `
+			INSERT INTO rooms(name, title, topic, description, visibility, encrypted)
+			VALUES($1, $2, $3, $4, $5, $6) RETURNING id`,
+			name, t.Room.Title, t.Room.Topic, t.Room.Description, visibility, t.Room.Encrypted).Scan(&roomID)
+	} else {
+		err = tx.QueryRow(ctx, "SELECT id FROM rooms WHERE name = $1", name).Scan(&roomID)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	for _, msg := range messages {
+		// Имя вложения очищается как при загрузке, размер берётся из самого файла
+		if msg.Filename != "" {
+			msg.Filename = attachmentFilename(msg.Filename)
+		}
+		if m, ok := media[msg.MediaURL]; ok && msg.Size != 0 {
+			msg.Size = m.size
+		}
+		msg.Duration, msg.Waveform = importVoiceInfo(msg.Duration, msg.Waveform)
+		if newURL, ok := rehosted[msg.MediaURL]; ok {
+			msg.MediaURL = newURL
+		}
+		thumbs := append([]Thumbnail(nil), msg.Thumbnails...)
+		for i := range thumbs {
+			if newURL, ok := rehosted[thumbs[i].URL]; ok {
+				thumbs[i].URL = newURL
+			}
+		}
+		var envelope Encrypted
+		if msg.Encrypted != nil {
+			envelope = *msg.Encrypted
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO messages(room_id, nickname, type, content, media_url, created_at, ciphertext, nonce, key_id,
+				media_width, media_height, thumbnails, media_filename, media_size, media_duration, waveform, bot)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+			roomID, msg.Nickname, msg.Type, msg.Content, msg.MediaURL, msg.createdAt,
+			envelope.Ciphertext, envelope.Nonce, envelope.KeyID,
+			msg.Width, msg.Height, thumbnailsJSON(thumbs), msg.Filename, msg.Size,
+			msg.Duration, waveformJSON(msg.Waveform), msg.Bot)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return result, err
+	}
+	slog.Info("Комната импортирована", logging.Room(name), "messages", result.MessagesImported, "media", result.MediaImported)
+	return result, nil
+}
+
+// ImportRoomHandler импортирует комнату из тела запроса (JSON или ZIP).
+// Параметры: room — новое имя, conflict — fail, merge или rename, dry_run=1 — только проверка.
+func ImportRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	opts := ImportOptions{
+		Room:     q.Get("room"),
+		Conflict: q.Get("conflict"),
+		DryRun:   q.Get("dry_run") == "1",
+	}
+	switch opts.Conflict {
+	case "", ConflictFail, ConflictMerge, ConflictRename:
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_conflict", "conflict должен быть fail, merge или rename")
+		return
+	}
+
+	// Архив сохраняется во временный файл: ZIP читается с произвольных позиций,
+	// а держать до maxImportSize байт в памяти на каждый запрос нельзя
+	tmp, err := os.CreateTemp("", "chat-import-*")
+	if err != nil {
+		slog.Error("Ошибка при создании временного файла", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при импорте комнаты")
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, maxImportSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", "Архив слишком большой")
+		return
+	}
+	if err != nil {
+		slog.Warn("Ошибка при чтении архива импорта", "err", err)
+		writeAPIError(w, http.StatusBadRequest, "invalid_body", "Не удалось прочитать архив")
+		return
+	}
+
+	result, err := ImportRoom(r.Context(), tmp, size, opts)
+	if errors.Is(err, ErrImportConflict) {
+		writeAPIError(w, http.StatusConflict, "already_exists", "Комната уже существует")
+		return
+	}
+	if errors.Is(err, ErrImportEncryption) {
+		writeAPIError(w, http.StatusConflict, "encryption_mismatch", "Шифрование комнаты не совпадает с архивом")
+		return
+	}
+	if err != nil {
+		slog.Warn("Ошибка при импорте комнаты", "err", err)
+		writeAPIError(w, http.StatusUnprocessableEntity, "import_failed", err.Error())
+		return
+	}
+
+	status := http.StatusCreated
+	if opts.DryRun || !result.Created {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, result)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"anonymous-chat/models"
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Порядок сортировки комнат в лобби
+const (
+	SortActivity = "activity" // сначала комнаты с недавними сообщениями
+	SortMembers  = "members"  // сначала комнаты с наибольшим числом участников онлайн
+	SortName     = "name"     // по алфавиту
+)
+
+// Размер страницы лобби по умолчанию и максимальный
+const (
+	defaultLobbyPageSize = 20
+	maxLobbyPageSize     = 100
+)
+
+// lobbyQuery описывает параметры отбора комнат в лобби
+type lobbyQuery struct {
+	Search  string
+	Sort    string
+	Page    int
+	PerPage int
+}
+
+// lobbyPage содержит одну страницу комнат и данные для навигации
+type lobbyPage struct {
+	lobbyQuery
+	Rooms      []Room
+	Total      int
+	TotalPages int
+}
+
+// parseLobbyQuery читает параметры лобби из строки запроса, подставляя значения по умолчанию
+func parseLobbyQuery(values url.Values) lobbyQuery {
+	q := lobbyQuery{
+		Search:  strings.TrimSpace(values.Get("q")),
+		Sort:    values.Get("sort"),
+		Page:    1,
+		PerPage: defaultLobbyPageSize,
+	}
+	switch q.Sort {
+	case SortActivity, SortMembers, SortName:
+	default:
+		q.Sort = SortActivity
+	}
+	if page, err := strconv.Atoi(values.Get("page")); err == nil && page > 0 {
+		q.Page = page
+	}
+	if perPage, err := strconv.Atoi(values.Get("per_page")); err == nil && perPage > 0 {
+		q.PerPage = min(perPage, maxLobbyPageSize)
+	}
+	return q
+}
+
+// escapeLike экранирует спецсимволы шаблона LIKE
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// lobbyOrder задаёт порядок комнат в SQL для сортировок, которым не нужен хаб.
+// Время последней активности берётся по индексу messages_room_created.
+var lobbyOrder = map[string]string{
+	SortActivity: "activity DESC, name",
+	SortName:     "name",
+}
+
+// loadLobby возвращает страницу публичных комнат. Сортировка и разбиение на
+// страницы выполняются в базе, а статистика сообщений считается только для
+// комнат страницы. Число участников онлайн известно только хабу, поэтому для
+// сортировки по нему в Go упорядочиваются имена комнат, без статистики.
+func loadLobby(ctx context.Context, q lobbyQuery) (lobbyPage, error) {
+	page := lobbyPage{lobbyQuery: q}
+	pattern := "%" + escapeLike(q.Search) + "%"
+
+	err := models.DB.QueryRow(ctx,
+		"SELECT COUNT(*) FROM rooms WHERE visibility = $1 AND name ILIKE $2",
+		VisibilityPublic, pattern).Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+	page.TotalPages = (page.Total + q.PerPage - 1) / q.PerPage
+	offset := (q.Page - 1) * q.PerPage
+	if offset >= page.Total {
+		return page, nil
+	}
+
+	var names []string
+	if q.Sort == SortMembers {
+		names, err = lobbyNamesByMembers(ctx, pattern, offset, q.PerPage)
+	} else {
+		names, err = queryNames(ctx, `
+			SELECT name FROM (
+				SELECT r.name, COALESCE(
+					(SELECT MAX(m.created_at) FROM messages m WHERE m.room_id = r.id), r.created_at) AS activity
+				FROM rooms r
+				WHERE r.visibility = $1 AND r.name ILIKE $2
+			) lobby
+			ORDER BY `+lobbyOrder[q.Sort]+`
+			LIMIT $3 OFFSET $4`,
+			VisibilityPublic, pattern, q.PerPage, offset)
+	}
+	if err != nil {
+		return page, err
+	}
+
+	page.Rooms, err = loadRoomsByName(ctx, names)
+	return page, err
+}
+
+// lobbyNamesByMembers возвращает страницу имён комнат по убыванию числа участников онлайн
+func lobbyNamesByMembers(ctx context.Context, pattern string, offset, limit int) ([]string, error) {
+	names, err := queryNames(ctx,
+		"SELECT name FROM rooms WHERE visibility = $1 AND name ILIKE $2 ORDER BY name",
+		VisibilityPublic, pattern)
+	if err != nil {
+		return nil, err
+	}
+	online := make(map[string]int, len(names))
+	for _, name := range names {
+		online[name] = onlineCount(name)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return online[names[i]] > online[names[j]]
+	})
+	start := min(offset, len(names))
+	return names[start:min(start+limit, len(names))], nil
+}
+
+// queryNames выполняет запрос, возвращающий один столбец с именами комнат
+func queryNames(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := models.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// loadRoomsByName загружает комнаты со статистикой в порядке списка имён
+func loadRoomsByName(ctx context.Context, names []string) ([]Room, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	rows, err := models.DB.Query(ctx, roomSelect+" WHERE r.name = ANY($1) GROUP BY r.id", names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byName := make(map[string]Room, len(names))
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		byName[room.Name] = room
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rooms := make([]Room, 0, len(names))
+	for _, name := range names {
+		if room, ok := byName[name]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
+// HasPrev сообщает, есть ли предыдущая страница
+func (p lobbyPage) HasPrev() bool {
+	return p.Page > 1
+}
+
+// HasNext сообщает, есть ли следующая страница
+func (p lobbyPage) HasNext() bool {
+	return p.Page < p.TotalPages
+}
+
+// PrevURL возвращает ссылку на предыдущую страницу лобби
+func (p lobbyPage) PrevURL() string {
+	return p.URL(p.Sort, p.Page-1)
+}
+
+// NextURL возвращает ссылку на следующую страницу лобби
+func (p lobbyPage) NextURL() string {
+	return p.URL(p.Sort, p.Page+1)
+}
+
+// SortURL возвращает ссылку на первую страницу лобби с другой сортировкой
+func (p lobbyPage) SortURL(sort string) string {
+	return p.URL(sort, 1)
+}
+
+// URL формирует ссылку на лобби с заданными сортировкой и страницей
+func (p lobbyPage) URL(sort string, page int) string {
+	values := url.Values{}
+	if p.Search != "" {
+		values.Set("q", p.Search)
+	}
+	values.Set("sort", sort)
+	values.Set("page", strconv.Itoa(page))
+	if p.PerPage != defaultLobbyPageSize {
+		values.Set("per_page", strconv.Itoa(p.PerPage))
+	}
+	return "/?" + values.Encode()
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"anonymous-chat/codec"
+	"anonymous-chat/logging"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Протокол обмена с клиентом.
+//
+// Клиент выбирает версию параметром v в URL подключения (/ws/{room}?v=1,
+// /sse/{room}?v=1). Без параметра используется устаревший протокол версии 0,
+// в котором клиент и сервер обмениваются голыми объектами Message.
+//
+// Начиная с версии 1 каждое сообщение — конверт {"v", "op", "id", "payload"}.
+// Поле id задаёт клиент; сервер повторяет его в ответе ack или error.
+//
+// Операции клиента:
+//
+//	message.send  {"type": "text", "content"} или {"type": "encrypted", "encrypted"}
+//	read          {"last_read_id"}       — отметка о прочтении
+//	dm.request    {"target"}             — приглашение в личную переписку
+//	dm.accept     {"invite"}             — принять приглашение
+//	dm.decline    {"invite"}             — отклонить приглашение
+//	ping          без payload            — ответ pong с тем же id
+//
+// Операции сервера:
+//
+//	hello         {"version", "versions"} — первое сообщение после подключения
+//	message       Message                 — сообщение чата
+//	receipt       Message с type "seen"   — позиция прочтения участника
+//	reaction      Message с reply_to      — реакция на сообщение
+//	dm.invite, dm.ready, dm.error         — события личной переписки, payload Message
+//	ack           без payload             — операция с данным id принята
+//	error         {"code", "message"}     — операция с данным id отклонена
+//	pong          без payload
+const (
+	OpMessageSend = "message.send"
+	OpRead        = "read"
+	OpDMRequest   = "dm.request"
+	OpDMAccept    = "dm.accept"
+	OpDMDecline   = "dm.decline"
+	OpPing        = "ping"
+
+	OpHello    = "hello"
+	OpMessage  = "message"
+	OpReceipt  = "receipt"
+	OpReaction = "reaction"
+	OpDMInvite = "dm.invite"
+	OpDMReady  = "dm.ready"
+	OpDMError  = "dm.error"
+	OpAck      = "ack"
+	OpError    = "error"
+	OpPong     = "pong"
+)
+
+// Версии протокола
+const (
+	legacyProtocol = 0 // голые объекты Message
+	latestProtocol = 1
+)
+
+// Все поддерживаемые версии по возрастанию; сообщаются клиенту в hello,
+// чтобы он мог перейти на более старую
+var supportedProtocols = []int{legacyProtocol, latestProtocol}
+
+// Коды ошибок в кадрах error
+const (
+	ErrBadRequest         = "bad_request"         // кадр не разобран
+	ErrUnsupportedVersion = "unsupported_version" // версия кадра не совпадает с согласованной
+	ErrUnknownOp          = "unknown_op"
+	ErrValidationFailed   = "validation_failed"
+	ErrForbidden          = "forbidden"
+	ErrRateLimited        = "rate_limited"
+)
+
+// Максимальная длина текстового сообщения
+const maxMessageLength = 4000
+
+// Ограничение частоты операций одного клиента
+const (
+	clientRateBurst     = 20
+	clientRatePerSecond = 5
+)
+
+// Frame — конверт протокола версии 1 и выше
+type Frame struct {
+	V       int         `json:"v"`
+	Op      string      `json:"op"`
+	ID      string      `json:"id,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+
+	shared *sharedEncoding // общий для получателей рассылки кеш закодированного кадра
+}
+
+// frameEncoding — формат, в котором кадр уходит клиенту
+type frameEncoding struct {
+	codec    string // имя подпротокола; пусто для JSON
+	protocol int
+}
+
+// sharedEncoding хранит кадр рассылки, закодированный для каждого формата
+// и версии протокола. Кадр кодирует первый из writePump получателей, а
+// остальные берут готовые байты, так что сообщение в комнату кодируется один
+// раз на формат, а не на каждого клиента.
+type sharedEncoding struct {
+	mutex sync.Mutex
+	data  map[frameEncoding][]byte
+}
+
+// encode возвращает закодированный кадр, кодируя его при первом обращении
+func (s *sharedEncoding) encode(c codec.Codec, protocol int, v interface{}) ([]byte, error) {
+	if s == nil {
+		return encodeMessage(c, v)
+	}
+	key := frameEncoding{protocol: protocol}
+	if c != nil {
+		key.codec = c.Name()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if data, ok := s.data[key]; ok {
+		return data, nil
+	}
+	data, err := encodeMessage(c, v)
+	if err != nil {
+		return nil, err
+	}
+	if s.data == nil {
+		s.data = make(map[frameEncoding][]byte)
+	}
+	s.data[key] = data
+	return data, nil
+}
+
+// inFrame — конверт, полученный от клиента; payload разбирается в зависимости от операции
+type inFrame struct {
+	V       int             `json:"v"`
+	Op      string          `json:"op"`
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+
+	value interface{} // payload бинарного кадра в обобщённом виде
+}
+
+// binaryFrame — конверт бинарного кадра; payload разбирается позже, как и в JSON
+type binaryFrame struct {
+	V       int         `json:"v"`
+	Op      string      `json:"op"`
+	ID      string      `json:"id"`
+	Payload interface{} `json:"payload"`
+}
+
+// ProtocolError описывает отказ в выполнении операции клиента
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string { return e.Code + ": " + e.Message }
+
+func protocolError(code, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// hello — содержимое первого кадра после подключения
+type hello struct {
+	Version  int   `json:"version"`
+	Versions []int `json:"versions"`
+}
+
+// negotiateProtocol выбирает версию протокола по параметру v запроса.
+// Если клиент просит версию новее поддерживаемой, используется последняя.
+func negotiateProtocol(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("v")
+	if raw == "" {
+		return legacyProtocol, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < legacyProtocol {
+		return 0, protocolError(ErrUnsupportedVersion, "некорректная версия протокола %q", raw)
+	}
+	return min(v, latestProtocol), nil
+}
+
+// Операции сервера для служебных типов сообщений; остальные передаются как message
+var messageOps = map[string]string{
+	TypeSeen:     OpReceipt,
+	TypeReaction: OpReaction,
+	TypeDMInvite: OpDMInvite,
+	TypeDMReady:  OpDMReady,
+	TypeDMError:  OpDMError,
+}
+
+// messageFrame упаковывает сообщение для отправки клиенту
+func messageFrame(msg Message) Frame {
+	op, ok := messageOps[msg.Type]
+	if !ok {
+		op = OpMessage
+	}
+	return Frame{Op: op, Payload: msg}
+}
+
+// Типы сообщений, которые клиент может отправить операцией message.send
+var clientMessageTypes = map[string]bool{
+	"text":        true,
+	TypeEncrypted: true,
+}
+
+// Операции клиента, которые сводятся к служебным сообщениям
+var opMessageTypes = map[string]string{
+	OpRead:      TypeRead,
+	OpDMRequest: TypeDMRequest,
+	OpDMAccept:  TypeDMAccept,
+	OpDMDecline: TypeDMDecline,
+}
+
+// rateLimiter ограничивает частоту операций алгоритмом «ведро с токенами».
+// Для SSE операции приходят из разных запросов, поэтому нужен мьютекс.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = clientRateBurst
+	} else {
+		l.tokens = min(clientRateBurst, l.tokens+now.Sub(l.last).Seconds()*clientRatePerSecond)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// writeFrame записывает кадр в соединение в формате согласованной версии протокола
+func (c *Client) writeFrame(f Frame) error {
+	var v interface{}
+	if c.Protocol == legacyProtocol {
+		// Старые клиенты получают только сообщения, без служебных кадров
+		msg, ok := f.Payload.(Message)
+		if !ok {
+			return nil
+		}
+		v = msg
+	} else {
+		f.V = c.Protocol
+		v = f
+	}
+	data, err := f.shared.encode(c.Conn.Codec(), c.Protocol, v)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Write(data)
+}
+
+// sendFrame ставит кадр в очередь отправки клиента; при заполненной очереди кадр пропускается
+func (c *Client) sendFrame(f Frame) {
+	if !c.trySend(f) {
+		slog.Warn("Канал отправки заполнен", logging.Nick(c.Nick), logging.Room(c.Room))
+	}
+}
+
+// handleData разбирает кадр JSON, полученный от клиента, и выполняет операцию
+func (c *Client) handleData(data []byte) error {
+	if c.Protocol == legacyProtocol {
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return protocolError(ErrBadRequest, "некорректный JSON")
+		}
+		return c.handleLegacy(msg)
+	}
+
+	var in inFrame
+	if err := json.Unmarshal(data, &in); err != nil {
+		return c.handleFrame(in, protocolError(ErrBadRequest, "некорректный конверт"))
+	}
+	return c.handleFrame(in, nil)
+}
+
+// handleBinary разбирает бинарный кадр сразу в конверт или сообщение,
+// без промежуточного JSON, и выполняет операцию
+func (c *Client) handleBinary(cd codec.Codec, data []byte) error {
+	if c.Protocol == legacyProtocol {
+		var msg Message
+		v, err := cd.Unmarshal(data)
+		if err == nil {
+			err = codec.Assign(&msg, v, false)
+		}
+		if err != nil {
+			return protocolError(ErrBadRequest, "некорректный кадр %s: %v", cd.Name(), err)
+		}
+		return c.handleLegacy(msg)
+	}
+
+	in, err := decodeBinaryFrame(cd, data)
+	return c.handleFrame(in, err)
+}
+
+// decodeBinaryFrame разбирает конверт бинарного кадра; payload сохраняется
+// в обобщённом виде и разбирается decodePayload
+func decodeBinaryFrame(cd codec.Codec, data []byte) (inFrame, error) {
+	var frame binaryFrame
+	v, err := cd.Unmarshal(data)
+	if err == nil {
+		err = codec.Assign(&frame, v, false)
+	}
+	if err != nil {
+		return inFrame{}, protocolError(ErrBadRequest, "некорректный кадр %s: %v", cd.Name(), err)
+	}
+	return inFrame{V: frame.V, Op: frame.Op, ID: frame.ID, value: frame.Payload}, nil
+}
+
+// handleLegacy выполняет сообщение устаревшего протокола
+func (c *Client) handleLegacy(msg Message) error {
+	// Старые клиенты могли не указывать тип текстового сообщения
+	if msg.Type == "" {
+		msg.Type = "text"
+	}
+	return c.handleIncoming(msg)
+}
+
+// handleFrame выполняет операцию из конверта; err — ошибка разбора конверта.
+// Результат сообщается клиенту кадром ack или error.
+func (c *Client) handleFrame(in inFrame, err error) error {
+	switch {
+	case err != nil:
+	case in.V != c.Protocol:
+		err = protocolError(ErrUnsupportedVersion, "согласована версия %d, получена %d", c.Protocol, in.V)
+	default:
+		err = c.handleOp(in)
+	}
+
+	if err != nil {
+		perr, ok := err.(*ProtocolError)
+		if !ok {
+			perr = protocolError(ErrBadRequest, "%s", err.Error())
+		}
+		c.sendFrame(Frame{Op: OpError, ID: in.ID, Payload: perr})
+		return err
+	}
+	if in.Op != OpPing && in.ID != "" {
+		c.sendFrame(Frame{Op: OpAck, ID: in.ID})
+	}
+	return nil
+}
+
+// handleOp выполняет операцию из конверта
+func (c *Client) handleOp(in inFrame) error {
+	if in.Op == OpPing {
+		c.sendFrame(Frame{Op: OpPong, ID: in.ID})
+		return nil
+	}
+
+	msg, err := decodePayload(in)
+	if err != nil {
+		return err
+	}
+
+	switch in.Op {
+	case OpMessageSend:
+		if msg.Type == "" {
+			return protocolError(ErrValidationFailed, "не указан type сообщения")
+		}
+	case OpRead:
+		if msg.LastReadID <= 0 {
+			return protocolError(ErrValidationFailed, "last_read_id должен быть положительным")
+		}
+		msg.Type = opMessageTypes[in.Op]
+	case OpDMRequest:
+		if msg.Target == "" {
+			return protocolError(ErrValidationFailed, "не указан target")
+		}
+		msg.Type = opMessageTypes[in.Op]
+	case OpDMAccept, OpDMDecline:
+		if msg.Invite == "" {
+			return protocolError(ErrValidationFailed, "не указан invite")
+		}
+		msg.Type = opMessageTypes[in.Op]
+	default:
+		return protocolError(ErrUnknownOp, "неизвестная операция %q", in.Op)
+	}
+	return c.handleIncoming(msg)
+}
+
+// decodePayload разбирает payload операции клиента; неизвестные поля отклоняются
+func decodePayload(in inFrame) (Message, error) {
+	var msg Message
+	var err error
+	switch {
+	case in.value != nil:
+		err = codec.Assign(&msg, in.value, true)
+	case len(in.Payload) > 0:
+		dec := json.NewDecoder(bytes.NewReader(in.Payload))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&msg)
+	}
+	if err != nil {
+		return msg, protocolError(ErrValidationFailed, "некорректный payload: %v", err)
+	}
+	return msg, nil
+}
+
+// validateClientMessage проверяет сообщение чата, полученное от клиента
+func (c *Client) validateClientMessage(msg *Message) error {
+	if !clientMessageTypes[msg.Type] {
+		return protocolError(ErrValidationFailed, "недопустимый тип сообщения %q", msg.Type)
+	}
+
+	// В зашифрованной комнате сервер проверяет только форму конверта,
+	// в обычной — конверт не принимается
+	if c.Encrypted {
+		if msg.Type != TypeEncrypted {
+			return protocolError(ErrForbidden, "в зашифрованной комнате допускаются только зашифрованные сообщения")
+		}
+		if err := validateEncryptedMessage(msg); err != nil {
+			return protocolError(ErrValidationFailed, "%s", err.Error())
+		}
+		return nil
+	}
+	if msg.Type == TypeEncrypted || msg.Encrypted != nil {
+		return protocolError(ErrForbidden, "комната не зашифрована")
+	}
+	if msg.Content == "" {
+		return protocolError(ErrValidationFailed, "пустое сообщение")
+	}
+	if utf8.RuneCountInString(msg.Content) > maxMessageLength {
+		return protocolError(ErrValidationFailed, "сообщение длиннее %d символов", maxMessageLength)
+	}
+	return nil
+}
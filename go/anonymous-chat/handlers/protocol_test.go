@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"anonymous-chat/codec"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// protocolCodecs — форматы кадров WebSocket; nil означает текстовый JSON
+var protocolCodecs = []codec.Codec{nil, codec.MsgPack, codec.CBOR}
+
+func codecName(c codec.Codec) string {
+	if c == nil {
+		return codec.SubprotocolJSON
+	}
+	return c.Name()
+}
+
+// encodeFrame кодирует значение так же, как writeFrame
+func encodeFrame(t *testing.T, c codec.Codec, v interface{}) []byte {
+	t.Helper()
+	data, err := encodeMessage(c, v)
+	if err != nil {
+		t.Fatalf("%s encode: %v", codecName(c), err)
+	}
+	return data
+}
+
+// frameJSON приводит кадр сервера к JSON, как его увидит клиент
+func frameJSON(c codec.Codec, data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	v, err := c.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// decodeClientFrame разбирает конверт кадра клиента так же, как handleData и handleBinary
+func decodeClientFrame(c codec.Codec, data []byte) (inFrame, error) {
+	if c != nil {
+		return decodeBinaryFrame(c, data)
+	}
+	var in inFrame
+	err := json.Unmarshal(data, &in)
+	return in, err
+}
+
+// sameJSON сравнивает документы JSON без учёта порядка ключей
+func sameJSON(t *testing.T, got, want []byte) bool {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("decoded frame is not JSON: %v", err)
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatalf("expected frame is not JSON: %v", err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+var testMessage = Message{
+	ID:        1 << 40,
+	Nickname:  "Алиса",
+	Type:      "image",
+	Content:   "подпись",
+	MediaURL:  "/uploads/abc.jpg",
+	CreatedAt: "2024-05-01T12:30:00Z",
+	ReplyTo:   7,
+	Bot:       true,
+	Width:     1920,
+	Height:    1080,
+	Thumbnails: []Thumbnail{
+		{URL: "/uploads/abc-320.jpg", Width: 320, Height: 180},
+		{URL: "/uploads/abc-640.jpg", Width: 640, Height: 360},
+	},
+	Filename: "фото.jpg",
+	Size:     123456,
+	Duration: 2.5,
+	Waveform: []int{0, 50, 100},
+}
+
+// Каждый кадр сервера должен доходить до клиента одинаково во всех форматах
+func TestServerFramesRoundTrip(t *testing.T) {
+	encrypted := Message{Nickname: "bob", Type: TypeEncrypted, Encrypted: &Encrypted{Ciphertext: "AAEC", Nonce: "AwQF", KeyID: "k1"}}
+	frames := []struct {
+		name  string
+		frame interface{}
+	}{
+		{"hello", Frame{V: latestProtocol, Op: OpHello, Payload: hello{Version: latestProtocol, Versions: supportedProtocols}}},
+		{"message", messageFrame(testMessage)},
+		{"encrypted message", messageFrame(encrypted)},
+		{"receipt", messageFrame(Message{Nickname: "bob", Type: TypeSeen, LastReadID: 42})},
+		{"reaction", messageFrame(Message{Nickname: "bob", Type: TypeReaction, Content: "👍", ReplyTo: 42})},
+		{"dm.invite", messageFrame(Message{Nickname: "bob", Type: TypeDMInvite, Target: "alice", Invite: "inv-1"})},
+		{"dm.ready", messageFrame(Message{Type: TypeDMReady, Room: "dm-abc", Invite: "inv-1"})},
+		{"dm.error", messageFrame(Message{Type: TypeDMError, Content: "участник не в сети", Invite: "inv-1"})},
+		{"ack", Frame{V: latestProtocol, Op: OpAck, ID: "op-1"}},
+		{"error", Frame{V: latestProtocol, Op: OpError, ID: "op-2", Payload: protocolError(ErrRateLimited, "слишком часто")}},
+		{"pong", Frame{V: latestProtocol, Op: OpPong, ID: "op-3"}},
+		{"legacy message", testMessage},
+	}
+	for _, c := range protocolCodecs {
+		for _, tt := range frames {
+			t.Run(codecName(c)+"/"+tt.name, func(t *testing.T) {
+				want, err := json.Marshal(tt.frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := frameJSON(c, encodeFrame(t, c, tt.frame))
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if !sameJSON(t, got, want) {
+					t.Errorf("frame = %s, want %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+// Кадры клиента разбираются в те же конверт и payload во всех форматах
+func TestClientFramesDecode(t *testing.T) {
+	frames := []struct {
+		name    string
+		frame   map[string]interface{}
+		want    Message
+		wantErr bool
+	}{
+		{
+			name:  "message.send",
+			frame: map[string]interface{}{"v": 1, "op": OpMessageSend, "id": "op-1", "payload": map[string]interface{}{"type": "text", "content": "привет"}},
+			want:  Message{Type: "text", Content: "привет"},
+		},
+		{
+			name: "message.send encrypted",
+			frame: map[string]interface{}{"v": 1, "op": OpMessageSend, "id": "op-2", "payload": map[string]interface{}{
+				"type": TypeEncrypted, "encrypted": map[string]interface{}{"ciphertext": "AAEC", "nonce": "AwQF", "key_id": "k1"},
+			}},
+			want: Message{Type: TypeEncrypted, Encrypted: &Encrypted{Ciphertext: "AAEC", Nonce: "AwQF", KeyID: "k1"}},
+		},
+		{
+			name:  "read",
+			frame: map[string]interface{}{"v": 1, "op": OpRead, "payload": map[string]interface{}{"last_read_id": int64(1) << 40}},
+			want:  Message{LastReadID: 1 << 40},
+		},
+		{
+			name:  "dm.request",
+			frame: map[string]interface{}{"v": 1, "op": OpDMRequest, "id": "op-3", "payload": map[string]interface{}{"target": "bob"}},
+			want:  Message{Target: "bob"},
+		},
+		{
+			name:  "dm.accept",
+			frame: map[string]interface{}{"v": 1, "op": OpDMAccept, "payload": map[string]interface{}{"invite": "inv-1"}},
+			want:  Message{Invite: "inv-1"},
+		},
+		{
+			name:  "dm.decline",
+			frame: map[string]interface{}{"v": 1, "op": OpDMDecline, "payload": map[string]interface{}{"invite": "inv-1"}},
+			want:  Message{Invite: "inv-1"},
+		},
+		{
+			name:  "ping",
+			frame: map[string]interface{}{"v": 1, "op": OpPing, "id": "op-4"},
+		},
+		{
+			name:    "unknown payload field",
+			frame:   map[string]interface{}{"v": 1, "op": OpMessageSend, "payload": map[string]interface{}{"type": "text", "admin": true}},
+			wantErr: true,
+		},
+	}
+	for _, c := range protocolCodecs {
+		for _, tt := range frames {
+			t.Run(codecName(c)+"/"+tt.name, func(t *testing.T) {
+				in, err := decodeClientFrame(c, encodeFrame(t, c, tt.frame))
+				if err != nil {
+					t.Fatalf("envelope: %v", err)
+				}
+				id, _ := tt.frame["id"].(string)
+				if in.V != 1 || in.Op != tt.frame["op"] || in.ID != id {
+					t.Errorf("envelope = {%d %q %q}, want {1 %q %q}", in.V, in.Op, in.ID, tt.frame["op"], id)
+				}
+				msg, err := decodePayload(in)
+				if tt.wantErr {
+					var perr *ProtocolError
+					if !errors.As(err, &perr) || perr.Code != ErrValidationFailed {
+						t.Errorf("decodePayload err = %v, want %s", err, ErrValidationFailed)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("decodePayload: %v", err)
+				}
+				if !reflect.DeepEqual(msg, tt.want) {
+					t.Errorf("payload = %+v, want %+v", msg, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// Обрезанный или слишком большой бинарный кадр отклоняется ошибкой протокола,
+// а не разбирается частично
+func TestBinaryFrameRejected(t *testing.T) {
+	frame := map[string]interface{}{"v": 1, "op": OpMessageSend, "id": "op-1", "payload": map[string]interface{}{"type": "text", "content": "привет"}}
+	for _, c := range []codec.Codec{codec.MsgPack, codec.CBOR} {
+		data := encodeFrame(t, c, frame)
+		for n := 0; n < len(data); n++ {
+			_, err := decodeBinaryFrame(c, data[:n])
+			var perr *ProtocolError
+			if !errors.As(err, &perr) || perr.Code != ErrBadRequest {
+				t.Errorf("%s: %d of %d bytes: err = %v, want %s", c.Name(), n, len(data), err, ErrBadRequest)
+			}
+		}
+
+		large := encodeFrame(t, c, map[string]interface{}{"v": 1, "op": OpMessageSend, "payload": map[string]interface{}{
+			"type": "text", "content": string(bytes.Repeat([]byte("a"), codec.MaxFrameSize)),
+		}})
+		_, err := decodeBinaryFrame(c, large)
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Code != ErrBadRequest {
+			t.Errorf("%s: %d bytes: err = %v, want %s", c.Name(), len(large), err, ErrBadRequest)
+		}
+	}
+}
+
+// recordingTransport запоминает записанные кадры
+type recordingTransport struct {
+	codec  codec.Codec
+	frames [][]byte
+}
+
+func (t *recordingTransport) Codec() codec.Codec { return t.codec }
+
+func (t *recordingTransport) Write(data []byte) error {
+	t.frames = append(t.frames, data)
+	return nil
+}
+
+func (t *recordingTransport) Close() error { return nil }
+
+func (t *recordingTransport) Kind() string { return "test" }
+
+// Кадр рассылки кодируется один раз на формат и версию протокола, и каждый
+// клиент получает те же байты, что и без общего кеша
+func TestSharedEncoding(t *testing.T) {
+	frame := messageFrame(testMessage)
+	frame.shared = &sharedEncoding{}
+
+	type recipient struct {
+		codec    codec.Codec
+		protocol int
+	}
+	var recipients []recipient
+	for _, c := range protocolCodecs {
+		for _, protocol := range supportedProtocols {
+			// По два клиента на формат: второй берёт кадр из кеша
+			recipients = append(recipients, recipient{c, protocol}, recipient{c, protocol})
+		}
+	}
+	for _, r := range recipients {
+		conn := &recordingTransport{codec: r.codec}
+		client := &Client{Conn: conn, Protocol: r.protocol}
+		if err := client.writeFrame(frame); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+
+		want := frame
+		want.shared = nil
+		want.V = r.protocol
+		var v interface{} = want
+		if r.protocol == legacyProtocol {
+			v = testMessage
+		}
+		if len(conn.frames) != 1 || !bytes.Equal(conn.frames[0], encodeFrame(t, r.codec, v)) {
+			t.Errorf("%s v%d: frame = %q, want %q", codecName(r.codec), r.protocol, conn.frames, encodeFrame(t, r.codec, v))
+		}
+	}
+	if n := len(frame.shared.data); n != len(recipients)/2 {
+		t.Errorf("frame encoded %d times, want %d", n, len(recipients)/2)
+	}
+}
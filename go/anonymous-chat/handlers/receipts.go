@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Типы служебных сообщений для отметок о прочтении
+const (
+	TypeRead = "read" // клиент сообщает позицию последнего прочитанного сообщения
+	TypeSeen = "seen" // сервер рассылает, до какого сообщения дочитал участник
+)
+
+// ensureRoomID возвращает ID комнаты, создавая её при отсутствии
+func ensureRoomID(ctx context.Context, room string) (int, error) {
+	var roomID int
+	err := models.DB.QueryRow(ctx, "SELECT id FROM rooms WHERE name=$1", room).Scan(&roomID)
+	if err == nil {
+		return roomID, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+	err = models.DB.QueryRow(ctx,
+		"INSERT INTO rooms(name) VALUES($1) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id",
+		room).Scan(&roomID)
+	return roomID, err
+}
+
+// joinRoom отмечает, что анонимная личность участвует в комнате.
+// Возвращает true, если личность вошла в комнату впервые.
+func joinRoom(ctx context.Context, identity, room, nickname string) (bool, error) {
+	roomID, err := ensureRoomID(ctx, room)
+	if err != nil {
+		return false, err
+	}
+	var inserted bool
+	err = models.DB.QueryRow(ctx, `
+		INSERT INTO room_members(identity, room_id, nickname) VALUES($1, $2, $3)
+		ON CONFLICT (identity, room_id) DO UPDATE SET nickname = EXCLUDED.nickname
+		RETURNING (xmax = 0)`,
+		identity, roomID, nickname).Scan(&inserted)
+	return inserted, err
+}
+
+// markRead сохраняет позицию прочтения; позиция никогда не сдвигается назад.
+// Возвращает итоговую позицию и ник, под которым личность участвует в комнате.
+func markRead(ctx context.Context, identity, room string, lastReadID int64) (int64, string, error) {
+	var stored int64
+	var nickname string
+	err := models.DB.QueryRow(ctx, `
+		UPDATE room_members rm
+		SET last_read_id = GREATEST(rm.last_read_id, $3)
+		FROM rooms r
+		WHERE rm.room_id = r.id AND r.name = $2 AND rm.identity = $1
+		RETURNING rm.last_read_id, rm.nickname`,
+		identity, room, lastReadID).Scan(&stored, &nickname)
+	return stored, nickname, err
+}
+
+// broadcastSeen рассылает участникам комнаты новую позицию прочтения участника
+func broadcastSeen(room, nickname string, lastReadID int64) {
+	broadcast <- MessageWithRoom{
+		Room: room,
+		Message: Message{
+			Nickname:   nickname,
+			Type:       TypeSeen,
+			LastReadID: lastReadID,
+			CreatedAt:  getCurrentTimestamp(),
+		},
+		Transient: true,
+	}
+}
+
+// handleReadReceipt сохраняет отметку о прочтении, полученную от клиента
+func (c *Client) handleReadReceipt(msg Message) {
+	if c.Identity == "" || msg.LastReadID <= 0 {
+		return
+	}
+	stored, _, err := markRead(context.Background(), c.Identity, c.Room, msg.LastReadID)
+	if err != nil {
+		slog.Error("Ошибка при сохранении отметки о прочтении", "err", err, logging.Room(c.Room))
+		return
+	}
+	broadcastSeen(c.Room, c.Nick, stored)
+}
+
+// sendReceipts отправляет клиенту текущие позиции прочтения участников комнаты
+func sendReceipts(c *Client) {
+	rows, err := models.DB.Query(context.Background(), `
+		SELECT rm.nickname, rm.last_read_id
+		FROM room_members rm
+		JOIN rooms r ON rm.room_id = r.id
+		WHERE r.name = $1 AND rm.last_read_id > 0`, c.Room)
+	if err != nil {
+		slog.Error("Ошибка при получении отметок о прочтении", "err", err, logging.Room(c.Room))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg := Message{Type: TypeSeen}
+		if err := rows.Scan(&msg.Nickname, &msg.LastReadID); err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		c.sendFrame(messageFrame(msg))
+	}
+}
+
+// unreadCounts возвращает число непрочитанных сообщений в каждой комнате, где участвует личность
+func unreadCounts(ctx context.Context, identity string) (map[string]int, error) {
+	rows, err := models.DB.Query(ctx, `
+		SELECT r.name, COUNT(m.id)
+		FROM room_members rm
+		JOIN rooms r ON rm.room_id = r.id
+		LEFT JOIN messages m ON m.room_id = r.id AND m.id > rm.last_read_id
+		WHERE rm.identity = $1
+		GROUP BY r.name`, identity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		counts[name] = count
+	}
+	return counts, rows.Err()
+}
+
+// fillUnread проставляет число непрочитанных сообщений в комнатах, где участвует личность запроса
+func fillUnread(r *http.Request, rooms []Room) {
+	identity, ok := identityFromRequest(r)
+	if !ok {
+		return
+	}
+	counts, err := unreadCounts(r.Context(), identity)
+	if err != nil {
+		slog.Error("Ошибка при подсчёте непрочитанных сообщений", "err", err)
+		return
+	}
+	for i := range rooms {
+		if n, joined := counts[rooms[i].Name]; joined {
+			rooms[i].Unread = &n
+		}
+	}
+}
+
+// joinedRooms возвращает комнаты, в которых участвует личность, включая приватные
+func joinedRooms(ctx context.Context, identity string) ([]Room, error) {
+	rows, err := models.DB.Query(ctx, roomSelect+`
+		JOIN room_members rm ON rm.room_id = r.id AND rm.identity = $1
+		GROUP BY r.id ORDER BY MAX(m.created_at) DESC NULLS LAST, r.name`, identity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// APIJoinedRoomsHandler возвращает комнаты личности запроса с числом непрочитанных сообщений
+func APIJoinedRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, ok := identityFromRequest(r)
+	rooms := []Room{}
+	if ok {
+		joined, err := joinedRooms(r.Context(), identity)
+		if err != nil {
+			slog.Error("Ошибка при получении комнат", "err", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении комнат")
+			return
+		}
+		rooms = append(rooms, joined...)
+		fillUnread(r, rooms)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Rooms []Room `json:"rooms"`
+	}{Rooms: rooms})
+}
+
+// APIMarkReadHandler сохраняет позицию прочтения комнаты для личности запроса
+func APIMarkReadHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["room"]
+	if !originAllowed(r) {
+		writeAPIError(w, http.StatusForbidden, "forbidden_origin", "Недопустимый источник запроса")
+		return
+	}
+	identity, ok := identityFromRequest(r)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "no_identity", "Нет анонимного идентификатора")
+		return
+	}
+
+	var in struct {
+		LastReadID int64 `json:"last_read_id"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&in); err != nil || in.LastReadID <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Некорректное тело запроса")
+		return
+	}
+
+	stored, nickname, err := markRead(r.Context(), identity, name, in.LastReadID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Вы не участвуете в этой комнате")
+		return
+	}
+	if err != nil {
+		slog.Error("Ошибка при сохранении отметки о прочтении", "err", err, logging.Room(name))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при сохранении отметки о прочтении")
+		return
+	}
+
+	broadcastSeen(name, nickname, stored)
+	writeJSON(w, http.StatusOK, struct {
+		LastReadID int64 `json:"last_read_id"`
+	}{LastReadID: stored})
+}
@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// Загрузка по частям по протоколу tus 1.0 (https://tus.io/protocols/resumable-upload)
+// с расширениями creation, expiration и termination. Клиент создаёт загрузку
+// запросом POST, отправляет содержимое запросами PATCH с текущим смещением и
+// после обрыва узнаёт принятое смещение запросом HEAD. Сообщение в комнату
+// публикуется, только когда файл получен целиком и прошёл проверку.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	resumableURLPrefix = "/upload-resumable/"
+
+	// Содержимое PATCH сохраняется частями такого размера; после обрыва
+	// соединения теряется не больше одной несохранённой части
+	resumableChunkSize = 1 << 20
+	// Незавершённая загрузка удаляется, если её не продолжали это время
+	resumableUploadTTL = 24 * time.Hour
+)
+
+// resumableUpload — состояние загрузки по частям
+type resumableUpload struct {
+	ID        string
+	Identity  string
+	Length    int64
+	Offset    int64
+	Completed bool
+	ExpiresAt time.Time
+	fileUpload
+}
+
+// setTusHeaders добавляет заголовки, общие для всех ответов протокола
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// requireTusVersion проверяет версию протокола клиента
+func requireTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Неподдерживаемая версия протокола tus", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata разбирает заголовок Upload-Metadata: пары «ключ base64(значение)» через запятую
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("некорректное значение " + key + " в Upload-Metadata")
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// ResumableOptionsHandler сообщает возможности сервера
+func ResumableOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(models.Config.MaxResumableBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResumableCreateHandler создаёт загрузку. Комната, вид загрузки, имя и тип
+// файла, а в зашифрованной комнате — конверт, передаются в Upload-Metadata.
+func ResumableCreateHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !requireTusVersion(w, r) || !requireAllowedOrigin(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Нужен заголовок Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > models.Config.MaxResumableBytes {
+		http.Error(w, "Файл слишком большой", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload := resumableUpload{
+		ID:     randomHex(16),
+		Length: length,
+		fileUpload: fileUpload{
+			Room:        meta["room"],
+			Kind:        meta["kind"],
+			Filename:    meta["filename"],
+			ContentType: meta["filetype"],
+		},
+	}
+	if upload.Room == "" {
+		http.Error(w, "Комната обязательна", http.StatusBadRequest)
+		return
+	}
+	if _, ok := uploadAllowedTypes(upload.Kind); !ok {
+		http.Error(w, "Неизвестный вид загрузки", http.StatusBadRequest)
+		return
+	}
+	// Заявленный тип проверяется по содержимому в конце, но превышение
+	// его предела видно сразу, и принимать такой файл незачем
+	if upload.Kind == "file" {
+		if limit := attachmentLimit(normalizeMIME(upload.ContentType)); limit > 0 && length > limit {
+			http.Error(w, "Файл слишком большой", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	upload.Identity, _ = identityFromRequest(r)
+	encrypted, ok := checkUploadRoom(w, r, upload.Identity, upload.Room)
+	if !ok {
+		return
+	}
+	var envelope []byte
+	if encrypted {
+		upload.Envelope, err = uploadEnvelope(meta["ciphertext"], meta["nonce"], meta["key_id"])
+		if err != nil {
+			slog.Warn("Некорректный конверт зашифрованного файла", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		envelope, _ = json.Marshal(upload.Envelope)
+	}
+
+	upload.ExpiresAt = time.Now().Add(resumableUploadTTL)
+	_, err = models.DB.Exec(r.Context(), `
+		INSERT INTO resumable_uploads(id, identity, room, kind, filename, content_type, encrypted, upload_length, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, NOW() + $9 * INTERVAL '1 second')`,
+		upload.ID, upload.Identity, upload.Room, upload.Kind, upload.Filename, upload.ContentType,
+		envelope, upload.Length, resumableUploadTTL.Seconds())
+	if err != nil {
+		slog.Error("Ошибка при создании загрузки", "err", err)
+		http.Error(w, "Ошибка при создании загрузки", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Создана загрузка по частям", "upload", upload.ID, "kind", upload.Kind, "size", length, logging.Room(upload.Room))
+	w.Header().Set("Location", resumableURLPrefix+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ResumableHeadHandler сообщает, сколько байт загрузки уже принято
+func ResumableHeadHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !requireTusVersion(w, r) {
+		return
+	}
+	upload, ok := loadResumableUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if !upload.Completed {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ResumablePatchHandler дописывает содержимое с указанного смещения. Принятые
+// байты сохраняются частями по мере чтения, поэтому обрыв соединения не
+// отменяет уже переданное. Запрос, на котором файл получен целиком,
+// проверяет его и публикует сообщение.
+func ResumablePatchHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !requireTusVersion(w, r) || !requireAllowedOrigin(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Ожидается Content-Type: application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Нужен заголовок Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	upload, ok := loadResumableUpload(w, r)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "Смещение не совпадает с принятым сервером", http.StatusConflict)
+		return
+	}
+
+	// Байты сверх объявленной длины не читаются
+	body := io.LimitReader(r.Body, upload.Length-upload.Offset)
+	buf := make([]byte, resumableChunkSize)
+	for upload.Offset < upload.Length {
+		n, readErr := io.ReadFull(body, buf)
+		if n > 0 {
+			// Контекст запроса не используется: полученное до обрыва должно сохраниться
+			if err := appendResumableChunk(context.Background(), &upload, buf[:n]); err != nil {
+				if errors.Is(err, errResumableConflict) {
+					http.Error(w, "Смещение не совпадает с принятым сервером", http.StatusConflict)
+					return
+				}
+				slog.Error("Ошибка при сохранении части загрузки", "err", err, "upload", upload.ID)
+				http.Error(w, "Ошибка при сохранении части загрузки", http.StatusInternalServerError)
+				return
+			}
+		}
+		if readErr != nil {
+			// Конец тела или обрыв: принятое сохранено, клиент продолжит с нового смещения
+			break
+		}
+	}
+
+	if upload.Offset == upload.Length && offset < upload.Length {
+		if !finishResumableUpload(w, r, upload) {
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Offset < upload.Length {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResumableDeleteHandler отменяет загрузку и удаляет принятые части
+func ResumableDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !requireTusVersion(w, r) || !requireAllowedOrigin(w, r) {
+		return
+	}
+	upload, ok := loadResumableUpload(w, r)
+	if !ok {
+		return
+	}
+	if _, err := models.DB.Exec(r.Context(), "DELETE FROM resumable_uploads WHERE id = $1", upload.ID); err != nil {
+		slog.Error("Ошибка при удалении загрузки", "err", err, "upload", upload.ID)
+		http.Error(w, "Ошибка при удалении загрузки", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadResumableUpload читает загрузку из адреса запроса. Чужая, просроченная
+// и несуществующая загрузки неотличимы для клиента.
+func loadResumableUpload(w http.ResponseWriter, r *http.Request) (resumableUpload, bool) {
+	upload := resumableUpload{ID: mux.Vars(r)["id"]}
+	var envelope []byte
+	var expiresIn float64 // срок считается в базе, чтобы не зависеть от часовых поясов
+	err := models.DB.QueryRow(r.Context(), `
+		SELECT identity, room, kind, filename, content_type, encrypted,
+			upload_length, upload_offset, completed, EXTRACT(EPOCH FROM expires_at - NOW())::float8
+		FROM resumable_uploads WHERE id = $1 AND expires_at > NOW()`,
+		upload.ID).Scan(&upload.Identity, &upload.Room, &upload.Kind, &upload.Filename, &upload.ContentType,
+		&envelope, &upload.Length, &upload.Offset, &upload.Completed, &expiresIn)
+	upload.ExpiresAt = time.Now().Add(time.Duration(expiresIn * float64(time.Second)))
+	identity, _ := identityFromRequest(r)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && upload.Identity != identity) {
+		http.Error(w, "Загрузка не найдена", http.StatusNotFound)
+		return upload, false
+	}
+	if err == nil && envelope != nil {
+		err = json.Unmarshal(envelope, &upload.Envelope)
+	}
+	if err != nil {
+		slog.Error("Ошибка при получении загрузки", "err", err, "upload", upload.ID)
+		http.Error(w, "Ошибка при получении загрузки", http.StatusInternalServerError)
+		return upload, false
+	}
+	return upload, true
+}
+
+// errResumableConflict означает, что смещение изменил параллельный запрос
+var errResumableConflict = errors.New("смещение загрузки изменилось")
+
+// appendResumableChunk сохраняет часть и сдвигает смещение загрузки. Условие на
+// смещение не даёт двум параллельным запросам записать одну и ту же часть.
+func appendResumableChunk(ctx context.Context, upload *resumableUpload, data []byte) error {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE resumable_uploads SET upload_offset = upload_offset + $3, expires_at = NOW() + $4 * INTERVAL '1 second'
+		WHERE id = $1 AND upload_offset = $2 AND NOT completed`,
+		upload.ID, upload.Offset, len(data), resumableUploadTTL.Seconds())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errResumableConflict
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO resumable_upload_chunks(upload_id, chunk_offset, data) VALUES($1, $2, $3)`,
+		upload.ID, upload.Offset, data)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	upload.Offset += int64(len(data))
+	upload.ExpiresAt = time.Now().Add(resumableUploadTTL)
+	return nil
+}
+
+// finishResumableUpload собирает файл из частей, проверяет и публикует его.
+// Части удаляются в любом случае; при успехе загрузка остаётся отмеченной
+// завершённой до истечения срока, чтобы HEAD после потерянного ответа
+// сообщил клиенту, что файл получен.
+func finishResumableUpload(w http.ResponseWriter, r *http.Request, upload resumableUpload) bool {
+	// Сборка не прерывается, если клиент отключился после отправки последней части
+	ctx := context.Background()
+	defer func() {
+		if _, err := models.DB.Exec(ctx, "DELETE FROM resumable_upload_chunks WHERE upload_id = $1", upload.ID); err != nil {
+			slog.Error("Ошибка при удалении частей загрузки", "err", err, "upload", upload.ID)
+		}
+	}()
+	fail := func() {
+		models.DB.Exec(ctx, "DELETE FROM resumable_uploads WHERE id = $1", upload.ID)
+	}
+
+	// Комната могла стать закрытой или зашифрованной, пока файл загружался
+	encrypted, ok := checkUploadRoom(w, r, upload.Identity, upload.Room)
+	if !ok {
+		fail()
+		return false
+	}
+	if encrypted != (upload.Envelope != nil) {
+		fail()
+		http.Error(w, "Настройки шифрования комнаты изменились во время загрузки", http.StatusConflict)
+		return false
+	}
+
+	file, err := assembleResumableUpload(ctx, upload)
+	if err != nil {
+		fail()
+		slog.Error("Ошибка при сборке загрузки", "err", err, "upload", upload.ID)
+		http.Error(w, "Ошибка при сборке загрузки", http.StatusInternalServerError)
+		return false
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	msg, err := publishUpload(file, upload.fileUpload)
+	if errors.Is(err, errSaveUpload) {
+		fail()
+		slog.Error("Ошибка при сохранении файла", "err", err)
+		http.Error(w, "Ошибка при сохранении файла", http.StatusInternalServerError)
+		return false
+	}
+	if err != nil {
+		fail()
+		slog.Warn("Файл отклонён при проверке содержимого", "err", err, "content_type", upload.ContentType)
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return false
+	}
+
+	if _, err := models.DB.Exec(ctx, "UPDATE resumable_uploads SET completed = TRUE WHERE id = $1", upload.ID); err != nil {
+		slog.Error("Ошибка при завершении загрузки", "err", err, "upload", upload.ID)
+	}
+	slog.Info("Файл успешно загружен", "type", msg.Type, "upload", upload.ID, logging.Room(upload.Room), logging.IP(r.RemoteAddr))
+	return true
+}
+
+// assembleResumableUpload собирает части по порядку во временный файл
+func assembleResumableUpload(ctx context.Context, upload resumableUpload) (*os.File, error) {
+	file, err := os.CreateTemp("", "chat-resumable-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func(err error) (*os.File, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	rows, err := models.DB.Query(ctx, `
+		SELECT chunk_offset, data FROM resumable_upload_chunks
+		WHERE upload_id = $1 ORDER BY chunk_offset`, upload.ID)
+	if err != nil {
+		return cleanup(err)
+	}
+	defer rows.Close()
+	var written int64
+	for rows.Next() {
+		var offset int64
+		var data []byte
+		if err := rows.Scan(&offset, &data); err != nil {
+			return cleanup(err)
+		}
+		if offset != written {
+			return cleanup(errors.New("в загрузке пропущена часть"))
+		}
+		if _, err := file.Write(data); err != nil {
+			return cleanup(err)
+		}
+		written += int64(len(data))
+	}
+	if err := rows.Err(); err != nil {
+		return cleanup(err)
+	}
+	if written != upload.Length {
+		return cleanup(errors.New("размер собранного файла не совпадает с объявленным"))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return cleanup(err)
+	}
+	return file, nil
+}
+
+// expireResumableUploads удаляет загрузки, которые не продолжали дольше срока
+func expireResumableUploads() {
+	tag, err := models.DB.Exec(context.Background(), "DELETE FROM resumable_uploads WHERE expires_at < NOW()")
+	if err != nil {
+		slog.Error("Ошибка при удалении просроченных загрузок", "err", err)
+		return
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		slog.Info("Удалены просроченные загрузки по частям", "count", n)
+	}
+}
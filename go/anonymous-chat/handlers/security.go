@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Имя поля формы с CSRF-токеном
+const csrfFieldName = "csrf_token"
+
+// Политика безопасности содержимого для HTML-страниц: скрипты и стили только
+// с собственного источника, встраивание страниц во фреймы запрещено.
+// blob: нужен для расшифрованных вложений зашифрованных комнат.
+// %[1]s — источник хранилища, куда /uploads перенаправляет за файлами.
+const pageCSPTemplate = "default-src 'self'; script-src 'self'; style-src 'self'; " +
+	"img-src 'self'%[1]s blob: data:; media-src 'self'%[1]s blob:; connect-src 'self'%[1]s; " +
+	"object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// Источник подписанных ссылок хранилища; пустой, если файлы отдаёт сервер
+var mediaOrigin string
+
+// pageCSP возвращает политику для HTML-страниц
+func pageCSP() string {
+	extra := ""
+	if mediaOrigin != "" {
+		extra = " " + mediaOrigin
+	}
+	return fmt.Sprintf(pageCSPTemplate, extra)
+}
+
+// Политика для загруженных файлов: при открытии напрямую файл не может
+// выполнить скрипт или обратиться к сайту от имени посетителя
+const uploadCSP = "default-src 'none'; img-src 'self'; media-src 'self'; sandbox; frame-ancestors 'none'"
+
+// originAllowed проверяет заголовок Origin запроса. Запросы без Origin
+// (не из браузера) и с собственного источника разрешены, остальные —
+// только из списка ALLOWED_ORIGINS.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range models.Config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAllowedOrigin отклоняет запрос с чужого источника.
+// При отказе отправляет ошибку и возвращает false.
+func requireAllowedOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if originAllowed(r) {
+		return true
+	}
+	slog.Warn("Запрос с недопустимого источника", "origin", r.Header.Get("Origin"), logging.IP(r.RemoteAddr))
+	http.Error(w, "Недопустимый источник запроса", http.StatusForbidden)
+	return false
+}
+
+var (
+	csrfKeyOnce sync.Once
+	csrfKey     []byte
+)
+
+// csrfSecret возвращает ключ подписи CSRF-токенов. Без CSRF_SECRET ключ
+// создаётся при запуске, и формы, открытые до перезапуска, придётся отправить заново.
+func csrfSecret() []byte {
+	csrfKeyOnce.Do(func() {
+		if models.Config.CSRFSecret != "" {
+			csrfKey = []byte(models.Config.CSRFSecret)
+			return
+		}
+		csrfKey = make([]byte, 32)
+		rand.Read(csrfKey)
+	})
+	return csrfKey
+}
+
+// csrfToken возвращает CSRF-токен анонимной личности. Токен привязан к cookie
+// личности, поэтому чужой сайт не может ни прочитать, ни подобрать его.
+func csrfToken(identity string) string {
+	mac := hmac.New(sha256.New, csrfSecret())
+	mac.Write([]byte(identity))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken проверяет CSRF-токен из формы запроса
+func validCSRFToken(r *http.Request, identity string) bool {
+	token := r.FormValue(csrfFieldName)
+	return token != "" && hmac.Equal([]byte(token), []byte(csrfToken(identity)))
+}
+
+// PageSecurityHeaders добавляет заголовки безопасности к HTML-страницам
+func PageSecurityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", pageCSP())
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "same-origin") // ник передаётся в адресе страницы чата
+		if r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next(w, r)
+	}
+}
+
+// UploadSecurityHeaders добавляет заголовки безопасности к загруженным файлам
+func UploadSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", uploadCSP)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HTTPSRedirect перенаправляет запросы на тот же адрес по HTTPS с указанным портом.
+// Код 308 сохраняет метод и тело запроса.
+func HTTPSRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6-адрес
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // регистрация декодеров для image.Decode
+	_ "image/png"
+	"io"
+	"mime"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Сколько байт от начала файла нужно для определения типа
+const sniffLength = 512
+
+// Максимальное число пикселей изображения; защищает от файлов, которые
+// при малом размере распаковываются в гигабайты памяти. Проверяется по
+// заголовку до декодирования. Обработка держит в памяти декодированное
+// изображение и его копию в RGBA (4 байта на пиксель): для 24 Мп (6000×4000)
+// это около 130 МБ на загрузку.
+const maxImagePixels = 24_000_000
+
+// uploadType описывает тип загружаемого файла, определяемый по содержимому
+type uploadType struct {
+	mime  string
+	ext   string
+	match func(head []byte) bool
+}
+
+// Известные типы в порядке проверки. Один контейнер может соответствовать
+// нескольким типам (WebM со звуком или видео): выбирается первый разрешённый.
+var uploadTypes = []uploadType{
+	{"image/jpeg", ".jpg", func(b []byte) bool { return bytes.HasPrefix(b, []byte{0xff, 0xd8, 0xff}) }},
+	{"image/png", ".png", func(b []byte) bool { return bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")) }},
+	{"audio/wav", ".wav", func(b []byte) bool {
+		return len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WAVE"
+	}},
+	{"audio/ogg", ".ogg", func(b []byte) bool { return bytes.HasPrefix(b, []byte("OggS")) }},
+	{"audio/webm", ".webm", isWebM},
+	{"video/webm", ".webm", isWebM},
+	{"video/mp4", ".mp4", isMP4},
+	{"application/pdf", ".pdf", func(b []byte) bool { return bytes.HasPrefix(b, []byte("%PDF-")) }},
+	{"application/zip", ".zip", func(b []byte) bool {
+		// Локальный заголовок файла или конец пустого архива
+		return bytes.HasPrefix(b, []byte("PK\x03\x04")) || bytes.HasPrefix(b, []byte("PK\x05\x06"))
+	}},
+	{"audio/mpeg", ".mp3", isMP3},
+	{"text/plain", ".txt", isText}, // последним: под него подходит почти любой текст
+}
+
+// detectableTypes возвращает типы, которые sniffUpload умеет определять
+func detectableTypes() []string {
+	types := make([]string, 0, len(uploadTypes))
+	for _, t := range uploadTypes {
+		types = append(types, t.mime)
+	}
+	return types
+}
+
+// isWebM распознаёт заголовок EBML с типом документа webm (Matroska без него не принимается)
+func isWebM(b []byte) bool {
+	return bytes.HasPrefix(b, []byte{0x1a, 0x45, 0xdf, 0xa3}) && bytes.Contains(b[:min(len(b), 64)], []byte("webm"))
+}
+
+// isMP4 распознаёт контейнер ISO BMFF по блоку ftyp; HEIF и AVIF с тем же
+// контейнером являются изображениями и не принимаются
+func isMP4(b []byte) bool {
+	if len(b) < 12 || string(b[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(b[8:12]) {
+	case "heic", "heix", "hevc", "mif1", "msf1", "avif":
+		return false
+	}
+	return true
+}
+
+// isText распознаёт текст в UTF-8 без управляющих символов, кроме пробельных
+func isText(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	// Начало файла могло оборвать многобайтовый символ
+	valid := false
+	for cut := 0; cut < utf8.UTFMax && cut < len(b); cut++ {
+		if utf8.Valid(b[:len(b)-cut]) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return false
+	}
+	for _, c := range b {
+		if (c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isMP3 распознаёт MP3 по тегу ID3 или заголовку первого кадра MPEG Audio
+func isMP3(b []byte) bool {
+	if bytes.HasPrefix(b, []byte("ID3")) {
+		return true
+	}
+	// Синхрослово из 11 единиц, слой не 00 (иначе это AAC), индекс битрейта не 1111
+	return len(b) >= 3 && b[0] == 0xff && b[1]&0xe0 == 0xe0 && b[1]&0x06 != 0 && b[2]&0xf0 != 0xf0
+}
+
+// Синонимы типов, которые присылают браузеры и клиенты
+var mimeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/x-wav":                  "audio/wav",
+	"audio/wave":                   "audio/wav",
+	"audio/vnd.wave":               "audio/wav",
+	"audio/x-m4a":                  "audio/mp4",
+	"application/x-zip-compressed": "application/zip",
+}
+
+// Ошибки проверки содержимого загрузки
+var (
+	errUnsupportedType = errors.New("неподдерживаемый тип файла")
+	errInvalidImage    = errors.New("файл не является корректным изображением")
+)
+
+// sniffedUpload — результат проверки содержимого загрузки
+type sniffedUpload struct {
+	MIME  string
+	Ext   string      // расширение для хранения; имя файла клиента не используется
+	Image image.Image // декодированное изображение; nil для остальных типов
+}
+
+// sniffUpload определяет тип файла по содержимому и проверяет его.
+// Тип должен входить в allowed и совпадать с заявленным клиентом; если клиент
+// тип не указал (или указал application/octet-stream), используется определённый.
+// Изображения полностью декодируются. После проверки файл перемотан в начало.
+func sniffUpload(file io.ReadSeeker, declared string, allowed []string) (sniffedUpload, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return sniffedUpload{}, err
+	}
+	head = head[:n]
+
+	var detected *uploadType
+	for i := range uploadTypes {
+		if uploadTypes[i].match(head) && slices.Contains(allowed, uploadTypes[i].mime) {
+			detected = &uploadTypes[i]
+			break
+		}
+	}
+	if detected == nil {
+		return sniffedUpload{}, errUnsupportedType
+	}
+
+	if claimed := normalizeMIME(declared); claimed != "" && claimed != "application/octet-stream" && !sameContainer(claimed, detected.mime) {
+		return sniffedUpload{}, fmt.Errorf("содержимое файла (%s) не совпадает с заявленным типом %s", detected.mime, claimed)
+	}
+
+	sniffed := sniffedUpload{MIME: detected.mime, Ext: detected.ext}
+	if strings.HasPrefix(detected.mime, "image/") {
+		if sniffed.Image, err = decodeImage(file); err != nil {
+			return sniffedUpload{}, err
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return sniffedUpload{}, err
+	}
+	return sniffed, nil
+}
+
+// normalizeMIME убирает параметры типа (например, ;codecs=opus) и приводит синонимы к одному виду
+func normalizeMIME(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(value))
+	}
+	if alias, ok := mimeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// sameContainer сравнивает заявленный и определённый типы. Звук и видео в одном
+// контейнере не различить по началу файла, а MediaRecorder, например, помечает
+// звук как video/webm, поэтому audio/x и video/x считаются одним типом.
+func sameContainer(claimed, detected string) bool {
+	if claimed == detected {
+		return true
+	}
+	claimedTop, claimedSub, _ := strings.Cut(claimed, "/")
+	detectedTop, detectedSub, _ := strings.Cut(detected, "/")
+	media := func(top string) bool { return top == "audio" || top == "video" }
+	return claimedSub == detectedSub && media(claimedTop) && media(detectedTop)
+}
+
+// decodeImage декодирует изображение целиком, предварительно проверив его размеры
+func decodeImage(file io.ReadSeeker) (image.Image, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("недопустимый размер изображения %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	return img, nil
+}
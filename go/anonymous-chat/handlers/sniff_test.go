@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encodedImage(t *testing.T, encode func(io.Writer, image.Image) error) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := encode(&b, image.NewGray(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// pngHeader возвращает сигнатуру PNG и блок IHDR с заданными размерами без
+// данных изображения: так выглядит начало «бомбы», которая распаковывается
+// в гигабайты пикселей
+func pngHeader(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 0, 0, 0, 0) // 8 бит, оттенки серого
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, 13)
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestSniffUpload(t *testing.T) {
+	pngData := encodedImage(t, png.Encode)
+	jpegData := encodedImage(t, func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+	webm := append([]byte{0x1a, 0x45, 0xdf, 0xa3, 0x9f, 0x42, 0x82, 0x84}, "webm\x00\x00\x00\x00"...)
+	ftyp := func(brand string) []byte { return append([]byte("\x00\x00\x00\x18ftyp"), brand+"\x00\x00\x00\x00"...) }
+	// Граница sniffLength приходится на середину двухбайтового символа
+	cyrillic := "a" + strings.Repeat("я", sniffLength)
+
+	all := detectableTypes()
+	audio := []string{"audio/wav", "audio/ogg", "audio/webm", "audio/mpeg"}
+	video := []string{"video/webm", "video/mp4"}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		declared string
+		allowed  []string
+		want     string // определённый тип; пусто — ожидается ошибка
+		wantErr  error  // конкретная ошибка, если она важна
+	}{
+		{name: "png", data: pngData, declared: "image/png", allowed: all, want: "image/png"},
+		{name: "jpeg alias", data: jpegData, declared: "image/jpg", allowed: all, want: "image/jpeg"},
+		{name: "no declared type", data: pngData, allowed: all, want: "image/png"},
+		{name: "octet-stream fallback", data: pngData, declared: "application/octet-stream", allowed: all, want: "image/png"},
+		{name: "declared type with parameters", data: webm, declared: "audio/webm;codecs=opus", allowed: audio, want: "audio/webm"},
+		{name: "mismatched declared type", data: pngData, declared: "image/jpeg", allowed: all},
+		{name: "pdf declared as text", data: []byte("%PDF-1.7\n"), declared: "text/plain", allowed: all},
+		{name: "png not allowed", data: pngData, allowed: audio, wantErr: errUnsupportedType},
+		{name: "broken png", data: []byte("\x89PNG\r\n\x1a\nnot a png"), allowed: all, wantErr: errInvalidImage},
+
+		// Звук и видео в одном контейнере: MediaRecorder помечает звук как video/webm
+		{name: "webm audio declared as video", data: webm, declared: "video/webm", allowed: audio, want: "audio/webm"},
+		{name: "webm video", data: webm, declared: "video/webm", allowed: video, want: "video/webm"},
+		{name: "ogg declared as video", data: []byte("OggS\x00\x02"), declared: "video/ogg", allowed: audio, want: "audio/ogg"},
+		{name: "webm declared as ogg", data: webm, declared: "audio/ogg", allowed: audio},
+		{name: "wav alias", data: []byte("RIFF\x24\x00\x00\x00WAVEfmt "), declared: "audio/x-wav", allowed: audio, want: "audio/wav"},
+		{name: "mp3 with id3", data: []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), declared: "audio/mp3", allowed: audio, want: "audio/mpeg"},
+		{name: "mp3 frame", data: []byte{0xff, 0xfb, 0x90, 0x44}, allowed: audio, want: "audio/mpeg"},
+		{name: "aac is not mp3", data: []byte{0xff, 0xf1, 0x50, 0x80}, allowed: audio, wantErr: errUnsupportedType},
+
+		// HEIF и AVIF используют контейнер MP4, но видео не являются
+		{name: "mp4", data: ftyp("isom"), declared: "video/mp4", allowed: all, want: "video/mp4"},
+		{name: "heic", data: ftyp("heic"), allowed: all, wantErr: errUnsupportedType},
+		{name: "avif", data: ftyp("avif"), allowed: all, wantErr: errUnsupportedType},
+		{name: "mif1", data: ftyp("mif1"), allowed: all, wantErr: errUnsupportedType},
+
+		{name: "zip alias", data: []byte("PK\x03\x04\x14\x00"), declared: "application/x-zip-compressed", allowed: all, want: "application/zip"},
+		{name: "text", data: []byte("привет\r\n\tмир\n"), declared: "text/plain; charset=utf-8", allowed: all, want: "text/plain"},
+		{name: "text cut inside a character", data: []byte(cyrillic), allowed: all, want: "text/plain"},
+		{name: "invalid utf-8", data: []byte("abc\xff\xfedef"), allowed: all, wantErr: errUnsupportedType},
+		{name: "control characters", data: []byte("abc\x00def"), allowed: all, wantErr: errUnsupportedType},
+		{name: "empty", data: nil, allowed: all, wantErr: errUnsupportedType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := bytes.NewReader(tt.data)
+			got, err := sniffUpload(file, tt.declared, tt.allowed)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("sniffUpload = %s, want error", got.MIME)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sniffUpload: %v", err)
+			}
+			if got.MIME != tt.want {
+				t.Errorf("MIME = %s, want %s", got.MIME, tt.want)
+			}
+			if (got.Image != nil) != strings.HasPrefix(tt.want, "image/") {
+				t.Errorf("Image = %v for %s", got.Image != nil, tt.want)
+			}
+			if pos, _ := file.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Errorf("file position = %d, want 0", pos)
+			}
+		})
+	}
+}
+
+// Изображение с огромными размерами отклоняется по заголовку до декодирования,
+// тогда как такой же заголовок с допустимыми размерами доходит до декодера
+func TestSniffUploadPixelBomb(t *testing.T) {
+	all := detectableTypes()
+	_, err := sniffUpload(bytes.NewReader(pngHeader(100_000, 100_000)), "image/png", all)
+	if err == nil || errors.Is(err, errInvalidImage) {
+		t.Errorf("100000x100000: err = %v, want size error", err)
+	}
+	_, err = sniffUpload(bytes.NewReader(pngHeader(1000, 1000)), "image/png", all)
+	if !errors.Is(err, errInvalidImage) {
+		t.Errorf("1000x1000 without data: err = %v, want errInvalidImage", err)
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"anonymous-chat/codec"
+	"anonymous-chat/logging"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Интервал комментариев-пингов, чтобы прокси не закрывали простаивающий поток
+const sseKeepAliveInterval = 25 * time.Second
+
+// Максимальный размер сообщения, отправляемого через POST
+const maxSSEMessageSize = 64 << 10
+
+// sseTransport — транспорт поверх потока Server-Sent Events.
+// Писать в поток может только горутина обработчика запроса, поэтому
+// Write вызывается из неё, а Close лишь сигнализирует о завершении.
+type sseTransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	done    chan struct{}
+	once    *sync.Once
+}
+
+// Codec возвращает nil: события SSE передаются в JSON
+func (t sseTransport) Codec() codec.Codec { return nil }
+
+func (t sseTransport) Write(data []byte) error {
+	if _, err := fmt.Fprintf(t.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+func (t sseTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t sseTransport) Kind() string { return "sse" }
+
+// Клиенты SSE по идентификатору сессии; через него POST-запросы
+// находят соединение, от имени которого отправляется сообщение
+var sseSessions = make(map[string]*Client)
+var sseMutex = &sync.Mutex{}
+
+// SSEHandler открывает поток событий комнаты — замену WebSocket для сетей,
+// где он не работает. Первым событием "session" клиент получает идентификатор
+// сессии для отправки сообщений через SSESendHandler.
+func SSEHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+
+	if IsShuttingDown() {
+		http.Error(w, "Сервер останавливается", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !requireAllowedOrigin(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Потоковая передача не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	identity := ensureIdentity(w, r)
+	if allowed, err := canAccessRoom(r.Context(), identity, room); err != nil || !allowed {
+		if err != nil {
+			slog.Error("Ошибка при проверке доступа к комнате", "err", err, logging.Room(room))
+		}
+		http.Error(w, "Доступ к комнате запрещён", http.StatusForbidden)
+		return
+	}
+
+	protocol, err := negotiateProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nickname := r.URL.Query().Get("nickname")
+	if nickname == "" {
+		nickname = "Anonymous"
+	}
+	if !checkNickname(w, r, room, nickname) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // отключает буферизацию в nginx
+	w.WriteHeader(http.StatusOK)
+
+	session := randomHex(16)
+	fmt.Fprintf(w, "event: session\ndata: {\"session\":%q}\n\n", session)
+	flusher.Flush()
+
+	conn := sseTransport{w: w, flusher: flusher, done: make(chan struct{}), once: &sync.Once{}}
+	client := connectClient(r, conn, protocol, room, nickname, identity)
+
+	sseMutex.Lock()
+	sseSessions[session] = client
+	sseMutex.Unlock()
+	defer func() {
+		sseMutex.Lock()
+		delete(sseSessions, session)
+		sseMutex.Unlock()
+		disconnectClient(client)
+	}()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case f, ok := <-client.Send:
+			if !ok {
+				return
+			}
+			if err := client.writeFrame(f); err != nil {
+				slog.Warn("Ошибка при отправке сообщения", "err", err)
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-conn.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// SSESendHandler принимает сообщение от клиента SSE и обрабатывает его так же,
+// как сообщение из WebSocket. Сессия принимается только от той же личности.
+// Отказ дублируется в ответе, так как клиент версии 0 не получает кадров error.
+func SSESendHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	session := r.URL.Query().Get("session")
+	if !requireAllowedOrigin(w, r) {
+		return
+	}
+
+	identity, _ := identityFromRequest(r)
+	sseMutex.Lock()
+	client := sseSessions[session]
+	sseMutex.Unlock()
+	if client == nil || client.Room != room || client.Identity != identity {
+		writeAPIError(w, http.StatusNotFound, "session_not_found", "Сессия не найдена")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSSEMessageSize))
+	if err != nil {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", "Сообщение слишком большое")
+		return
+	}
+	if err := client.handleData(data); err != nil {
+		status := http.StatusUnprocessableEntity
+		perr, ok := err.(*ProtocolError)
+		if !ok {
+			perr = protocolError(ErrBadRequest, "%s", err.Error())
+		}
+		switch perr.Code {
+		case ErrRateLimited:
+			status = http.StatusTooManyRequests
+		case ErrForbidden:
+			status = http.StatusForbidden
+		case ErrBadRequest, ErrUnsupportedVersion, ErrUnknownOp:
+			status = http.StatusBadRequest
+		}
+		writeAPIError(w, status, perr.Code, perr.Message)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CloseSSESessions завершает все потоки SSE. Вызывается при остановке сервера,
+// иначе долгие запросы задержали бы Shutdown до истечения таймаута.
+func CloseSSESessions() {
+	sseMutex.Lock()
+	defer sseMutex.Unlock()
+	for _, client := range sseSessions {
+		client.Conn.Close()
+	}
+}
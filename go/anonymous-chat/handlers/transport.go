@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"anonymous-chat/codec"
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport доставляет сообщения одному клиенту. Хаб и обработчики работают
+// с Client и не зависят от того, подключён он через WebSocket или SSE.
+type Transport interface {
+	Codec() codec.Codec      // формат сообщений; nil для JSON
+	Write(data []byte) error // записывает одно сообщение, закодированное в формате Codec
+	Close() error
+	Kind() string // название транспорта для логов
+}
+
+// encodeMessage кодирует сообщение протокола в формате транспорта
+func encodeMessage(c codec.Codec, v interface{}) ([]byte, error) {
+	if c == nil {
+		return json.Marshal(v)
+	}
+	return c.Marshal(v)
+}
+
+// wsTransport — транспорт поверх соединения WebSocket.
+// Если при подключении согласован бинарный подпротокол, сообщения кодируются им,
+// иначе передаются текстовыми кадрами JSON.
+type wsTransport struct {
+	conn  *websocket.Conn
+	codec codec.Codec // nil для JSON
+}
+
+func (t wsTransport) Codec() codec.Codec { return t.codec }
+
+func (t wsTransport) Write(data []byte) error {
+	if t.codec == nil {
+		return t.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Read читает кадр клиента. При бинарном подпротоколе текстовый кадр
+// отклоняется ошибкой *ProtocolError, соединение при этом остаётся открытым.
+func (t wsTransport) Read() ([]byte, error) {
+	kind, data, err := t.conn.ReadMessage()
+	if err != nil || t.codec == nil {
+		return data, err
+	}
+	if kind != websocket.BinaryMessage {
+		return nil, protocolError(ErrBadRequest, "ожидался бинарный кадр %s", t.codec.Name())
+	}
+	return data, nil
+}
+
+func (t wsTransport) Close() error { return t.conn.Close() }
+
+func (t wsTransport) Kind() string {
+	if t.codec != nil {
+		return "websocket/" + t.codec.Name()
+	}
+	return "websocket"
+}
+
+// connectClient регистрирует клиента в комнате и отправляет ему приветствие протокола,
+// историю и отметки о прочтении
+func connectClient(r *http.Request, conn Transport, protocol int, room, nickname, identity string) *Client {
+	encrypted, err := roomEncrypted(context.Background(), room)
+	if err != nil {
+		slog.Error("Ошибка при получении настроек комнаты", "err", err, logging.Room(room))
+	}
+
+	client := &Client{
+		Conn:      conn,
+		Send:      make(chan Frame, models.Config.SendBuffer), // Буферизованный канал
+		Room:      room,
+		Nick:      nickname,
+		Identity:  identity,
+		Encrypted: encrypted,
+		Protocol:  protocol,
+	}
+
+	joined, err := joinRoom(context.Background(), identity, room, nickname)
+	if err != nil {
+		slog.Error("Ошибка при добавлении участника в комнату", "err", err, logging.Room(room))
+	} else if joined {
+		go emitWebhookEvent(room, EventMemberJoined, struct {
+			Nickname string `json:"nickname"`
+		}{Nickname: nickname})
+	}
+
+	// Добавление клиента в комнату
+	mutex.Lock()
+	if clients[room] == nil {
+		clients[room] = make(map[*Client]bool)
+	}
+	clients[room][client] = true
+	mutex.Unlock()
+
+	slog.Info("Клиент подключен", logging.Nick(nickname), logging.Room(room), logging.IP(r.RemoteAddr),
+		"transport", conn.Kind(), "protocol", protocol)
+
+	if protocol != legacyProtocol {
+		client.sendFrame(Frame{Op: OpHello, Payload: hello{Version: protocol, Versions: supportedProtocols}})
+	}
+
+	// Отправка истории сообщений и отметок о прочтении из базы данных
+	sendHistory(client)
+	sendReceipts(client)
+	return client
+}
+
+// disconnectClient закрывает соединение и удаляет клиента из комнаты
+func disconnectClient(c *Client) {
+	c.Conn.Close()
+	mutex.Lock()
+	delete(clients[c.Room], c)
+	mutex.Unlock()
+	slog.Info("Клиент отключен", logging.Nick(c.Nick), logging.Room(c.Room))
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"anonymous-chat/models"
+	"anonymous-chat/storage"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Сборка мусора в директории загрузок
+const (
+	uploadGCInterval  = 10 * time.Minute
+	uploadGCBatchSize = 100
+	// Файл без ссылок удаляется не сразу: между загрузкой и сохранением
+	// сообщения, которое на него сошлётся, проходит некоторое время
+	uploadGCGrace = time.Hour
+)
+
+// Файлы с адресом по содержимому никогда не меняются и кэшируются на год
+const uploadCacheControl = "public, max-age=31536000, immutable"
+
+// Срок действия подписанной ссылки при отдаче /uploads перенаправлением.
+// Ответ с перенаправлением кэшируется браузером на меньший срок.
+const (
+	uploadPresignTTL     = time.Hour
+	uploadRedirectMaxAge = 50 * time.Minute
+	uploadStoreOpTimeout = 5 * time.Minute
+)
+
+var (
+	blobs          storage.Store
+	uploadRedirect bool // отдавать /uploads перенаправлением на подписанную ссылку
+)
+
+// SetBlobStore задаёт хранилище загрузок. При redirect запросы к /uploads
+// перенаправляются на подписанные ссылки хранилища, если оно их поддерживает;
+// источник ссылок добавляется в CSP страниц.
+func SetBlobStore(store storage.Store, redirect bool) {
+	blobs = store
+	uploadRedirect = false
+	mediaOrigin = ""
+	if p, ok := store.(storage.Presigner); ok && redirect {
+		uploadRedirect = true
+		mediaOrigin = p.Origin()
+	}
+}
+
+// saveUpload сохраняет содержимое в хранилище под именем из SHA-256
+// содержимого с указанным расширением и возвращает имя файла. Одинаковые файлы
+// хранятся один раз; ссылки на файл из сообщений считает база данных.
+func saveUpload(src io.Reader, ext string) (string, error) {
+	// Имя объекта известно только после чтения всего содержимого, поэтому
+	// оно сначала пишется во временный файл, а хеш считается по ходу записи
+	tmp, err := os.CreateTemp("", "chat-upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	filename := sum + ext
+
+	// Запись в базе защищает файл от сборки мусора, пока на него не сослалось сообщение.
+	// Если сборщик как раз удаляет этот файл, вставка дождётся конца его транзакции.
+	_, err = models.DB.Exec(context.Background(), `
+		INSERT INTO uploads(filename, size) VALUES($1, $2)
+		ON CONFLICT (filename) DO UPDATE SET updated_at = NOW()`,
+		filename, size)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadStoreOpTimeout)
+	defer cancel()
+	// Существующий объект заменяется идентичным
+	if err := blobs.Put(ctx, filename, tmp, size, sum, mime.TypeByExtension(ext)); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// contentHash возвращает SHA-256 из имени файла с адресом по содержимому.
+// Файлы, загруженные до перехода на такие имена, хеша не имеют.
+func contentHash(filename string) (string, bool) {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if len(stem) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(stem); err != nil {
+		return "", false
+	}
+	return stem, true
+}
+
+// UploadsHandler отдаёт загруженные файлы. Список директории и служебные
+// файлы недоступны. Файлы с адресом по содержимому получают ETag из хеша
+// и кэшируются без повторной проверки. Для хранилища с подписанными ссылками
+// в режиме перенаправления клиент скачивает файл из хранилища напрямую.
+func UploadsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, uploadsURLPrefix)
+		if !storage.ValidName(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		disposition := uploadDisposition(name, r.URL.Query().Get("name"))
+		if uploadRedirect {
+			location, err := blobs.(storage.Presigner).PresignGet(name, uploadPresignTTL, disposition)
+			if err != nil {
+				slog.Error("Ошибка при подписи ссылки на файл", "err", err, "file", name)
+				http.Error(w, "Ошибка хранилища", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(uploadRedirectMaxAge.Seconds())))
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+
+		f, info, err := blobs.Open(r.Context(), name)
+		if errors.Is(err, storage.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			slog.Error("Ошибка при открытии файла в хранилище", "err", err, "file", name)
+			http.Error(w, "Ошибка хранилища", http.StatusBadGateway)
+			return
+		}
+		defer f.Close()
+
+		if hash, ok := contentHash(name); ok {
+			w.Header().Set("ETag", `"`+hash+`"`)
+			w.Header().Set("Cache-Control", uploadCacheControl)
+		}
+		w.Header().Set("Content-Disposition", disposition)
+		// Тип по расширению избавляет ServeContent от чтения начала файла
+		if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		// ServeContent сам отвечает 304 на If-None-Match и поддерживает Range
+		http.ServeContent(w, r, name, info.ModTime, f)
+	})
+}
+
+// Расширения файлов, которые браузер может показать на странице; остальные
+// (документы, архивы, текст, зашифрованные блоки) только скачиваются
+var inlineUploadExts = map[string]bool{
+	".jpg": true, ".png": true,
+	".mp3": true, ".wav": true, ".ogg": true, ".webm": true, ".mp4": true,
+}
+
+// uploadDisposition формирует Content-Disposition для файла. Имя для сохранения
+// берётся из параметра name ссылки (адрес файла — хеш содержимого, исходное имя
+// хранится в сообщении); кавычки и символы вне ASCII кодируются по RFC 2231.
+// Параметр name может подставить кто угодно, поэтому расширение в нём всегда
+// заменяется расширением сохранённого файла, определённым по содержимому:
+// текстовый файл не скачается как update.bat или invoice.html.
+func uploadDisposition(stored, requested string) string {
+	dispositionType := "attachment"
+	if inlineUploadExts[strings.ToLower(filepath.Ext(stored))] {
+		dispositionType = "inline"
+	}
+	filename := stored
+	if requested != "" {
+		name := attachmentFilename(requested)
+		filename = strings.TrimSuffix(name, filepath.Ext(name)) + filepath.Ext(stored)
+	}
+	disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": filename})
+	if disposition == "" {
+		return dispositionType
+	}
+	return disposition
+}
+
+// RunUploadGC периодически удаляет загрузки, на которые не ссылается ни одно сообщение.
+// Строки резервируются через SKIP LOCKED, поэтому сборщик может работать в нескольких репликах.
+func RunUploadGC() {
+	ticker := time.NewTicker(uploadGCInterval)
+	defer ticker.Stop()
+
+	for {
+		// Если пачка заполнена целиком, вероятно, есть ещё файлы
+		if collectUploads() == uploadGCBatchSize {
+			continue
+		}
+		expireResumableUploads()
+		<-ticker.C
+	}
+}
+
+// collectUploads удаляет одну пачку файлов без ссылок и возвращает её размер
+func collectUploads() int {
+	ctx := context.Background()
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		slog.Error("Ошибка при начале транзакции", "err", err)
+		return 0
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокировка строк не даёт новой загрузке того же содержимого
+	// записать файл, пока сборщик его удаляет
+	rows, err := tx.Query(ctx, `
+		SELECT filename FROM uploads
+		WHERE refcount <= 0 AND updated_at < NOW() - $1 * INTERVAL '1 second'
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`,
+		uploadGCGrace.Seconds(), uploadGCBatchSize)
+	if err != nil {
+		slog.Error("Ошибка при выборке неиспользуемых загрузок", "err", err)
+		return 0
+	}
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		filenames = append(filenames, filename)
+	}
+	rows.Close()
+	if len(filenames) == 0 {
+		return 0
+	}
+
+	// Запись остаётся, если файл удалить не удалось: следующий проход повторит попытку
+	deleted := filenames[:0]
+	for _, filename := range filenames {
+		if err := blobs.Delete(ctx, filename); err != nil {
+			slog.Error("Ошибка при удалении файла", "err", err, "file", filename)
+			continue
+		}
+		deleted = append(deleted, filename)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM uploads WHERE filename = ANY($1)", deleted); err != nil {
+		slog.Error("Ошибка при удалении записей загрузок", "err", err)
+		return 0
+	}
+	if err := tx.Commit(ctx); err != nil {
+		slog.Error("Ошибка при фиксации транзакции", "err", err)
+		return 0
+	}
+	slog.Info("Удалены неиспользуемые загрузки", "count", len(deleted))
+	return len(deleted)
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import "testing"
+
+func TestUploadDisposition(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		stored, requested string
+		want              string
+	}{
+		{hash + ".pdf", "", `attachment; filename=` + hash + `.pdf`},
+		{hash + ".pdf", "report.pdf", `attachment; filename=report.pdf`},
+		{hash + ".jpg", "photo.JPG", `inline; filename=photo.jpg`},
+		// Расширение из ссылки не должно менять тип сохраняемого файла
+		{hash + ".txt", "update.bat", `attachment; filename=update.txt`},
+		{hash + ".txt", "invoice.html", `attachment; filename=invoice.txt`},
+		{hash + ".txt", "archive.tar.gz", `attachment; filename=archive.tar.txt`},
+		{hash + ".zip", "no-extension", `attachment; filename=no-extension.zip`},
+		{hash + ".pdf", "../../etc/passwd", `attachment; filename=passwd.pdf`},
+		{hash + ".pdf", "отчёт.pdf", `attachment; filename*=utf-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.pdf`},
+		{hash + ".pdf", "a\"b.pdf", `attachment; filename="a\"b.pdf"`},
+	}
+	for _, tt := range tests {
+		if got := uploadDisposition(tt.stored, tt.requested); got != tt.want {
+			t.Errorf("uploadDisposition(%q, %q) = %s, want %s", tt.stored, tt.requested, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"anonymous-chat/logging"
+	"anonymous-chat/models"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+)
+
+// События комнаты, на которые можно подписать вебхук
+const (
+	EventMessagePosted = "message.posted"
+	EventFileUploaded  = "file.uploaded"
+	EventMemberJoined  = "member.joined"
+	EventPing          = "ping" // тестовое событие, отправляется вручную
+)
+
+var webhookEvents = []string{EventMessagePosted, EventFileUploaded, EventMemberJoined}
+
+// Статусы доставки
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Параметры доставки вебхуков
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 2 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 10
+	// На это время доставка резервируется за обработчиком. Пачка отправляется
+	// последовательно, поэтому резерв должен пережить её целиком, иначе другая
+	// реплика заберёт ещё не отправленные доставки и отправит их повторно
+	webhookLease = 2 * webhookBatchSize * webhookTimeout
+)
+
+// Webhook описывает подписку комнаты на события
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // отдаётся только при создании
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery описывает запись журнала доставки
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	Event          string     `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `json:"last_error"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// webhookPayload — тело запроса, которое получает подписчик
+type webhookPayload struct {
+	Event     string      `json:"event"`
+	Room      string      `json:"room"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Сигнал обработчику о появлении новых доставок
+var webhookWake = make(chan struct{}, 1)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// signWebhook вычисляет подпись HMAC-SHA256 от "<timestamp>.<тело>"
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff возвращает задержку перед следующей попыткой
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookBaseBackoff << (attempts - 1)
+	if delay <= 0 || delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// wakeWebhookWorker будит обработчик, не блокируясь
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// emitWebhookEvent ставит событие в очередь доставки для всех подписанных вебхуков комнаты.
+// Вызывается асинхронно, чтобы не задерживать рассылку сообщений.
+func emitWebhookEvent(room, event string, data interface{}) {
+	ctx := context.Background()
+	body, err := json.Marshal(webhookPayload{Event: event, Room: room, Timestamp: time.Now(), Data: data})
+	if err != nil {
+		slog.Error("Ошибка при формировании события вебхука", "err", err)
+		return
+	}
+
+	tag, err := models.DB.Exec(ctx, `
+		INSERT INTO webhook_deliveries(webhook_id, event, payload)
+		SELECT w.id, $2, $3
+		FROM webhooks w
+		JOIN rooms r ON w.room_id = r.id
+		WHERE r.name = $1 AND $2 = ANY(w.events)`,
+		room, event, string(body))
+	if err != nil {
+		slog.Error("Ошибка при постановке события вебхука в очередь", "err", err, logging.Room(room))
+		return
+	}
+	if tag.RowsAffected() > 0 {
+		wakeWebhookWorker()
+	}
+}
+
+// emitMessageEvent ставит в очередь событие о сохранённом сообщении.
+// Если сообщение сохранить не удалось (ID равен нулю), событие не отправляется.
+func emitMessageEvent(room string, msg Message) {
+	if msg.ID == 0 {
+		return
+	}
+	event := EventMessagePosted
+	if msg.MediaURL != "" {
+		event = EventFileUploaded
+	}
+	go emitWebhookEvent(room, event, msg)
+}
+
+// RunWebhookWorker доставляет события вебхуков с повторными попытками.
+// Доставки резервируются через SKIP LOCKED, поэтому обработчик может работать в нескольких репликах.
+func RunWebhookWorker() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Если пачка заполнена целиком, в очереди, вероятно, есть ещё доставки
+		if deliverDueWebhooks() == webhookBatchSize {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+// dueDelivery описывает доставку, зарезервированную обработчиком
+type dueDelivery struct {
+	id       int64
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverDueWebhooks резервирует и доставляет пачку доставок, срок которых наступил.
+// Возвращает число обработанных доставок.
+func deliverDueWebhooks() int {
+	ctx := context.Background()
+	rows, err := models.DB.Query(ctx, `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE d.webhook_id = w.id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret`,
+		webhookLease.Seconds(), DeliveryPending, webhookBatchSize)
+	if err != nil {
+		slog.Error("Ошибка при выборке доставок вебхуков", "err", err)
+		return 0
+	}
+
+	var due []dueDelivery
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		statusCode, err := sendWebhook(d)
+		recordDelivery(d, statusCode, err)
+	}
+	return len(due)
+}
+
+// sendWebhook выполняет одну попытку доставки
+func sendWebhook(d dueDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := []byte(d.payload)
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "anonymous-chat-webhooks/1")
+	req.Header.Set("X-Webhook-Event", d.event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("получатель ответил %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordDelivery записывает результат попытки в журнал и планирует повтор
+func recordDelivery(d dueDelivery, statusCode int, sendErr error) {
+	attempts := d.attempts + 1
+	status := DeliverySucceeded
+	errText := ""
+	next := time.Now()
+	var deliveredAt *time.Time
+	if sendErr != nil {
+		errText = sendErr.Error()
+		status = DeliveryPending
+		next = time.Now().Add(webhookBackoff(attempts))
+		if attempts >= webhookMaxAttempts {
+			status = DeliveryFailed
+		}
+		slog.Warn("Ошибка доставки вебхука", "delivery", d.id, "attempt", attempts, "err", sendErr)
+	} else {
+		deliveredAt = &next
+	}
+
+	_, err := models.DB.Exec(context.Background(), `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_status_code = $4, last_error = $5,
+			next_attempt_at = $6, delivered_at = $7
+		WHERE id = $1`,
+		d.id, status, attempts, statusCode, errText, next, deliveredAt)
+	if err != nil {
+		slog.Error("Ошибка при записи результата доставки", "err", err)
+	}
+}
+
+// validateWebhookURL проверяет адрес получателя
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("URL должен быть абсолютным адресом http или https")
+	}
+	return nil
+}
+
+// APICreateWebhookHandler регистрирует вебхук комнаты; секрет для проверки подписи возвращается один раз
+func APICreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	room := mux.Vars(r)["room"]
+
+	var in struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Некорректное тело запроса")
+		return
+	}
+	if err := validateWebhookURL(in.URL); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+	if len(in.Events) == 0 {
+		in.Events = webhookEvents
+	}
+	for _, event := range in.Events {
+		if !slices.Contains(webhookEvents, event) {
+			writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Неизвестное событие: "+event)
+			return
+		}
+	}
+
+	hook := Webhook{URL: in.URL, Events: in.Events, Secret: randomHex(32)}
+	err := models.DB.QueryRow(r.Context(), `
+		INSERT INTO webhooks(room_id, url, events, secret)
+		SELECT id, $2, $3, $4 FROM rooms WHERE name = $1
+		RETURNING id, created_at`,
+		room, hook.URL, hook.Events, hook.Secret).Scan(&hook.ID, &hook.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Комната не найдена")
+		return
+	}
+	if err != nil {
+		slog.Error("Ошибка при создании вебхука", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при создании вебхука")
+		return
+	}
+
+	slog.Info("Вебхук зарегистрирован", logging.Room(room), "webhook", hook.ID)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// APIListWebhooksHandler возвращает вебхуки комнаты без секретов
+func APIListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	room := mux.Vars(r)["room"]
+
+	rows, err := models.DB.Query(r.Context(), `
+		SELECT w.id, w.url, w.events, w.created_at
+		FROM webhooks w JOIN rooms r ON w.room_id = r.id
+		WHERE r.name = $1 ORDER BY w.id`, room)
+	if err != nil {
+		slog.Error("Ошибка при получении вебхуков", "err", err, logging.Room(room))
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении вебхуков")
+		return
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.Events, &hook.CreatedAt); err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}{Webhooks: hooks})
+}
+
+// webhookIDFromRequest возвращает ID вебхука, если он принадлежит комнате из URL
+func webhookIDFromRequest(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err == nil {
+		err = models.DB.QueryRow(r.Context(), `
+			SELECT w.id FROM webhooks w JOIN rooms r ON w.room_id = r.id
+			WHERE w.id = $1 AND r.name = $2`, id, vars["room"]).Scan(&id)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Вебхук не найден")
+		return 0, false
+	}
+	return id, true
+}
+
+// APIDeleteWebhookHandler удаляет вебхук вместе с журналом доставок
+func APIDeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id, ok := webhookIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Журнал доставок удаляется каскадно
+	if _, err := models.DB.Exec(r.Context(), "DELETE FROM webhooks WHERE id = $1", id); err != nil {
+		slog.Error("Ошибка при удалении вебхука", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при удалении вебхука")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIWebhookDeliveriesHandler возвращает журнал последних доставок вебхука
+func APIWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id, ok := webhookIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := models.DB.Query(r.Context(), `
+		SELECT id, event, status, attempts, last_status_code, last_error, next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries WHERE webhook_id = $1
+		ORDER BY id DESC LIMIT 100`, id)
+	if err != nil {
+		slog.Error("Ошибка при получении журнала доставок", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при получении журнала доставок")
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.Event, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError,
+			&d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			slog.Error("Ошибка при сканировании строки", "err", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}{Deliveries: deliveries})
+}
+
+// APIPingWebhookHandler ставит в очередь тестовое событие ping для проверки получателя
+func APIPingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id, ok := webhookIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	body, _ := json.Marshal(webhookPayload{Event: EventPing, Room: room, Timestamp: time.Now(), Data: struct{}{}})
+	var deliveryID int64
+	err := models.DB.QueryRow(r.Context(),
+		"INSERT INTO webhook_deliveries(webhook_id, event, payload) VALUES($1, $2, $3) RETURNING id",
+		id, EventPing, string(body)).Scan(&deliveryID)
+	if err != nil {
+		slog.Error("Ошибка при постановке события вебхука в очередь", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Ошибка при постановке события в очередь")
+		return
+	}
+	wakeWebhookWorker()
+
+	writeJSON(w, http.StatusAccepted, struct {
+		DeliveryID int64 `json:"delivery_id"`
+	}{DeliveryID: deliveryID})
+}
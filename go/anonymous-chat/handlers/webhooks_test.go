@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Доставка проверяется на локальном получателе: заголовки, подпись и тело
+// должны совпадать с тем, что получатель может проверить своим секретом
+func TestSendWebhookToLocalReceiver(t *testing.T) {
+	const secret = "test-secret"
+	payload := `{"event":"message.posted","room":"general"}`
+
+	var got *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	d := dueDelivery{id: 42, event: EventMessagePosted, payload: payload, url: receiver.URL, secret: secret}
+	status, err := sendWebhook(d)
+	if err != nil {
+		t.Fatalf("sendWebhook: %v", err)
+	}
+	if status != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", status, http.StatusNoContent)
+	}
+
+	if got.Method != http.MethodPost {
+		t.Errorf("method = %s, want POST", got.Method)
+	}
+	if string(body) != payload {
+		t.Errorf("body = %s, want %s", body, payload)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":       "application/json",
+		"X-Webhook-Event":    EventMessagePosted,
+		"X-Webhook-Delivery": "42",
+	} {
+		if v := got.Header.Get(header); v != want {
+			t.Errorf("%s = %q, want %q", header, v, want)
+		}
+	}
+
+	timestamp := got.Header.Get("X-Webhook-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("X-Webhook-Timestamp = %q, want current Unix time", timestamp)
+	}
+	if sig := got.Header.Get("X-Webhook-Signature"); sig != signWebhook(secret, timestamp, body) {
+		t.Errorf("X-Webhook-Signature = %q does not match body", sig)
+	}
+}
+
+func TestSendWebhookReceiverErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"accepted", http.StatusAccepted, false},
+		{"not modified", http.StatusNotModified, true},
+		{"client error", http.StatusGone, true},
+		{"server error", http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer receiver.Close()
+
+			status, err := sendWebhook(dueDelivery{id: 1, event: EventPing, payload: "{}", url: receiver.URL + "/hook"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestSendWebhookUnreachable(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	status, err := sendWebhook(dueDelivery{id: 1, event: EventPing, payload: "{}", url: url})
+	if err == nil {
+		t.Fatal("sendWebhook to closed receiver succeeded")
+	}
+	if status != 0 {
+		t.Errorf("status = %d, want 0", status)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// Значение получено независимо: printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	const want = "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := signWebhook("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("signWebhook = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, webhookBaseBackoff},
+		{2, 2 * webhookBaseBackoff},
+		{4, 8 * webhookBaseBackoff},
+		{20, webhookMaxBackoff},
+		{100, webhookMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// Резерв доставки должен пережить отправку всей пачки при таймауте на каждой
+func TestWebhookLeaseCoversBatch(t *testing.T) {
+	if webhookLease <= webhookBatchSize*webhookTimeout {
+		t.Errorf("webhookLease = %v, want more than %v", webhookLease, webhookBatchSize*webhookTimeout)
+	}
+}
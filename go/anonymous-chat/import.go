@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"anonymous-chat/handlers"
+)
+
+// runImport выполняет подкоманду import: восстанавливает комнату из архива экспорта.
+// Возвращает код завершения процесса.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	room := fs.String("room", "", "имя комнаты (по умолчанию из архива)")
+	conflict := fs.String("conflict", handlers.ConflictFail, "действие при существующей комнате: fail, merge или rename")
+	dryRun := fs.Bool("dry-run", false, "только проверить архив, ничего не записывая")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Использование: anonymous-chat import [флаги] <архив.json|архив.zip>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Не удалось прочитать архив:", err)
+		return 1
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Не удалось прочитать архив:", err)
+		return 1
+	}
+
+	result, err := handlers.ImportRoom(context.Background(), f, info.Size(), handlers.ImportOptions{
+		Room:     *room,
+		Conflict: *conflict,
+		DryRun:   *dryRun,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка импорта:", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+	return 0
+}
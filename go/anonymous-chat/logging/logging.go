@@ -0,0 +1,101 @@
+// Package logging настраивает структурированное логирование (log/slog)
+// с режимом приватности для анонимного чата.
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	privacy = true
+	debug   = false
+	salt    []byte
+)
+
+// Setup устанавливает логгер по умолчанию.
+// level — debug, info, warn или error; format — text или json.
+// В режиме приватности ники, комнаты и IP хешируются, а содержимое сообщений скрывается.
+// Пустая соль заменяется случайной, и хеши не сопоставимы между перезапусками.
+func Setup(level, format string, privacyMode bool, hashSalt string) {
+	var lvl slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		lvl = slog.LevelInfo
+	}
+
+	privacy = privacyMode
+	debug = lvl <= slog.LevelDebug
+	if hashSalt != "" {
+		salt = []byte(hashSalt)
+	} else {
+		salt = make([]byte, 32)
+		rand.Read(salt)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	if strings.ToLower(format) == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// hash возвращает укороченный HMAC-SHA256 значения
+func hash(value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// identity возвращает атрибут с идентификатором, хешированным в режиме приватности
+func identity(key, value string) slog.Attr {
+	if privacy {
+		return slog.String(key, hash(value))
+	}
+	return slog.String(key, value)
+}
+
+// Nick возвращает атрибут с ником участника
+func Nick(nick string) slog.Attr {
+	return identity("nick", nick)
+}
+
+// Room возвращает атрибут с именем комнаты
+func Room(room string) slog.Attr {
+	return identity("room", room)
+}
+
+// IP возвращает атрибут с IP-адресом клиента (порт отбрасывается)
+func IP(remoteAddr string) slog.Attr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return identity("ip", host)
+}
+
+// Content возвращает атрибут с содержимым сообщения или имени файла.
+// Текст пишется только при уровне debug и выключенном режиме приватности,
+// иначе в лог попадает лишь его длина.
+func Content(content string) slog.Attr {
+	if debug && !privacy {
+		return slog.String("content", content)
+	}
+	return slog.String("content", fmt.Sprintf("[скрыто, %d байт]", len(content)))
+}
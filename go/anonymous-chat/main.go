@@ -1,45 +1,261 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"anonymous-chat/bots"
+	"anonymous-chat/certs"
 	"anonymous-chat/handlers"
+	"anonymous-chat/logging"
 	"anonymous-chat/models"
+	"anonymous-chat/storage"
 
 	"github.com/gorilla/mux"
 )
 
+// Время между переходом в режим остановки и закрытием слушателя,
+// за которое балансировщик успевает заметить неготовность
+const shutdownDrainDelay = 5 * time.Second
+
+// Интервал проверки файлов TLS-сертификата на изменение
+const certReloadInterval = 30 * time.Second
+
 func main() {
+	// Загрузка конфигурации и настройка логирования
+	args, err := models.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка конфигурации:", err)
+		os.Exit(2)
+	}
+	logging.Setup(models.Config.LogLevel, models.Config.LogFormat, models.Config.LogPrivacy, models.Config.LogHashSalt)
+
+	// Типы вложений разбираются один раз; формат проверен при загрузке конфигурации
+	attachmentLimits, _ := models.Config.AttachmentLimits()
+	if err := handlers.SetAttachmentTypes(attachmentLimits); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка конфигурации: attachment_types:", err)
+		os.Exit(2)
+	}
+
+	// Подкоманды выполняются вместо запуска сервера
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = args[0]
+	}
+	switch subcommand {
+	case "":
+	case "config":
+		// Итоговая конфигурация после всех слоёв, без секретов
+		if err := models.Config.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Ошибка вывода конфигурации:", err)
+			os.Exit(1)
+		}
+		return
+	case "import":
+	default:
+		fmt.Fprintf(os.Stderr, "Неизвестная подкоманда %q\n", subcommand)
+		os.Exit(2)
+	}
+
 	// Инициализация базы данных
 	models.InitDB()
 	defer models.DB.Close()
+	models.Migrate()
+
+	// Хранилище загрузок нужно и импорту, который сохраняет файлы из архива
+	store, err := newBlobStore()
+	if err != nil {
+		slog.Error("Не удалось открыть хранилище загрузок", "err", err)
+		os.Exit(1)
+	}
+	handlers.SetBlobStore(store, models.Config.UploadsServe == "redirect")
+
+	if subcommand == "import" {
+		os.Exit(runImport(args[1:]))
+	}
+
+	// Регистрация встроенных ботов; в комнатах они включаются через API
+	handlers.RegisterBot(bots.Dice{})
+	handlers.RegisterBot(bots.Calc{})
+	handlers.RegisterBot(bots.NewPoll())
+	handlers.RegisterBot(bots.NewReminder())
 
 	// Создание нового маршрутизатора
 	router := mux.NewRouter()
 
-	// Маршруты для WebSocket и страниц
+	// Проверки живости и готовности
+	router.HandleFunc("/healthz", handlers.LivenessHandler).Methods("GET")
+	router.HandleFunc("/readyz", handlers.ReadinessHandler).Methods("GET")
+
+	// Маршруты для WebSocket, резервного транспорта SSE и страниц
 	router.HandleFunc("/ws/{room}", handlers.ChatHandler)
-	router.HandleFunc("/chat/{room}", handlers.ChatPageHandler)
-	router.HandleFunc("/", handlers.IndexHandler).Methods("GET", "POST")
+	router.HandleFunc("/sse/{room}", handlers.SSEHandler).Methods("GET")
+	router.HandleFunc("/sse/{room}/send", handlers.SSESendHandler).Methods("POST")
+	router.HandleFunc("/chat/{room}", handlers.PageSecurityHeaders(handlers.ChatPageHandler))
+	router.HandleFunc("/", handlers.PageSecurityHeaders(handlers.IndexHandler)).Methods("GET", "POST")
+
+	// JSON API комнат
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/rooms", handlers.APIListRoomsHandler).Methods("GET")
+	api.HandleFunc("/rooms", handlers.APICreateRoomHandler).Methods("POST")
+	api.HandleFunc("/rooms/{room}", handlers.APIGetRoomHandler).Methods("GET")
+	api.HandleFunc("/rooms/{room}", handlers.APIUpdateRoomHandler).Methods("PATCH", "PUT")
+	api.HandleFunc("/rooms/{room}", handlers.APIDeleteRoomHandler).Methods("DELETE")
+	api.HandleFunc("/rooms/{room}/read", handlers.APIMarkReadHandler).Methods("POST")
+	api.HandleFunc("/rooms/{room}/export", handlers.ExportRoomHandler).Methods("GET")
+	api.HandleFunc("/me/rooms", handlers.APIJoinedRoomsHandler).Methods("GET")
+
+	// Публикация сообщений ботами (требует токена бота)
+	api.HandleFunc("/rooms/{room}/messages", handlers.APIBotPostHandler).Methods("POST")
+
+	// Административные маршруты (требуют ADMIN_TOKEN)
+	api.HandleFunc("/admin/import", handlers.ImportRoomHandler).Methods("POST")
+	api.HandleFunc("/rooms/{room}/webhooks", handlers.APIListWebhooksHandler).Methods("GET")
+	api.HandleFunc("/rooms/{room}/webhooks", handlers.APICreateWebhookHandler).Methods("POST")
+	api.HandleFunc("/rooms/{room}/webhooks/{id}", handlers.APIDeleteWebhookHandler).Methods("DELETE")
+	api.HandleFunc("/rooms/{room}/webhooks/{id}/deliveries", handlers.APIWebhookDeliveriesHandler).Methods("GET")
+	api.HandleFunc("/rooms/{room}/webhooks/{id}/ping", handlers.APIPingWebhookHandler).Methods("POST")
+	api.HandleFunc("/rooms/{room}/bots", handlers.APIListBotTokensHandler).Methods("GET")
+	api.HandleFunc("/rooms/{room}/bots", handlers.APICreateBotTokenHandler).Methods("POST")
+	api.HandleFunc("/rooms/{room}/bots/{id}", handlers.APIRevokeBotTokenHandler).Methods("DELETE")
+	api.HandleFunc("/rooms/{room}/builtin-bots", handlers.APIListBuiltinBotsHandler).Methods("GET")
+	api.HandleFunc("/rooms/{room}/builtin-bots/{name}", handlers.APIEnableBuiltinBotHandler).Methods("PUT")
+	api.HandleFunc("/rooms/{room}/builtin-bots/{name}", handlers.APIDisableBuiltinBotHandler).Methods("DELETE")
 
 	// Маршруты для загрузки файлов
 	router.HandleFunc("/upload-image", handlers.ImageUploadHandler).Methods("POST")
 	router.HandleFunc("/upload-voice", handlers.VoiceUploadHandler).Methods("POST")
+	router.HandleFunc("/upload-file", handlers.FileUploadHandler).Methods("POST")
+
+	// Загрузка по частям с возобновлением (протокол tus)
+	router.HandleFunc("/upload-resumable", handlers.ResumableOptionsHandler).Methods("OPTIONS")
+	router.HandleFunc("/upload-resumable", handlers.ResumableCreateHandler).Methods("POST")
+	router.HandleFunc("/upload-resumable/{id}", handlers.ResumableOptionsHandler).Methods("OPTIONS")
+	router.HandleFunc("/upload-resumable/{id}", handlers.ResumableHeadHandler).Methods("HEAD")
+	router.HandleFunc("/upload-resumable/{id}", handlers.ResumablePatchHandler).Methods("PATCH")
+	router.HandleFunc("/upload-resumable/{id}", handlers.ResumableDeleteHandler).Methods("DELETE")
 
 	// Обслуживание статических файлов
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 
-	// Обслуживание загруженных файлов
-	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads/"))))
+	// Обслуживание загруженных файлов; заголовки не дают выполнить загруженный файл как страницу сайта
+	router.PathPrefix("/uploads/").Handler(handlers.UploadSecurityHeaders(handlers.UploadsHandler())).Methods("GET", "HEAD")
 
 	// Запуск обработчика сообщений
 	go handlers.HandleMessages()
 
+	// Запуск доставки вебхуков
+	go handlers.RunWebhookWorker()
+
+	// Запуск удаления загрузок, на которые не ссылаются сообщения
+	go handlers.RunUploadGC()
+
 	// Запуск сервера
-	log.Println("Сервер запущен на порту:", models.Config.Port)
-	err := http.ListenAndServe(":"+models.Config.Port, router)
-	if err != nil {
-		log.Fatal("Ошибка запуска сервера: ", err)
+	server := &http.Server{
+		Addr:    ":" + models.Config.Port,
+		Handler: router,
+	}
+	server.RegisterOnShutdown(handlers.CloseSSESessions)
+
+	// TLS включается, если заданы сертификат и ключ (наличие обоих проверено при загрузке конфигурации)
+	tlsEnabled := models.Config.TLSCertFile != ""
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if tlsEnabled {
+		reloader, err := certs.NewReloader(models.Config.TLSCertFile, models.Config.TLSKeyFile)
+		if err != nil {
+			slog.Error("Не удалось загрузить сертификат TLS", "err", err)
+			os.Exit(1)
+		}
+		go reloader.Watch(watchCtx, certReloadInterval)
+
+		// При запуске через ServeTLS net/http сам включает HTTP/2. WebSocket
+		// по HTTP/2 сервер не поддерживает, поэтому браузеры открывают для него
+		// отдельное соединение HTTP/1.1, а страницы, API и SSE идут по HTTP/2.
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+
+	go func() {
+		slog.Info("Сервер запущен", "port", models.Config.Port, "tls", tlsEnabled)
+		var err error
+		if tlsEnabled {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Ошибка запуска сервера", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Перенаправление с HTTP на HTTPS
+	var redirectServer *http.Server
+	if models.Config.HTTPRedirectPort != "" {
+		redirectServer = &http.Server{
+			Addr:              ":" + models.Config.HTTPRedirectPort,
+			Handler:           handlers.HTTPSRedirect(models.Config.Port),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Перенаправление HTTP на HTTPS запущено", "port", models.Config.HTTPRedirectPort)
+			err := redirectServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Ошибка запуска перенаправления HTTP", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Ожидание сигнала остановки
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	// Сначала /readyz начинает возвращать ошибку, чтобы балансировщик
+	// перестал направлять новые подключения, затем сервер останавливается
+	slog.Info("Получен сигнал остановки, сервер больше не готов принимать подключения")
+	handlers.SetShuttingDown()
+	time.Sleep(shutdownDrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Ошибка при остановке сервера", "err", err)
+	}
+	slog.Info("Сервер остановлен")
+}
+
+// newBlobStore создаёт хранилище загрузок по конфигурации
+func newBlobStore() (storage.Store, error) {
+	if models.Config.StorageBackend != "s3" {
+		return storage.NewFS(models.Config.UploadDir)
 	}
+	return storage.NewS3(storage.S3Config{
+		Endpoint:  models.Config.S3Endpoint,
+		Region:    models.Config.S3Region,
+		Bucket:    models.Config.S3Bucket,
+		Prefix:    models.Config.S3Prefix,
+		AccessKey: models.Config.S3AccessKey,
+		SecretKey: models.Config.S3SecretKey,
+		PathStyle: models.Config.S3PathStyle,
+	})
 }
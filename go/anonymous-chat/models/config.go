@@ -0,0 +1,432 @@
+package models
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigStruct хранит конфигурацию приложения.
+//
+// Значения собираются слоями, каждый следующий переопределяет предыдущий:
+// значения по умолчанию, файл YAML (-config или CONFIG_FILE), переменные
+// окружения (включая .env) и флаги командной строки.
+//
+// Тег yaml задаёт ключ в файле, env — переменную окружения, usage — описание
+// флага. Имя флага совпадает с ключом файла, только с дефисами вместо
+// подчёркиваний. Поля с тегом secret при выводе конфигурации маскируются.
+type ConfigStruct struct {
+	Port       string `yaml:"port" env:"PORT" usage:"порт HTTP-сервера (HTTPS при включённом TLS)"`
+	DBHost     string `yaml:"db_host" env:"DB_HOST" usage:"адрес PostgreSQL"`
+	DBPort     string `yaml:"db_port" env:"DB_PORT" usage:"порт PostgreSQL"`
+	DBUser     string `yaml:"db_user" env:"DB_USER" usage:"пользователь PostgreSQL"`
+	DBPassword string `yaml:"db_password" env:"DB_PASSWORD" usage:"пароль PostgreSQL" secret:"true"`
+	DBName     string `yaml:"db_name" env:"DB_NAME" usage:"имя базы данных"`
+
+	// Логирование
+	LogLevel    string `yaml:"log_level" env:"LOG_LEVEL" usage:"уровень логирования: debug, info, warn или error"`
+	LogFormat   string `yaml:"log_format" env:"LOG_FORMAT" usage:"формат логов: text или json"`
+	LogPrivacy  bool   `yaml:"log_privacy" env:"LOG_PRIVACY" usage:"скрывать содержимое и хешировать идентификаторы"`
+	LogHashSalt string `yaml:"log_hash_salt" env:"LOG_HASH_SALT" usage:"соль для хеширования ников, комнат и IP" secret:"true"`
+
+	// Токен администратора; пустой токен отключает административные эндпоинты
+	AdminToken string `yaml:"admin_token" env:"ADMIN_TOKEN" usage:"токен административного API" secret:"true"`
+
+	// Безопасность браузерных запросов
+	AllowedOrigins []string `yaml:"allowed_origins" env:"ALLOWED_ORIGINS" usage:"источники, кроме собственного, с которых разрешены WebSocket, SSE и загрузки, через запятую; * разрешает любые"`
+	CSRFSecret     string   `yaml:"csrf_secret" env:"CSRF_SECRET" usage:"ключ подписи CSRF-токенов; пустой ключ генерируется при запуске" secret:"true"`
+
+	// TLS включается, если заданы сертификат и ключ; тогда PORT — порт HTTPS
+	TLSCertFile      string `yaml:"tls_cert_file" env:"TLS_CERT_FILE" usage:"файл сертификата TLS"`
+	TLSKeyFile       string `yaml:"tls_key_file" env:"TLS_KEY_FILE" usage:"файл закрытого ключа TLS"`
+	HTTPRedirectPort string `yaml:"http_redirect_port" env:"HTTP_REDIRECT_PORT" usage:"порт HTTP, с которого запросы перенаправляются на HTTPS; пустой — не слушать"`
+
+	// Чат и загрузки
+	UploadDir         string   `yaml:"upload_dir" env:"UPLOAD_DIR" usage:"директория загруженных файлов"`
+	MaxUploadBytes    int64    `yaml:"max_upload_bytes" env:"MAX_UPLOAD_BYTES" usage:"максимальный размер загружаемого файла в байтах"`
+	MaxResumableBytes int64    `yaml:"max_resumable_upload_bytes" env:"MAX_RESUMABLE_UPLOAD_BYTES" usage:"максимальный размер файла при загрузке по частям в байтах"`
+	SendBuffer        int      `yaml:"send_buffer" env:"SEND_BUFFER" usage:"размер очереди отправки клиента; при переполнении сообщения пропускаются"`
+	HistoryLimit      int      `yaml:"history_limit" env:"HISTORY_LIMIT" usage:"сколько последних сообщений отправлять при входе в комнату; 0 — всю историю"`
+	TimestampFormat   string   `yaml:"timestamp_format" env:"TIMESTAMP_FORMAT" usage:"формат времени сообщений в нотации Go"`
+	AttachmentTypes   []string `yaml:"attachment_types" env:"ATTACHMENT_TYPES" usage:"типы файлов-вложений через запятую, только из распознаваемых по содержимому; после = можно указать предельный размер с суффиксом K, M или G, например video/mp4=200M"`
+
+	// Хранилище загрузок: локальная директория (upload_dir) или S3-совместимый сервис
+	StorageBackend string `yaml:"storage_backend" env:"STORAGE_BACKEND" usage:"хранилище загрузок: fs или s3"`
+	UploadsServe   string `yaml:"uploads_serve" env:"UPLOADS_SERVE" usage:"как отдавать /uploads из S3: proxy — через сервер, redirect — перенаправлением на подписанную ссылку"`
+	S3Endpoint     string `yaml:"s3_endpoint" env:"S3_ENDPOINT" usage:"адрес S3, например https://s3.eu-central-1.amazonaws.com или http://localhost:9000 для MinIO"`
+	S3Region       string `yaml:"s3_region" env:"S3_REGION" usage:"регион S3"`
+	S3Bucket       string `yaml:"s3_bucket" env:"S3_BUCKET" usage:"бакет для загрузок"`
+	S3Prefix       string `yaml:"s3_prefix" env:"S3_PREFIX" usage:"префикс ключей объектов, например uploads/"`
+	S3AccessKey    string `yaml:"s3_access_key" env:"S3_ACCESS_KEY" usage:"идентификатор ключа доступа S3"`
+	S3SecretKey    string `yaml:"s3_secret_key" env:"S3_SECRET_KEY" usage:"секретный ключ доступа S3" secret:"true"`
+	S3PathStyle    bool   `yaml:"s3_path_style" env:"S3_PATH_STYLE" usage:"адресовать бакет в пути, а не в имени хоста (нужно для MinIO)"`
+}
+
+var Config ConfigStruct
+
+// defaultConfig возвращает значения по умолчанию
+func defaultConfig() ConfigStruct {
+	return ConfigStruct{
+		Port:   "8080",
+		DBHost: "localhost",
+		DBPort: "5432",
+		DBName: "chat_app",
+
+		LogLevel:   "info",
+		LogFormat:  "text",
+		LogPrivacy: true,
+
+		UploadDir:         "./uploads",
+		MaxUploadBytes:    10 << 20,
+		MaxResumableBytes: 200 << 20,
+		SendBuffer:        256,
+		TimestampFormat:   "2006-01-02 15:04:05",
+		AttachmentTypes: []string{
+			"application/pdf=20M",
+			"application/zip=50M",
+			"text/plain=1M",
+			"video/mp4=200M",
+			"video/webm=200M",
+		},
+
+		StorageBackend: "fs",
+		UploadsServe:   "proxy",
+		S3Region:       "us-east-1",
+		S3PathStyle:    true,
+	}
+}
+
+// configField связывает поле конфигурации с его тегами
+type configField struct {
+	value  reflect.Value
+	key    string
+	env    string
+	usage  string
+	secret bool
+}
+
+// flagName возвращает имя флага командной строки для поля
+func (f configField) flagName() string {
+	return strings.ReplaceAll(f.key, "_", "-")
+}
+
+// set разбирает строковое значение из окружения или флага
+func (f configField) set(raw string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("ожидается логическое значение, получено %q", raw)
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("ожидается целое число, получено %q", raw)
+		}
+		f.value.SetInt(n)
+	case reflect.Slice:
+		// Список задаётся через запятую; пустые элементы пропускаются
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("неподдерживаемый тип %s", f.value.Type())
+	}
+	return nil
+}
+
+// fields перечисляет поля конфигурации
+func (c *ConfigStruct) fields() []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fields = append(fields, configField{
+			value:  v.Field(i),
+			key:    sf.Tag.Get("yaml"),
+			env:    sf.Tag.Get("env"),
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Tag.Get("secret") == "true",
+		})
+	}
+	return fields
+}
+
+// flagValue — значение флага, применяемое после файла и окружения
+type flagValue struct {
+	field configField
+	raw   string
+}
+
+// LoadConfig собирает конфигурацию из всех слоёв и проверяет её.
+// args — аргументы командной строки без имени программы; возвращаются
+// оставшиеся позиционные аргументы (подкоманда и её параметры).
+// При -h возвращается flag.ErrHelp.
+func LoadConfig(args []string) ([]string, error) {
+	// Загрузка переменных окружения из .env; уже заданные переменные не переопределяются
+	envErr := godotenv.Load()
+
+	cfg := defaultConfig()
+	fields := cfg.fields()
+
+	fs := flag.NewFlagSet("anonymous-chat", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "файл конфигурации YAML")
+	var flags []flagValue
+	for _, f := range fields {
+		record := func(raw string) error {
+			flags = append(flags, flagValue{field: f, raw: raw})
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(f.flagName(), f.usage, record)
+		} else {
+			fs.Func(f.flagName(), f.usage, record)
+		}
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Использование: anonymous-chat [флаги] [config | import ...]")
+		fmt.Fprintln(fs.Output(), "Флаги переопределяют переменные окружения, а те — файл конфигурации.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, fmt.Errorf("файл конфигурации %s: %w", *configFile, err)
+		}
+	}
+
+	var errs []error
+	for _, f := range fields {
+		if raw, ok := os.LookupEnv(f.env); ok && f.env != "" {
+			if err := f.set(raw); err != nil {
+				errs = append(errs, fmt.Errorf("переменная %s: %w", f.env, err))
+			}
+		}
+	}
+	for _, fv := range flags {
+		if err := fv.field.set(fv.raw); err != nil {
+			errs = append(errs, fmt.Errorf("флаг -%s: %w", fv.field.flagName(), err))
+		}
+	}
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	Config = cfg
+	if envErr != nil {
+		slog.Info("Не удалось загрузить .env файл, используем системные переменные")
+	}
+	return fs.Args(), nil
+}
+
+// loadFile применяет значения из файла YAML; неизвестные ключи считаются ошибкой
+func (c *ConfigStruct) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// validate проверяет согласованность конфигурации и возвращает все найденные ошибки
+func (c *ConfigStruct) validate() []error {
+	var errs []error
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if !validPort(c.Port) {
+		fail("port", "некорректный порт %q", c.Port)
+	}
+	if c.DBHost == "" {
+		fail("db_host", "не может быть пустым")
+	}
+	if !validPort(c.DBPort) {
+		fail("db_port", "некорректный порт %q", c.DBPort)
+	}
+	if c.DBName == "" {
+		fail("db_name", "не может быть пустым")
+	}
+
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		fail("log_level", "ожидается debug, info, warn или error, получено %q", c.LogLevel)
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "text", "json":
+	default:
+		fail("log_format", "ожидается text или json, получено %q", c.LogFormat)
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			fail("allowed_origins", "ожидается источник вида https://example.com, получено %q", origin)
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		fail("tls_cert_file", "для TLS нужны и сертификат, и ключ")
+	}
+	if c.HTTPRedirectPort != "" {
+		switch {
+		case !validPort(c.HTTPRedirectPort):
+			fail("http_redirect_port", "некорректный порт %q", c.HTTPRedirectPort)
+		case c.TLSCertFile == "":
+			fail("http_redirect_port", "перенаправление на HTTPS требует TLS")
+		case c.HTTPRedirectPort == c.Port:
+			fail("http_redirect_port", "совпадает с портом сервера")
+		}
+	}
+
+	if c.UploadDir == "" {
+		fail("upload_dir", "не может быть пустым")
+	}
+	if c.MaxUploadBytes <= 0 {
+		fail("max_upload_bytes", "должен быть положительным")
+	}
+	if c.MaxResumableBytes <= 0 {
+		fail("max_resumable_upload_bytes", "должен быть положительным")
+	}
+	if c.SendBuffer <= 0 {
+		fail("send_buffer", "должен быть положительным")
+	}
+	if c.HistoryLimit < 0 {
+		fail("history_limit", "не может быть отрицательным")
+	}
+	if c.TimestampFormat == "" {
+		fail("timestamp_format", "не может быть пустым")
+	}
+	if _, err := c.AttachmentLimits(); err != nil {
+		fail("attachment_types", "%v", err)
+	}
+
+	switch c.StorageBackend {
+	case "fs":
+	case "s3":
+		if u, err := url.Parse(c.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("s3_endpoint", "ожидается адрес вида https://s3.example.com, получено %q", c.S3Endpoint)
+		}
+		if c.S3Region == "" {
+			fail("s3_region", "не может быть пустым")
+		}
+		if c.S3Bucket == "" {
+			fail("s3_bucket", "не может быть пустым")
+		}
+		if c.S3AccessKey == "" || c.S3SecretKey == "" {
+			fail("s3_access_key", "для S3 нужны идентификатор и секретный ключ")
+		}
+	default:
+		fail("storage_backend", "ожидается fs или s3, получено %q", c.StorageBackend)
+	}
+	switch c.UploadsServe {
+	case "proxy":
+	case "redirect":
+		if c.StorageBackend != "s3" {
+			fail("uploads_serve", "перенаправление возможно только для хранилища s3")
+		}
+	default:
+		fail("uploads_serve", "ожидается proxy или redirect, получено %q", c.UploadsServe)
+	}
+	return errs
+}
+
+// AttachmentLimits разбирает attachment_types и возвращает предельный размер
+// для каждого разрешённого типа; 0 — без отдельного ограничения
+func (c *ConfigStruct) AttachmentLimits() (map[string]int64, error) {
+	limits := make(map[string]int64, len(c.AttachmentTypes))
+	for _, entry := range c.AttachmentTypes {
+		mimeType, size, hasSize := strings.Cut(entry, "=")
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if !strings.Contains(mimeType, "/") {
+			return nil, fmt.Errorf("ожидается тип вида application/pdf, получено %q", entry)
+		}
+		var limit int64
+		if hasSize {
+			var err error
+			if limit, err = parseByteSize(size); err != nil {
+				return nil, fmt.Errorf("%s: %v", mimeType, err)
+			}
+		}
+		limits[mimeType] = limit
+	}
+	return limits, nil
+}
+
+// parseByteSize разбирает размер в байтах с необязательным суффиксом K, M или G (степени 1024)
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("некорректный размер %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// validPort проверяет номер TCP-порта
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// Print выводит итоговую конфигурацию в формате файла конфигурации;
+// секреты заменяются звёздочками
+func (c ConfigStruct) Print(w io.Writer) error {
+	masked := c
+	for _, f := range masked.fields() {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString("********")
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(masked); err != nil {
+		return err
+	}
+	return enc.Close()
+}
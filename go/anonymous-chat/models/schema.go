@@ -0,0 +1,179 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// migrations содержит идемпотентные SQL-запросы, приводящие схему к актуальному виду.
+// Новые изменения схемы добавляются в конец списка.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS rooms (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		id SERIAL PRIMARY KEY,
+		room_id INTEGER NOT NULL REFERENCES rooms(id),
+		nickname TEXT NOT NULL,
+		type TEXT NOT NULL,
+		content TEXT NOT NULL DEFAULT '',
+		media_url TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+
+	// Метаданные комнат
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS topic TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS visibility TEXT NOT NULL DEFAULT 'public'`,
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT NOW()`,
+
+	// Участники комнат и отметки о прочтении
+	`CREATE TABLE IF NOT EXISTS room_members (
+		identity TEXT NOT NULL,
+		room_id INTEGER NOT NULL REFERENCES rooms(id),
+		nickname TEXT NOT NULL DEFAULT '',
+		last_read_id BIGINT NOT NULL DEFAULT 0,
+		joined_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (identity, room_id)
+	)`,
+
+	// Сквозное шифрование: сервер хранит только непрозрачный конверт
+	`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS ciphertext TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT ''`,
+
+	// Исходящие вебхуки и журнал их доставки
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id BIGSERIAL PRIMARY KEY,
+		room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id BIGINT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_status_code INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+
+	// Токены ботов, публикующих сообщения через HTTP
+	`CREATE TABLE IF NOT EXISTS bot_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	)`,
+
+	// Встроенные боты, включённые в комнатах
+	`CREATE TABLE IF NOT EXISTS room_bots (
+		room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+		bot TEXT NOT NULL,
+		enabled_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (room_id, bot)
+	)`,
+
+	// Размеры изображений и миниатюры
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_width INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_height INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS thumbnails JSONB NOT NULL DEFAULT '[]'`,
+
+	// Загрузки с адресом по содержимому; refcount — число сообщений, ссылающихся на файл
+	`CREATE TABLE IF NOT EXISTS uploads (
+		filename TEXT PRIMARY KEY,
+		size BIGINT NOT NULL,
+		refcount INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS uploads_unreferenced ON uploads (updated_at) WHERE refcount <= 0`,
+	// Файлы, на которые ссылается сообщение: медиафайл и миниатюры
+	`CREATE OR REPLACE FUNCTION message_upload_files(media_url TEXT, thumbnails JSONB) RETURNS TEXT[] AS $$
+		SELECT ARRAY(
+			SELECT substring(u FROM '^/uploads/([^/]+)$')
+			FROM unnest(ARRAY[media_url] || ARRAY(SELECT value->>'url' FROM jsonb_array_elements(thumbnails))) u
+			WHERE u LIKE '/uploads/%')
+	$$ LANGUAGE SQL IMMUTABLE`,
+	// Счётчик ссылок поддерживается триггером, поэтому учитываются и каскадные
+	// удаления сообщений вместе с комнатой
+	`CREATE OR REPLACE FUNCTION count_upload_refs() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' THEN
+			UPDATE uploads SET refcount = refcount + 1
+			WHERE filename = ANY(message_upload_files(NEW.media_url, NEW.thumbnails));
+			RETURN NEW;
+		END IF;
+		UPDATE uploads SET refcount = refcount - 1, updated_at = NOW()
+		WHERE filename = ANY(message_upload_files(OLD.media_url, OLD.thumbnails));
+		RETURN OLD;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS messages_upload_refs ON messages`,
+	`CREATE TRIGGER messages_upload_refs AFTER INSERT OR DELETE ON messages
+		FOR EACH ROW EXECUTE FUNCTION count_upload_refs()`,
+
+	// Загрузки по частям: части хранятся в базе, поэтому загрузку можно
+	// продолжить через любую реплику
+	`CREATE TABLE IF NOT EXISTS resumable_uploads (
+		id TEXT PRIMARY KEY,
+		identity TEXT NOT NULL,
+		room TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		encrypted JSONB,
+		upload_length BIGINT NOT NULL,
+		upload_offset BIGINT NOT NULL DEFAULT 0,
+		completed BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS resumable_uploads_expires ON resumable_uploads (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS resumable_upload_chunks (
+		upload_id TEXT NOT NULL REFERENCES resumable_uploads(id) ON DELETE CASCADE,
+		chunk_offset BIGINT NOT NULL,
+		data BYTEA NOT NULL,
+		PRIMARY KEY (upload_id, chunk_offset)
+	)`,
+
+	// Имя и размер файла для вложений
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_filename TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_size BIGINT NOT NULL DEFAULT 0`,
+
+	// Длительность и осциллограмма голосовых сообщений
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS media_duration DOUBLE PRECISION NOT NULL DEFAULT 0`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS waveform JSONB NOT NULL DEFAULT '[]'`,
+
+	// Признак сообщения бота: ник бота не отличить от ника человека
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE`,
+
+	// Последнее сообщение комнаты для сортировки лобби по активности
+	`CREATE INDEX IF NOT EXISTS messages_room_created ON messages (room_id, created_at)`,
+}
+
+// Migrate применяет миграции схемы базы данных
+func Migrate() {
+	for _, query := range migrations {
+		if _, err := DB.Exec(context.Background(), query); err != nil {
+			slog.Error("Ошибка при миграции базы данных", "err", err)
+			os.Exit(1)
+		}
+	}
+	slog.Info("Схема базы данных актуальна")
+}
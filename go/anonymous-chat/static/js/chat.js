@@ -6,8 +6,7 @@ const nicknameInput = document.getElementById('nickname'); // Элемент с
 const room = roomInput ? roomInput.value : ""; // Получение значения комнаты
 const nickname = nicknameInput ? nicknameInput.value : "Anonymous"; // Получение значения никнейма
 
-const wsProtocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-const ws = new WebSocket(`${wsProtocol}://${window.location.host}/ws/${room}?nickname=${encodeURIComponent(nickname)}`);
+const ws = ChatTransport.connect(room, nickname); // WebSocket или резервный SSE
 
 const messages = document.getElementById('messages'); // Блок для отображения сообщений
 const messageForm = document.getElementById('messageForm'); // Форма отправки текстовых сообщений
@@ -19,48 +18,363 @@ const imageInput = document.getElementById('imageInput'); // Поле выбор
 const uploadVoiceForm = document.getElementById('uploadVoiceForm'); // Форма загрузки голосовых сообщений
 const voiceInput = document.getElementById('voiceInput'); // Поле выбора аудиофайла
 
+const uploadFileForm = document.getElementById('uploadFileForm'); // Форма отправки файлов и видео
+const fileInput = document.getElementById('fileInput'); // Поле выбора файла
+
 const recordButton = document.getElementById('recordButton'); // Кнопка записи аудио
 const recordedAudio = document.getElementById('recordedAudio'); // Аудио-плеер для записи
 const voiceForm = document.getElementById('voiceForm'); // Форма отправки записанного аудио
 
-// Обработчики WebSocket-событий
+// Обработчики событий соединения
 ws.onopen = function() {
-    console.log("WebSocket подключено");
+    console.log("Соединение установлено");
 };
 
-ws.onmessage = function(event) {
-    const msg = JSON.parse(event.data);
+// Отметки о прочтении
+let lastMessageId = 0; // ID последнего полученного сообщения
+let lastReportedId = 0; // ID, о прочтении которого уже сообщено серверу
+const readers = {}; // ник -> ID последнего прочитанного сообщения
+let readTimer = null;
+
+const seenBy = document.createElement('div');
+seenBy.id = 'seenBy';
+messages.insertAdjacentElement('afterend', seenBy);
+
+// Сообщает серверу о прочтении, если вкладка активна
+function reportRead() {
+    if (document.visibilityState !== 'visible' || lastMessageId <= lastReportedId) {
+        return;
+    }
+    clearTimeout(readTimer);
+    readTimer = setTimeout(() => {
+        if (ws.open) {
+            ws.send('read', { last_read_id: lastMessageId });
+            lastReportedId = lastMessageId;
+        }
+    }, 500);
+}
+
+// Показывает, кто прочитал последнее сообщение
+function renderSeenBy() {
+    const names = Object.keys(readers).filter(n => n !== nickname && readers[n] >= lastMessageId && lastMessageId > 0);
+    seenBy.textContent = names.length ? `Прочитали: ${names.join(', ')}` : '';
+}
+
+document.addEventListener('visibilitychange', reportRead);
+
+ws.onmessage = function(msg) {
+
+    if (msg.type === 'seen') {
+        readers[msg.nickname] = Math.max(readers[msg.nickname] || 0, msg.last_read_id);
+        renderSeenBy();
+        return;
+    }
+
+    if (msg.type && msg.type.startsWith('dm_')) {
+        handleDirectMessageEvent(msg);
+        return;
+    }
+
+    if (msg.type === 'reaction') {
+        addReaction(msg);
+        return;
+    }
+
+    // После переподключения сервер присылает историю заново
+    if (msg.id && messages.querySelector(`[data-id="${msg.id}"]`)) {
+        return;
+    }
+
     const item = document.createElement('div');
+    item.dataset.nickname = msg.nickname;
+    if (msg.bot) {
+        item.classList.add('bot');
+    }
+    if (msg.id) {
+        item.dataset.id = msg.id;
+        lastMessageId = Math.max(lastMessageId, msg.id);
+    }
 
-    if (msg.type === 'text') {
-        item.textContent = `[${msg.created_at}] ${msg.nickname}: ${msg.content}`;
+    if (msg.type === 'encrypted') {
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: …`;
+        renderEncrypted(item, msg);
+    } else if (msg.type === 'text') {
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: ${msg.content}`;
     } else if (msg.type === 'image') {
-        item.innerHTML = `[${msg.created_at}] ${msg.nickname}: <br><img src="${msg.media_url}" alt="Image" style="max-width: 300px;">`;
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: `;
+        item.appendChild(document.createElement('br'));
+        item.appendChild(imagePreview(msg));
     } else if (msg.type === 'voice') {
-        item.innerHTML = `[${msg.created_at}] ${msg.nickname}: <br><audio controls src="${msg.media_url}"></audio>`;
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: `;
+        item.appendChild(document.createElement('br'));
+        item.appendChild(voiceNote(msg));
+    } else if (msg.type === 'video') {
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: `;
+        item.appendChild(document.createElement('br'));
+        const video = document.createElement('video');
+        video.controls = true;
+        video.preload = 'metadata';
+        video.src = msg.media_url;
+        item.appendChild(video);
+    } else if (msg.type === 'file') {
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: `;
+        item.appendChild(attachmentLink(msg));
     } else {
         // Обработка других типов сообщений, если необходимо
-        item.textContent = `[${msg.created_at}] ${msg.nickname}: ${msg.content}`;
+        item.textContent = `[${msg.created_at}] ${senderLabel(msg)}: ${msg.content}`;
     }
 
     messages.appendChild(item);
     messages.scrollTop = messages.scrollHeight;
+    renderSeenBy();
+    reportRead();
 };
 
+// Подпись отправителя; сообщения ботов помечаются, чтобы их нельзя было спутать с людьми
+function senderLabel(msg) {
+    return msg.bot ? `${msg.nickname} [бот]` : msg.nickname;
+}
+
+// Добавляет реакцию к сообщению с ID reply_to
+function addReaction(msg) {
+    const target = messages.querySelector(`[data-id="${msg.reply_to}"]`);
+    if (!target) {
+        return;
+    }
+    const reaction = document.createElement('span');
+    reaction.className = 'reaction';
+    reaction.title = senderLabel(msg);
+    reaction.textContent = msg.content;
+    target.appendChild(reaction);
+}
+
+// Расшифровывает сообщение зашифрованной комнаты и отображает его в элементе
+function renderEncrypted(item, msg) {
+    const prefix = `[${msg.created_at}] ${senderLabel(msg)}: `;
+    if (!E2E.enabled || !msg.encrypted) {
+        item.textContent = prefix + '[зашифрованное сообщение]';
+        return;
+    }
+    if (msg.media_url) {
+        E2E.openFile(msg.media_url, msg.encrypted)
+            .then(file => {
+                item.textContent = prefix;
+                item.appendChild(document.createElement('br'));
+                let media;
+                if (file.meta.mime.startsWith('image/')) {
+                    media = document.createElement('img');
+                    media.style.maxWidth = '300px';
+                } else if (file.meta.mime.startsWith('audio/')) {
+                    media = document.createElement('audio');
+                    media.controls = true;
+                } else if (file.meta.mime.startsWith('video/')) {
+                    media = document.createElement('video');
+                    media.controls = true;
+                } else {
+                    media = document.createElement('a');
+                    media.download = file.meta.name;
+                    media.textContent = file.meta.name;
+                    media.href = file.url;
+                }
+                if (media.tagName !== 'A') {
+                    media.src = file.url;
+                }
+                item.appendChild(media);
+            })
+            .catch(() => item.textContent = prefix + '[не удалось расшифровать файл]');
+        return;
+    }
+    E2E.open(msg.encrypted)
+        .then(payload => item.textContent = prefix + payload.text)
+        .catch(() => item.textContent = prefix + '[не удалось расшифровать сообщение]');
+}
+
+// Превью изображения: браузер выбирает подходящую миниатюру из srcset,
+// а полный размер открывается по ссылке
+function imagePreview(msg) {
+    const link = document.createElement('a');
+    link.href = msg.media_url;
+    link.target = '_blank';
+    link.rel = 'noopener';
+
+    const img = document.createElement('img');
+    img.alt = 'Image';
+    img.src = msg.media_url;
+    if (msg.width && msg.height) {
+        // Размеры заранее резервируют место, и лента не прыгает при загрузке
+        img.width = msg.width;
+        img.height = msg.height;
+    }
+    if (msg.thumbnails && msg.thumbnails.length) {
+        const sources = msg.thumbnails.map(t => `${t.url} ${t.width}w`);
+        if (msg.width) {
+            sources.push(`${msg.media_url} ${msg.width}w`);
+        }
+        img.srcset = sources.join(', ');
+        img.sizes = '300px';
+        img.src = msg.thumbnails[0].url;
+    }
+    link.appendChild(img);
+    return link;
+}
+
+// Голосовое сообщение: осциллограмма и длительность, которые сервер вычислил
+// при загрузке, видны до начала воспроизведения; щелчок по осциллограмме
+// перематывает запись
+function voiceNote(msg) {
+    const note = document.createElement('div');
+    note.className = 'voice-note';
+    const audio = document.createElement('audio');
+    audio.controls = true;
+    audio.preload = 'none';
+    audio.src = msg.media_url;
+
+    if (msg.waveform && msg.waveform.length) {
+        const waveform = document.createElement('div');
+        waveform.className = 'waveform';
+        const bars = msg.waveform.map(level => {
+            const bar = document.createElement('span');
+            bar.style.height = `${Math.max(level, 4)}%`;
+            waveform.appendChild(bar);
+            return bar;
+        });
+        audio.addEventListener('timeupdate', () => {
+            const total = audio.duration || msg.duration;
+            const played = total ? audio.currentTime / total * bars.length : 0;
+            bars.forEach((bar, i) => bar.classList.toggle('played', i < played));
+        });
+        waveform.addEventListener('click', e => {
+            const total = audio.duration || msg.duration;
+            if (!total) return;
+            const rect = waveform.getBoundingClientRect();
+            audio.currentTime = (e.clientX - rect.left) / rect.width * total;
+            audio.play();
+        });
+        note.appendChild(waveform);
+    }
+    if (msg.duration) {
+        const duration = document.createElement('span');
+        duration.className = 'voice-duration';
+        duration.textContent = formatDuration(msg.duration);
+        note.appendChild(duration);
+    }
+    note.appendChild(audio);
+    return note;
+}
+
+function formatDuration(seconds) {
+    const total = Math.round(seconds);
+    return `${Math.floor(total / 60)}:${String(total % 60).padStart(2, '0')}`;
+}
+
+// Ссылка на вложение: имя файла передаётся серверу, чтобы он отдал его
+// в Content-Disposition, — адрес файла состоит из хеша содержимого
+function attachmentLink(msg) {
+    const link = document.createElement('a');
+    link.href = `${msg.media_url}?name=${encodeURIComponent(msg.filename)}`;
+    link.download = msg.filename;
+    link.textContent = `${msg.filename} (${formatSize(msg.size)})`;
+    return link;
+}
+
+function formatSize(bytes) {
+    const units = ['байт', 'КБ', 'МБ', 'ГБ'];
+    let size = bytes || 0;
+    let unit = 0;
+    while (size >= 1024 && unit < units.length - 1) {
+        size /= 1024;
+        unit++;
+    }
+    return `${unit ? size.toFixed(1) : size} ${units[unit]}`;
+}
+
+// Отправляет файл по частям с возобновлением после обрыва. В зашифрованной
+// комнате на сервер уходят зашифрованный файл и конверт с его именем и типом.
+async function sendFile(kind, file, filename) {
+    const name = filename || file.name;
+    const metadata = { room: room, kind: kind, filename: name, filetype: file.type };
+    let blob = file;
+    if (E2E.enabled) {
+        const sealed = await E2E.sealFile(file, name);
+        blob = sealed.blob;
+        metadata.filename = 'encrypted.bin';
+        metadata.filetype = 'application/octet-stream';
+        metadata.ciphertext = sealed.envelope.ciphertext;
+        metadata.nonce = sealed.envelope.nonce;
+        metadata.key_id = sealed.envelope.key_id;
+    }
+    return ResumableUpload.upload(blob, metadata);
+}
+
+// Личная переписка: приглашение по клику на сообщение участника
+messages.addEventListener('click', function(e) {
+    const item = e.target.closest('div[data-nickname]');
+    if (!item) {
+        return;
+    }
+    const target = item.dataset.nickname;
+    if (target === nickname || target === 'System') {
+        return;
+    }
+    if (confirm(`Пригласить ${target} в личную переписку?`)) {
+        ws.send('dm.request', { target: target });
+    }
+});
+
+// Показывает служебную строку в ленте сообщений
+function showNotice(text, link) {
+    const item = document.createElement('div');
+    item.className = 'notice';
+    item.textContent = text;
+    if (link) {
+        const a = document.createElement('a');
+        a.href = link;
+        a.target = '_blank';
+        a.textContent = ' Открыть';
+        item.appendChild(a);
+    }
+    messages.appendChild(item);
+    messages.scrollTop = messages.scrollHeight;
+}
+
+// Обработка событий личной переписки
+function handleDirectMessageEvent(msg) {
+    if (msg.type === 'dm_invite') {
+        const accepted = confirm(`${msg.nickname} приглашает вас в личную переписку. Принять?`);
+        ws.send(accepted ? 'dm.accept' : 'dm.decline', { invite: msg.invite });
+    } else if (msg.type === 'dm_ready') {
+        const link = `/chat/${encodeURIComponent(msg.room)}?nickname=${encodeURIComponent(nickname)}`;
+        showNotice(`Личная переписка с ${msg.target} готова.`, link);
+    } else if (msg.type === 'dm_error') {
+        showNotice(msg.target ? `${msg.target}: ${msg.content}` : msg.content);
+    }
+}
+
 ws.onerror = function(error) {
-    console.error("WebSocket ошибка:", error);
+    console.error("Ошибка соединения:", error);
+};
+
+// Сервер отклонил операцию: например, сообщение слишком длинное или отправлено слишком часто
+ws.onreject = function(error) {
+    showNotice(error.code === 'rate_limited' ? 'Слишком много сообщений, подождите немного.' : error.message);
 };
 
 // Отправка текстовых сообщений
 messageForm.addEventListener('submit', function(e) {
     e.preventDefault();
     const text = messageInput.value.trim();
-    if (text) {
+    if (text && E2E.enabled) {
+        // В зашифрованной комнате на сервер уходит только конверт
+        E2E.seal({ text: text }).then(envelope => {
+            ws.send('message.send', { type: 'encrypted', encrypted: envelope });
+        });
+        messageInput.value = '';
+    } else if (text) {
         const msg = {
             type: 'text', // Указываем тип сообщения
             content: text,
         };
-        ws.send(JSON.stringify(msg));
+        ws.send('message.send', msg);
         messageInput.value = '';
     }
 });
@@ -74,23 +388,10 @@ uploadImageForm.addEventListener('submit', function(e) {
         return;
     }
 
-    const formData = new FormData();
-    formData.append('image', file);
-    formData.append('room', room);
-
-    fetch('/upload-image', {
-        method: 'POST',
-        body: formData
-    })
-    .then(response => {
-        if (!response.ok) {
-            throw new Error("Ошибка при загрузке изображения");
-        }
-        return response.json();
-    })
-    .then(data => {
-        console.log("Изображение загружено:", data);
-        // Опционально, можно добавить уведомление пользователю
+    // Сообщение с изображением придёт от сервера, когда файл будет принят целиком
+    sendFile('image', file)
+    .then(url => {
+        console.log("Изображение загружено:", url);
     })
     .catch(error => {
         console.error("Ошибка при загрузке изображения:", error);
@@ -110,23 +411,9 @@ uploadVoiceForm.addEventListener('submit', function(e) {
         return;
     }
 
-    const formData = new FormData();
-    formData.append('voice', file);
-    formData.append('room', room);
-
-    fetch('/upload-voice', {
-        method: 'POST',
-        body: formData
-    })
-    .then(response => {
-        if (!response.ok) {
-            throw new Error("Ошибка при загрузке голосового сообщения");
-        }
-        return response.json();
-    })
-    .then(data => {
-        console.log("Голосовое сообщение загружено:", data);
-        // Опционально, можно добавить уведомление пользователю
+    sendFile('voice', file)
+    .then(url => {
+        console.log("Голосовое сообщение загружено:", url);
     })
     .catch(error => {
         console.error("Ошибка при загрузке голосового сообщения:", error);
@@ -137,6 +424,28 @@ uploadVoiceForm.addEventListener('submit', function(e) {
     voiceInput.value = '';
 });
 
+// Отправка файлов и видео
+uploadFileForm.addEventListener('submit', function(e) {
+    e.preventDefault();
+    const file = fileInput.files[0];
+    if (!file) {
+        alert("Пожалуйста, выберите файл для отправки.");
+        return;
+    }
+
+    sendFile('file', file)
+    .then(url => {
+        console.log("Файл загружен:", url);
+    })
+    .catch(error => {
+        console.error("Ошибка при загрузке файла:", error);
+        alert(error instanceof ResumableUpload.UploadRejected && error.message
+            ? `Файл не принят: ${error.message}` : "Ошибка при загрузке файла.");
+    });
+
+    fileInput.value = '';
+});
+
 // Запись голосовых сообщений
 let mediaRecorder;
 let audioChunks = [];
@@ -159,7 +468,11 @@ recordButton.addEventListener('click', function() {
                 }
 
                 mediaRecorder.onstop = function() {
-                    const audioBlob = new Blob(audioChunks, { type: 'audio/wav' });
+                    // Браузер записывает в своём формате (обычно WebM или Ogg с Opus);
+                    // сервер проверяет содержимое, поэтому тип должен быть настоящим
+                    const mimeType = (mediaRecorder.mimeType || 'audio/webm').split(';')[0];
+                    const audioBlob = new Blob(audioChunks, { type: mimeType });
+                    const audioExt = mimeType.includes('ogg') ? 'ogg' : mimeType.includes('wav') ? 'wav' : 'webm';
                     audioChunks = [];
                     const audioUrl = URL.createObjectURL(audioBlob);
                     recordedAudio.src = audioUrl;
@@ -169,23 +482,9 @@ recordButton.addEventListener('click', function() {
                     // Добавление обработчика отправки голосового сообщения
                     voiceForm.addEventListener('submit', function(ev) {
                         ev.preventDefault();
-                        const formData = new FormData();
-                        formData.append('voice', audioBlob, 'voice.wav');
-                        formData.append('room', room);
-
-                        fetch('/upload-voice', {
-                            method: 'POST',
-                            body: formData
-                        })
-                        .then(response => {
-                            if (!response.ok) {
-                                throw new Error("Ошибка при загрузке голосового сообщения");
-                            }
-                            return response.json();
-                        })
-                        .then(data => {
-                            console.log("Голосовое сообщение загружено:", data);
-                            // Можно добавить уведомление пользователю
+                        sendFile('voice', audioBlob, 'voice.' + audioExt)
+                        .then(url => {
+                            console.log("Голосовое сообщение загружено:", url);
                         })
                         .catch(error => {
                             console.error("Ошибка при загрузке голосового сообщения:", error);
@@ -0,0 +1,90 @@
+// Сквозное шифрование комнаты (AES-GCM).
+// Ключ хранится только во фрагменте URL (#key=...), который браузер не отправляет на сервер.
+const E2E = (function() {
+    const encryptedInput = document.getElementById('encrypted');
+    const enabled = encryptedInput ? encryptedInput.value === 'true' : false;
+
+    // Кодирование base64 и обратно
+    function toBase64(bytes) {
+        let binary = '';
+        bytes.forEach(b => binary += String.fromCharCode(b));
+        return btoa(binary);
+    }
+
+    function fromBase64(text) {
+        return Uint8Array.from(atob(text), c => c.charCodeAt(0));
+    }
+
+    // Получение ключа из фрагмента URL или создание нового
+    function loadRawKey() {
+        const match = window.location.hash.match(/key=([A-Za-z0-9+/=_-]+)/);
+        if (match) {
+            return fromBase64(match[1].replace(/-/g, '+').replace(/_/g, '/'));
+        }
+        const raw = crypto.getRandomValues(new Uint8Array(32));
+        const encoded = toBase64(raw).replace(/\+/g, '-').replace(/\//g, '_');
+        history.replaceState(null, '', `${window.location.pathname}${window.location.search}#key=${encoded}`);
+        return raw;
+    }
+
+    let keyPromise = null;
+    let keyIdPromise = null;
+    if (enabled) {
+        const raw = loadRawKey();
+        keyPromise = crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['encrypt', 'decrypt']);
+        // Идентификатор ключа — первые 8 байт SHA-256 ключа
+        keyIdPromise = crypto.subtle.digest('SHA-256', raw).then(hash =>
+            Array.from(new Uint8Array(hash).slice(0, 8)).map(b => b.toString(16).padStart(2, '0')).join(''));
+    }
+
+    // Шифрует байты и возвращает шифртекст и nonce
+    async function encryptBytes(bytes) {
+        const key = await keyPromise;
+        const nonce = crypto.getRandomValues(new Uint8Array(12));
+        const ciphertext = await crypto.subtle.encrypt({ name: 'AES-GCM', iv: nonce }, key, bytes);
+        return { ciphertext: new Uint8Array(ciphertext), nonce: nonce };
+    }
+
+    // Расшифровывает байты
+    async function decryptBytes(ciphertext, nonce) {
+        const key = await keyPromise;
+        return new Uint8Array(await crypto.subtle.decrypt({ name: 'AES-GCM', iv: nonce }, key, ciphertext));
+    }
+
+    // Шифрует объект в конверт {ciphertext, nonce, key_id}
+    async function seal(payload) {
+        const data = new TextEncoder().encode(JSON.stringify(payload));
+        const sealed = await encryptBytes(data);
+        return {
+            ciphertext: toBase64(sealed.ciphertext),
+            nonce: toBase64(sealed.nonce),
+            key_id: await keyIdPromise,
+        };
+    }
+
+    // Расшифровывает конверт в объект
+    async function open(envelope) {
+        if (envelope.key_id !== await keyIdPromise) {
+            throw new Error('Сообщение зашифровано другим ключом');
+        }
+        const data = await decryptBytes(fromBase64(envelope.ciphertext), fromBase64(envelope.nonce));
+        return JSON.parse(new TextDecoder().decode(data));
+    }
+
+    // Шифрует файл; тип, имя и nonce файла помещаются в зашифрованные метаданные
+    async function sealFile(file, name) {
+        const sealed = await encryptBytes(new Uint8Array(await file.arrayBuffer()));
+        const envelope = await seal({ name: name, mime: file.type, file_nonce: toBase64(sealed.nonce) });
+        return { blob: new Blob([sealed.ciphertext], { type: 'application/octet-stream' }), envelope: envelope };
+    }
+
+    // Загружает и расшифровывает файл, возвращает ссылку на него и метаданные
+    async function openFile(url, envelope) {
+        const meta = await open(envelope);
+        const response = await fetch(url);
+        const data = await decryptBytes(new Uint8Array(await response.arrayBuffer()), fromBase64(meta.file_nonce));
+        return { url: URL.createObjectURL(new Blob([data], { type: meta.mime })), meta: meta };
+    }
+
+    return { enabled, seal, open, sealFile, openFile };
+})();
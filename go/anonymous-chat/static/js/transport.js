@@ -0,0 +1,93 @@
+// Соединение с комнатой: WebSocket, а если он недоступен (например, его рвёт прокси) —
+// поток Server-Sent Events для приёма и POST-запросы для отправки.
+// Принудительно включить SSE можно параметром страницы ?transport=sse.
+//
+// Обмен идёт конвертами протокола {v, op, id, payload}: conn.send(op, payload)
+// отправляет операцию, conn.onmessage получает payload событий сервера вместе с op,
+// conn.onreject — ошибки операций (кадры error).
+const ChatTransport = (function() {
+    const PROTOCOL_VERSION = 1;
+
+    function connect(room, nickname) {
+        const conn = { open: false, onopen: null, onmessage: null, onerror: null, onreject: null };
+        const query = `nickname=${encodeURIComponent(nickname)}&v=${PROTOCOL_VERSION}`;
+        let nextId = 1;
+        let write = null;
+
+        // Разбирает кадр сервера и передаёт его обработчикам
+        function receive(data) {
+            const frame = JSON.parse(data);
+            if (frame.op === 'error') {
+                console.warn("Операция отклонена:", frame.payload.code, frame.payload.message);
+                if (conn.onreject) conn.onreject(frame.payload);
+            } else if (frame.op === 'hello') {
+                console.log("Версия протокола:", frame.payload.version);
+            } else if (frame.op !== 'ack' && frame.op !== 'pong') {
+                if (conn.onmessage) conn.onmessage(frame.payload, frame.op);
+            }
+        }
+
+        conn.send = function(op, payload) {
+            if (!write) return;
+            write(JSON.stringify({ v: PROTOCOL_VERSION, op: op, id: String(nextId++), payload: payload }));
+        };
+
+        function connectSSE() {
+            console.log("Переход на резервный транспорт SSE");
+            let session = null;
+            const source = new EventSource(`/sse/${encodeURIComponent(room)}?${query}`);
+            source.addEventListener('session', function(event) {
+                session = JSON.parse(event.data).session;
+                conn.open = true;
+                if (conn.onopen) conn.onopen();
+            });
+            source.onmessage = function(event) {
+                receive(event.data);
+            };
+            source.onerror = function(error) {
+                // EventSource переподключается сам и получает новую сессию
+                conn.open = false;
+                if (conn.onerror) conn.onerror(error);
+            };
+            write = function(data) {
+                if (!session) return;
+                fetch(`/sse/${encodeURIComponent(room)}/send?session=${session}`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: data,
+                }).catch(error => console.error("Ошибка отправки:", error));
+            };
+        }
+
+        if (new URLSearchParams(window.location.search).get('transport') === 'sse' || !window.WebSocket) {
+            connectSSE();
+            return conn;
+        }
+
+        const wsProtocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
+        const ws = new WebSocket(`${wsProtocol}://${window.location.host}/ws/${room}?${query}`);
+        let opened = false;
+        ws.onopen = function() {
+            opened = true;
+            conn.open = true;
+            if (conn.onopen) conn.onopen();
+        };
+        ws.onmessage = function(event) {
+            receive(event.data);
+        };
+        ws.onerror = function(error) {
+            if (opened && conn.onerror) conn.onerror(error);
+        };
+        ws.onclose = function() {
+            conn.open = false;
+            // Соединение так и не установилось — WebSocket недоступен
+            if (!opened) connectSSE();
+        };
+        write = function(data) {
+            if (ws.readyState === WebSocket.OPEN) ws.send(data);
+        };
+        return conn;
+    }
+
+    return { connect: connect };
+})();
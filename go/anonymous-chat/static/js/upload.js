@@ -0,0 +1,84 @@
+// Загрузка файлов по частям с возобновлением (протокол tus 1.0).
+// Файл отправляется частями по CHUNK_SIZE; при обрыве соединения клиент
+// спрашивает у сервера принятое смещение и продолжает с него, а не с нуля.
+//
+// ResumableUpload.upload(blob, metadata, onProgress) возвращает промис,
+// который выполняется, когда сервер принял и проверил файл целиком.
+const ResumableUpload = (function() {
+    const TUS_VERSION = '1.0.0';
+    const ENDPOINT = '/upload-resumable';
+    const CHUNK_SIZE = 4 * 1024 * 1024;
+    const RETRY_DELAYS = [1000, 3000, 5000, 10000, 20000];
+
+    // Ошибка, после которой повтор бессмысленен: сервер отклонил файл
+    class UploadRejected extends Error {}
+
+    function encodeMetadata(metadata) {
+        return Object.entries(metadata)
+            .filter(([, value]) => value !== undefined && value !== null && value !== '')
+            .map(([key, value]) => {
+                const bytes = new TextEncoder().encode(String(value));
+                let binary = '';
+                bytes.forEach(b => { binary += String.fromCharCode(b); });
+                return `${key} ${btoa(binary)}`;
+            })
+            .join(',');
+    }
+
+    async function request(method, url, headers, body) {
+        const response = await fetch(url, {
+            method: method,
+            headers: Object.assign({ 'Tus-Resumable': TUS_VERSION }, headers),
+            body: body,
+        });
+        // 4xx, кроме конфликта смещения, означает отказ сервера, а не сбой сети
+        if (response.status >= 400 && response.status < 500 && response.status !== 409) {
+            throw new UploadRejected(await response.text());
+        }
+        if (!response.ok) {
+            throw new Error(`${method} ${url}: ${response.status}`);
+        }
+        return response;
+    }
+
+    async function create(blob, metadata) {
+        const response = await request('POST', ENDPOINT, {
+            'Upload-Length': String(blob.size),
+            'Upload-Metadata': encodeMetadata(metadata),
+        });
+        return response.headers.get('Location');
+    }
+
+    async function currentOffset(url) {
+        const response = await request('HEAD', url, {});
+        return parseInt(response.headers.get('Upload-Offset'), 10);
+    }
+
+    async function upload(blob, metadata, onProgress) {
+        const url = await create(blob, metadata);
+        let offset = 0;
+        let attempt = 0;
+        while (offset < blob.size) {
+            try {
+                const response = await request('PATCH', url, {
+                    'Content-Type': 'application/offset+octet-stream',
+                    'Upload-Offset': String(offset),
+                }, blob.slice(offset, offset + CHUNK_SIZE));
+                offset = parseInt(response.headers.get('Upload-Offset'), 10);
+                attempt = 0;
+                if (onProgress) onProgress(offset, blob.size);
+            } catch (error) {
+                if (error instanceof UploadRejected || attempt >= RETRY_DELAYS.length) {
+                    throw error;
+                }
+                console.warn("Загрузка прервана, повтор:", error);
+                await new Promise(resolve => setTimeout(resolve, RETRY_DELAYS[attempt++]));
+                // Сервер сохраняет полученное до обрыва, поэтому продолжаем с его смещения
+                offset = await currentOffset(url).catch(() => offset);
+            }
+        }
+        return url;
+    }
+
+    return { upload: upload, UploadRejected: UploadRejected };
+})();
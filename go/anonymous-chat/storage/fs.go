@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Префикс временных файлов, в которые пишется объект до переименования
+const fsTempPrefix = ".upload-"
+
+// Временные файлы старше этого срока остались от прерванной записи
+const fsStaleTempAge = time.Hour
+
+// FS хранит объекты файлами в локальной директории.
+// Подходит только для одной реплики или общей файловой системы.
+type FS struct {
+	dir string
+}
+
+// NewFS создаёт директорию при необходимости и удаляет временные файлы,
+// оставшиеся от прерванных записей
+func NewFS(dir string) (*FS, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	s := &FS{dir: dir}
+	s.removeStaleTemps()
+	return s, nil
+}
+
+// Put записывает объект во временный файл и атомарно переименовывает его
+func (s *FS) Put(ctx context.Context, name string, body io.ReadSeeker, size int64, checksum, contentType string) error {
+	if !ValidName(name) {
+		return errInvalidName
+	}
+	tmp, err := os.CreateTemp(s.dir, fsTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // после переименования не найдёт файла
+	_, err = io.Copy(tmp, body)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+// Open открывает файл объекта
+func (s *FS) Open(ctx context.Context, name string) (io.ReadSeekCloser, Info, error) {
+	if !ValidName(name) {
+		return nil, Info{}, ErrNotExist
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, Info{}, ErrNotExist
+	}
+	return f, Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete удаляет файл объекта
+func (s *FS) Delete(ctx context.Context, name string) error {
+	if !ValidName(name) {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Ping проверяет, что в директорию можно писать
+func (s *FS) Ping(ctx context.Context) error {
+	f, err := os.CreateTemp(s.dir, fsTempPrefix+"health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// removeStaleTemps удаляет временные файлы, оставшиеся от прерванных записей
+func (s *FS) removeStaleTemps() {
+	temps, err := filepath.Glob(filepath.Join(s.dir, fsTempPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, name := range temps {
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > fsStaleTempAge {
+			if err := os.Remove(name); err == nil {
+				slog.Debug("Удалён временный файл загрузки", "file", name)
+			}
+		}
+	}
+}
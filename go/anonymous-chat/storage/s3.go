@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Максимальный срок действия подписанной ссылки по спецификации SigV4
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// Хеш пустого тела запроса
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config описывает подключение к S3-совместимому хранилищу
+type S3Config struct {
+	Endpoint  string // например https://s3.eu-central-1.amazonaws.com или http://localhost:9000
+	Region    string
+	Bucket    string
+	Prefix    string // префикс ключей объектов
+	AccessKey string
+	SecretKey string
+	// PathStyle адресует бакет в пути (endpoint/bucket/key), а не в имени
+	// хоста (bucket.endpoint/key); MinIO по умолчанию понимает только такой вид
+	PathStyle bool
+}
+
+// S3 хранит объекты в бакете S3-совместимого сервиса.
+// Запросы подписываются AWS Signature Version 4.
+type S3 struct {
+	cfg    S3Config
+	base   *url.URL // адрес бакета
+	client *http.Client
+}
+
+// NewS3 проверяет параметры подключения; сеть при этом не используется
+func NewS3(cfg S3Config) (*S3, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("некорректный адрес S3 %q", cfg.Endpoint)
+	}
+	base := *endpoint
+	if cfg.PathStyle {
+		base.Path = endpoint.Path + "/" + cfg.Bucket
+	} else {
+		base.Host = cfg.Bucket + "." + endpoint.Host
+	}
+	return &S3{
+		cfg:    cfg,
+		base:   &base,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// objectURL возвращает адрес объекта; ключ кодируется по правилам SigV4
+func (s *S3) objectURL(name string) *url.URL {
+	u := *s.base
+	u.Path = s.base.Path + "/" + s.cfg.Prefix + name
+	u.RawPath = s.base.Path + "/" + uriEncode(s.cfg.Prefix+name, false)
+	return &u
+}
+
+// Put загружает объект одним запросом PUT
+func (s *S3) Put(ctx context.Context, name string, body io.ReadSeeker, size int64, checksum, contentType string) error {
+	if !ValidName(name) {
+		return errInvalidName
+	}
+	if checksum == "" {
+		var err error
+		if checksum, err = hashReader(body); err != nil {
+			return err
+		}
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(name).String(), io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody // иначе пустое тело ушло бы кусками без длины
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.do(req, checksum)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open узнаёт размер объекта запросом HEAD; содержимое читается
+// диапазонами по мере чтения и перемотки
+func (s *S3) Open(ctx context.Context, name string) (io.ReadSeekCloser, Info, error) {
+	if !ValidName(name) {
+		return nil, Info{}, ErrNotExist
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	resp.Body.Close()
+
+	info := Info{Size: resp.ContentLength}
+	if info.Size < 0 {
+		return nil, Info{}, fmt.Errorf("S3 не сообщил размер объекта %s", name)
+	}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3Reader{ctx: ctx, store: s, name: name, size: info.Size}, info, nil
+}
+
+// Delete удаляет объект; S3 отвечает успехом и для отсутствующего объекта
+func (s *S3) Delete(ctx context.Context, name string) error {
+	if !ValidName(name) {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(name).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Ping проверяет доступность бакета запросом HEAD
+func (s *S3) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.base.String()+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PresignGet возвращает ссылку на объект, действующую ttl
+func (s *S3) PresignGet(name string, ttl time.Duration, disposition string) (string, error) {
+	if !ValidName(name) {
+		return "", errInvalidName
+	}
+	if ttl <= 0 || ttl > maxPresignTTL {
+		return "", fmt.Errorf("срок действия ссылки должен быть от 1 секунды до %s", maxPresignTTL)
+	}
+	now := time.Now().UTC()
+	u := s.objectURL(name)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format(amzDateFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if disposition != "" {
+		query.Set("response-content-disposition", disposition)
+	}
+	header := http.Header{"Host": {u.Host}}
+	signature := s.signature(now, http.MethodGet, u, query, header, []string{"host"}, "UNSIGNED-PAYLOAD")
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// Origin возвращает источник подписанных ссылок
+func (s *S3) Origin() string {
+	return s.base.Scheme + "://" + s.base.Host
+}
+
+// do подписывает и отправляет запрос. Ответ 404 превращается в ErrNotExist,
+// другие коды вне 2xx — в ошибку с текстом из ответа S3.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Host", req.URL.Host)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signed = []string{"host", "range", "x-amz-content-sha256", "x-amz-date"} // по алфавиту
+	}
+	signature := s.signature(now, req.Method, req.URL, req.URL.Query(), req.Header, signed, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, s.scope(now), strings.Join(signed, ";"), signature))
+	req.Header.Del("Host") // заголовок Host берётся из req.Host
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	return nil, responseError(req, resp)
+}
+
+// responseError извлекает код и текст ошибки из XML-ответа S3
+func responseError(req *http.Request, resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil || body.Code == "" {
+		return fmt.Errorf("S3 %s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("S3 %s %s: %s: %s: %s", req.Method, req.URL.Path, resp.Status, body.Code, body.Message)
+}
+
+// Формат времени в подписи SigV4
+const amzDateFormat = "20060102T150405Z"
+
+// scope возвращает область действия ключа подписи
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature вычисляет подпись SigV4 запроса по заданным заголовкам
+func (s *S3) signature(now time.Time, method string, u *url.URL, query url.Values, header http.Header, signed []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(amzDateFormat),
+		s.scope(now),
+		hashHex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQuery сортирует и кодирует параметры запроса по правилам SigV4
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode кодирует строку по правилам SigV4: без изменений остаются только
+// буквы, цифры и -._~, а косая черта — если encodeSlash не задан
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashReader считает SHA-256 содержимого с начала
+func hashReader(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// s3Reader читает объект запросами GET с заголовком Range начиная с текущей
+// позиции. Перемотка только запоминает позицию, поэтому http.ServeContent
+// при запросе диапазона скачивает из S3 лишь нужную часть объекта.
+type s3Reader struct {
+	ctx    context.Context
+	store  *S3
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.store.objectURL(r.name).String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		resp, err := r.store.do(req, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && r.offset > 0 {
+			resp.Body.Close()
+			return 0, fmt.Errorf("S3 не поддержал запрос диапазона: %s", resp.Status)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("отрицательная позиция")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testS3 подключается к настоящему S3-совместимому хранилищу. Тест запускается,
+// только если задан S3_TEST_ENDPOINT, например для MinIO:
+//
+//	S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_BUCKET=chat-test \
+//	S3_TEST_ACCESS_KEY=minioadmin S3_TEST_SECRET_KEY=minioadmin \
+//	S3_TEST_PATH_STYLE=1 go test ./storage
+//
+// Объекты создаются под уникальным префиксом и удаляются после теста.
+func testS3(t *testing.T) *S3 {
+	t.Helper()
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT не задан")
+	}
+	region := os.Getenv("S3_TEST_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	pathStyle, _ := strconv.ParseBool(os.Getenv("S3_TEST_PATH_STYLE"))
+	s, err := NewS3(S3Config{
+		Endpoint:  endpoint,
+		Region:    region,
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		Prefix:    "chat-test-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "/",
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		PathStyle: pathStyle,
+	})
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+	return s
+}
+
+func TestS3Integration(t *testing.T) {
+	s := testS3(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := s.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	const name = "object name+ü.txt" // ключ с символами, которые кодируются в подписи
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	t.Cleanup(func() { s.Delete(context.Background(), name) })
+
+	if err := s.Put(ctx, name, bytes.NewReader(content), int64(len(content)), "", "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		rc, info, err := s.Open(ctx, name)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer rc.Close()
+		if info.Size != int64(len(content)) {
+			t.Errorf("Size = %d, want %d", info.Size, len(content))
+		}
+		if info.ModTime.IsZero() {
+			t.Error("ModTime is zero")
+		}
+
+		all, err := io.ReadAll(rc)
+		if err != nil || !bytes.Equal(all, content) {
+			t.Errorf("ReadAll = %q, %v; want %q", all, err, content)
+		}
+
+		// Перемотка внутрь объекта читает диапазон
+		if _, err := rc.Seek(10, io.SeekStart); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		part := make([]byte, 5)
+		if _, err := io.ReadFull(rc, part); err != nil || string(part) != "abcde" {
+			t.Errorf("range read = %q, %v; want %q", part, err, "abcde")
+		}
+		if _, err := rc.Seek(-3, io.SeekEnd); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		tail, err := io.ReadAll(rc)
+		if err != nil || string(tail) != "xyz" {
+			t.Errorf("tail read = %q, %v; want %q", tail, err, "xyz")
+		}
+	})
+
+	t.Run("PresignGet", func(t *testing.T) {
+		const disposition = `attachment; filename="report.txt"`
+		link, err := s.PresignGet(name, time.Minute, disposition)
+		if err != nil {
+			t.Fatalf("PresignGet: %v", err)
+		}
+		resp, err := http.Get(link)
+		if err != nil {
+			t.Fatalf("GET presigned link: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET presigned link: %s: %s", resp.Status, body)
+		}
+		if !bytes.Equal(body, content) {
+			t.Errorf("body = %q, want %q", body, content)
+		}
+		if got := resp.Header.Get("Content-Disposition"); got != disposition {
+			t.Errorf("Content-Disposition = %q, want %q", got, disposition)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		const empty = "empty.bin"
+		t.Cleanup(func() { s.Delete(context.Background(), empty) })
+		if err := s.Put(ctx, empty, bytes.NewReader(nil), 0, "", ""); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		rc, info, err := s.Open(ctx, empty)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer rc.Close()
+		if info.Size != 0 {
+			t.Errorf("Size = %d, want 0", info.Size)
+		}
+		if data, err := io.ReadAll(rc); err != nil || len(data) != 0 {
+			t.Errorf("ReadAll = %q, %v; want empty", data, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := s.Delete(ctx, name); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, _, err := s.Open(ctx, name); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Open after Delete: err = %v, want ErrNotExist", err)
+		}
+		if err := s.Delete(ctx, name); err != nil {
+			t.Errorf("Delete of missing object: %v", err)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+// Package storage хранит загруженные файлы: в локальной директории или в
+// S3-совместимом сервисе (AWS S3, MinIO и другие). Объекты адресуются
+// плоскими именами, которые выбирает вызывающий код.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Ошибки хранилища
+var (
+	// ErrNotExist возвращается, если объекта с таким именем нет
+	ErrNotExist    = fs.ErrNotExist
+	errInvalidName = errors.New("недопустимое имя объекта")
+)
+
+// Info описывает сохранённый объект
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Store — хранилище объектов
+type Store interface {
+	// Put сохраняет объект целиком; существующий объект с тем же именем заменяется.
+	// checksum — шестнадцатеричный SHA-256 содержимого, если он уже известен, иначе пустая строка.
+	Put(ctx context.Context, name string, body io.ReadSeeker, size int64, checksum, contentType string) error
+	// Open открывает объект для чтения с произвольной позиции
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, Info, error)
+	// Delete удаляет объект; отсутствие объекта ошибкой не считается
+	Delete(ctx context.Context, name string) error
+	// Ping проверяет, что хранилище доступно для записи
+	Ping(ctx context.Context) error
+}
+
+// Presigner выдаёт временные ссылки, по которым клиент скачивает объект
+// из хранилища напрямую, минуя сервер
+type Presigner interface {
+	// PresignGet подписывает ссылку; непустой disposition хранилище вернёт
+	// в заголовке Content-Disposition ответа
+	PresignGet(name string, ttl time.Duration, disposition string) (string, error)
+	// Origin возвращает источник (схема и хост) подписанных ссылок
+	Origin() string
+}
+
+// ValidName проверяет, что имя объекта плоское и не служебное
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}